@@ -27,6 +27,7 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gilliek/go-opml/opml"
@@ -42,6 +43,8 @@ const (
 
 var (
 	verbose = flag.Bool("verbose", false, "show verbose logging")
+	useJSON = flag.Bool("json", false, "send requests with a JSON body")
+	useWS   = flag.Bool("websocket", false, "read events from a WebSocket connection")
 )
 
 // Export is the JSON export format
@@ -151,10 +154,22 @@ Commands:
 	channels NAME                create channel with NAME
 	channels UID NAME            update channel UID with NAME
 	channels -delete UID         delete channel with UID
+	channels order UID...        order channels by UID
 
 	timeline UID                 show posts for channel UID
 	timeline UID -after AFTER    show posts for channel UID starting from AFTER
 	timeline UID -before BEFORE  show posts for channel UID ending at BEFORE
+	timeline UID -unread         show unread posts for channel UID
+	timeline UID -source ID      show posts for channel UID from feed ID
+	timeline UID -limit N        show at most N posts for channel UID
+	timeline global              show posts of all channels
+
+	remove UID ENTRY...          remove entries ENTRY from channel UID
+	star UID ENTRY...            star entries ENTRY in channel UID
+	unstar UID ENTRY...          unstar entries ENTRY in channel UID
+
+	retention UID                show the retention policy of channel UID and the
+	                             posts it would remove
 
 	search QUERY                 search for feeds from QUERY
 	query QUERY CHANNEL          search for items matching QUERY in CHANNEL
@@ -166,6 +181,14 @@ Commands:
 
 	unfollow UID URL             unfollow URL on channel UID
 
+	mute UID                     show muted users for channel UID (or global)
+	mute UID URL                 mute URL on channel UID (or global)
+	unmute UID URL               unmute URL on channel UID (or global)
+
+	block UID                    show blocked users for channel UID (or global)
+	block UID URL                block URL on channel UID (or global)
+	unblock UID URL              unblock URL on channel UID (or global)
+
 	export opml                  export feeds as OPML
 	import opml FILENAME         import OPML feeds
 
@@ -233,6 +256,8 @@ Global arguments:
 	}
 
 	c.Logging = *verbose
+	c.UseJSON = *useJSON
+	c.UseWebSocket = *useWS
 
 	performCommands(&c, flag.Args())
 }
@@ -285,7 +310,20 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		fmt.Printf("%s\n", channel.UID)
 	}
 
-	if len(commands) == 3 && commands[0] == "channels" {
+	if len(commands) >= 3 && commands[0] == "channels" && commands[1] == "order" {
+		var uids []string
+		for _, c := range commands[2:] {
+			uid, _ := channelID(ctx, sub, c)
+			uids = append(uids, uid)
+		}
+		err := sub.ChannelsOrder(ctx, uids)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		fmt.Println("Channels ordered")
+	}
+
+	if len(commands) == 3 && commands[0] == "channels" && commands[1] != "order" {
 		if commands[1] == "-delete" {
 			uid, _ := channelID(ctx, sub, commands[2])
 			err := sub.ChannelsDelete(ctx, uid)
@@ -307,17 +345,32 @@ func performCommands(sub microsub.Microsub, commands []string) {
 	if len(commands) >= 2 && commands[0] == "timeline" {
 		channel, _ := channelID(ctx, sub, commands[1])
 
-		var timeline microsub.Timeline
-		var err error
-
-		if len(commands) == 4 && commands[2] == "-after" {
-			timeline, err = sub.TimelineGet(ctx, "", commands[3], channel)
-		} else if len(commands) == 4 && commands[2] == "-before" {
-			timeline, err = sub.TimelineGet(ctx, commands[3], "", channel)
-		} else {
-			timeline, err = sub.TimelineGet(ctx, "", "", channel)
+		var options microsub.TimelineOptions
+		for i := 2; i < len(commands); i++ {
+			switch {
+			case commands[i] == "-after" && i+1 < len(commands):
+				i++
+				options.After = commands[i]
+			case commands[i] == "-before" && i+1 < len(commands):
+				i++
+				options.Before = commands[i]
+			case commands[i] == "-source" && i+1 < len(commands):
+				i++
+				options.Source = commands[i]
+			case commands[i] == "-limit" && i+1 < len(commands):
+				i++
+				limit, err := strconv.Atoi(commands[i])
+				if err != nil {
+					log.Fatalf("invalid limit %q: %s", commands[i], err)
+				}
+				options.Limit = limit
+			case commands[i] == "-unread":
+				isRead := false
+				options.IsRead = &isRead
+			}
 		}
 
+		timeline, err := sub.TimelineGet(ctx, channel, options)
 		if err != nil {
 			log.Fatalf("An error occurred: %s\n", err)
 		}
@@ -329,6 +382,46 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		fmt.Printf("Before: %s, After: %s\n", timeline.Paging.Before, timeline.Paging.After)
 	}
 
+	if len(commands) >= 3 && commands[0] == "remove" {
+		channel, _ := channelID(ctx, sub, commands[1])
+		err := sub.RemoveItems(ctx, channel, commands[2:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) >= 3 && commands[0] == "star" {
+		channel, _ := channelID(ctx, sub, commands[1])
+		err := sub.Star(ctx, channel, commands[2:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) >= 3 && commands[0] == "unstar" {
+		channel, _ := channelID(ctx, sub, commands[1])
+		err := sub.Unstar(ctx, channel, commands[2:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) == 2 && commands[0] == "retention" {
+		channel, _ := channelID(ctx, sub, commands[1])
+		retention, err := sub.RetentionGet(ctx, channel)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+
+		policy := retention.Policy
+		fmt.Printf("Max age: %d days, max items: %d, keep unread: %t, keep starred: %t\n", policy.MaxAgeDays, policy.MaxItems, policy.KeepUnread, policy.KeepStarred)
+		for _, item := range retention.Items {
+			showItem(&item)
+		}
+
+		fmt.Printf("%d posts would be removed\n", retention.Count)
+	}
+
 	if len(commands) == 2 && commands[0] == "search" {
 		query := commands[1]
 		feeds, err := sub.Search(ctx, query)
@@ -378,7 +471,7 @@ func performCommands(sub microsub.Microsub, commands []string) {
 			log.Fatalf("An error occurred: %s\n", err)
 		}
 		for _, feed := range feeds {
-			fmt.Println(feed.URL)
+			fmt.Printf("%-10s %s\n", feed.ID, feed.URL)
 		}
 	}
 
@@ -401,6 +494,64 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		}
 	}
 
+	if len(commands) == 2 && commands[0] == "mute" {
+		uid, _ := channelID(ctx, sub, commands[1])
+		muted, err := sub.MuteGetList(ctx, uid)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		for _, card := range muted {
+			fmt.Println(card.URL)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "mute" {
+		uid, _ := channelID(ctx, sub, commands[1])
+		u := commands[2]
+		err := sub.MuteURL(ctx, uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "unmute" {
+		uid, _ := channelID(ctx, sub, commands[1])
+		u := commands[2]
+		err := sub.UnmuteURL(ctx, uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) == 2 && commands[0] == "block" {
+		uid, _ := channelID(ctx, sub, commands[1])
+		blocked, err := sub.BlockGetList(ctx, uid)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		for _, card := range blocked {
+			fmt.Println(card.URL)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "block" {
+		uid, _ := channelID(ctx, sub, commands[1])
+		u := commands[2]
+		err := sub.BlockURL(ctx, uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "unblock" {
+		uid, _ := channelID(ctx, sub, commands[1])
+		u := commands[2]
+		err := sub.UnblockURL(ctx, uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
 	if len(commands) == 2 && commands[0] == "export" {
 		filetype := commands[1]
 
@@ -431,7 +582,7 @@ func performCommands(sub microsub.Microsub, commands []string) {
 	}
 
 	if len(commands) == 1 && commands[0] == "events" {
-		c, err := sub.Events(ctx)
+		c, err := sub.Events(ctx, "")
 		if err != nil {
 			log.Fatalf("could not start event listener: %+v", err)
 		}
@@ -653,5 +804,11 @@ func showItem(item *microsub.Item) {
 		}
 	}
 	fmt.Println(item.URL)
+	if item.ID != "" {
+		fmt.Printf("ID: %s\n", item.ID)
+	}
+	if item.Channel != "" {
+		fmt.Printf("Channel: %s\n", item.Channel)
+	}
 	fmt.Println()
 }
@@ -19,6 +19,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -46,6 +47,10 @@ func (app *App) Run() error {
 	if err != nil {
 		return fmt.Errorf("while starting app: %v", err)
 	}
+	err = migrateSearch(context.Background(), app.options.database)
+	if err != nil {
+		return fmt.Errorf("while starting app: %v", err)
+	}
 	app.backend.run()
 	app.hubBackend.run()
 
@@ -66,6 +71,9 @@ func NewApp(options AppOptions) (*App, error) {
 	app.backend = backend
 
 	app.backend.AuthEnabled = options.AuthEnabled
+	app.backend.fetchTimeout = options.FetchTimeout
+	app.backend.pruneInterval = options.PruneInterval
+	app.backend.resolveRedirects = options.ResolveRedirects
 
 	app.hubBackend = &hubIncomingBackend{
 		baseURL:  options.BaseURL,
@@ -84,14 +92,16 @@ func NewApp(options AppOptions) (*App, error) {
 		handler = WithAuth(handler, app.backend)
 	}
 
+	handler = WithTimeout(handler, options.RequestTimeout)
+
 	app.backend.broker = broker
 
 	http.Handle("/microsub/", handler)
 
-	http.Handle("/incoming/", &incomingHandler{
+	http.Handle("/incoming/", WithTimeout(&incomingHandler{
 		Backend:   app.hubBackend,
 		Processor: app.backend,
-	})
+	}, options.RequestTimeout))
 
 	if !options.Headless {
 		handler, err := newMainHandler(app.backend, options.BaseURL, options.pool)
@@ -21,13 +21,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/blevesearch/bleve/v2"
 	"github.com/gomodule/redigo/redis"
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/sse"
+	"github.com/pstuifzand/ekster/pkg/timeline"
+	"github.com/pstuifzand/ekster/pkg/timeline/timelinetest"
+	"github.com/pstuifzand/ekster/pkg/userid"
+	"github.com/pstuifzand/ekster/pkg/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -77,7 +89,7 @@ type databaseSuite struct {
 }
 
 func (d *databaseSuite) TestGetChannelFromAuthorization() {
-	_, err := d.Database.Exec(`truncate "sources", "channels", "feeds", "subscriptions","items"`)
+	_, err := d.Database.Exec(`truncate "sources", "channels", "feeds", "subscriptions","items" restart identity cascade`)
 	assert.NoError(d.T(), err, "truncate sources, channels, feeds")
 	row := d.Database.QueryRow(`INSERT INTO "channels" (uid, name, created_at, updated_at) VALUES ('abcdef', 'Channel', now(), now()) RETURNING "id"`)
 	var id int
@@ -99,6 +111,784 @@ func (d *databaseSuite) TestGetChannelFromAuthorization() {
 	assert.Equal(d.T(), "", c, "channel uid found")
 }
 
+func (d *databaseSuite) TestTimelinePaging() {
+	t := d.T()
+	ctx := context.Background()
+	_, err := d.Database.Exec(`truncate "sources", "channels", "feeds", "subscriptions", "items" restart identity cascade`)
+	assert.NoError(t, err, "truncate")
+	_, err = d.Database.Exec(`INSERT INTO "channels" (uid, name, created_at, updated_at) VALUES ('paging', 'Paging', now(), now())`)
+	assert.NoError(t, err, "insert channel")
+
+	tl := timeline.Create(ctx, "paging", "postgres-stream", nil, d.Database)
+	if !assert.NotNil(t, tl) {
+		return
+	}
+
+	// 5 timestamps with 11 items each, so every page boundary is between
+	// items with the same timestamp
+	published := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	var added []string
+	for i := 0; i < 55; i++ {
+		uid := fmt.Sprintf("item-%02d", i)
+		_, err := tl.AddItem(ctx, microsub.Item{
+			Type:      "entry",
+			ID:        uid,
+			Published: published.Add(time.Duration(i/11) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err, "add item")
+		added = append(added, uid)
+	}
+
+	// Newest first
+	var expected []string
+	for i := len(added) - 1; i >= 0; i-- {
+		expected = append(expected, added[i])
+	}
+
+	var seen []string
+	var pages []microsub.Timeline
+	options := microsub.TimelineOptions{Limit: 10}
+	for {
+		page, err := tl.Items(ctx, options)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, len(page.Items), 10)
+		for _, item := range page.Items {
+			seen = append(seen, item.ID)
+		}
+		pages = append(pages, page)
+		if page.Paging.After == "" {
+			break
+		}
+		options.After = page.Paging.After
+	}
+	assert.Equal(t, expected, seen, "all items in order, without skipping items")
+	assert.Len(t, pages, 6)
+	assert.Empty(t, pages[0].Paging.Before, "no newer items before the first page")
+
+	// Paging back from the last page returns the previous page
+	previous, err := tl.Items(ctx, microsub.TimelineOptions{Before: pages[5].Paging.Before, Limit: 10})
+	if assert.NoError(t, err) {
+		assert.Equal(t, pages[4].Items, previous.Items)
+	}
+
+	// The server maximum is used for large limits
+	for i := len(added); i <= timeline.MaxLimit; i++ {
+		_, err := tl.AddItem(ctx, microsub.Item{
+			Type:      "entry",
+			ID:        fmt.Sprintf("item-%03d", i),
+			Published: published.Add(-time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err, "add item")
+	}
+	page, err := tl.Items(ctx, microsub.TimelineOptions{Limit: timeline.MaxLimit * 10})
+	if assert.NoError(t, err) {
+		assert.Len(t, page.Items, timeline.MaxLimit)
+		assert.NotEmpty(t, page.Paging.After, "more items after the maximum")
+	}
+
+	_, err = tl.Items(ctx, microsub.TimelineOptions{After: "not a cursor"})
+	assert.True(t, errors.Is(err, microsub.ErrInvalidRequest))
+}
+
+func (d *databaseSuite) TestGlobalTimeline() {
+	t := d.T()
+	ctx := context.Background()
+	_, err := d.Database.Exec(`truncate "sources", "channels", "feeds", "subscriptions", "items" restart identity cascade`)
+	assert.NoError(t, err, "truncate")
+	_, err = d.Database.Exec(`INSERT INTO "channels" (uid, name, user_id) VALUES ('first', 'First', 1), ('second', 'Second', 1), ('other', 'Other', 2)`)
+	assert.NoError(t, err, "insert channels")
+
+	published := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, channel := range []string{"first", "second", "first", "second", "other"} {
+		tl := timeline.Create(ctx, channel, "postgres-stream", nil, d.Database)
+		_, err := tl.AddItem(ctx, microsub.Item{
+			Type:      "entry",
+			ID:        fmt.Sprintf("item-%d", i),
+			Published: published.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err, "add item")
+	}
+
+	global := timeline.CreateGlobal(ctx, 1, d.Database, nil)
+	if !assert.NotNil(t, global) {
+		return
+	}
+
+	page, err := global.Items(ctx, microsub.TimelineOptions{Limit: 3})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 3) {
+		assert.Equal(t, "item-3", page.Items[0].ID)
+		assert.Equal(t, "second", page.Items[0].Channel)
+		assert.Equal(t, "item-2", page.Items[1].ID)
+		assert.Equal(t, "first", page.Items[1].Channel)
+		assert.Equal(t, "item-1", page.Items[2].ID)
+	}
+
+	page, err = global.Items(ctx, microsub.TimelineOptions{After: page.Paging.After, Limit: 3})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "item-0", page.Items[0].ID)
+		assert.Empty(t, page.Paging.After)
+	}
+
+	count, err := global.Count(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count, "items of other users are not counted")
+
+	// Marking items as read in the global timeline changes the channels of the items
+	err = global.MarkRead(ctx, []string{"item-0", "item-3", "item-4"})
+	assert.NoError(t, err)
+
+	for channel, unread := range map[string]int{"first": 1, "second": 1, "other": 1} {
+		count, err := timeline.Create(ctx, channel, "postgres-stream", nil, d.Database).Count(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, unread, count, "unread count of %s", channel)
+	}
+
+	_, err = global.AddItem(ctx, microsub.Item{Type: "entry", ID: "item-5"})
+	assert.True(t, errors.Is(err, microsub.ErrInvalidRequest))
+}
+
+func (d *databaseSuite) TestUpdateItem() {
+	t := d.T()
+	ctx := context.Background()
+	_, err := d.Database.Exec(`truncate "sources", "channels", "feeds", "subscriptions", "items" restart identity cascade`)
+	assert.NoError(t, err, "truncate")
+	_, err = d.Database.Exec(`INSERT INTO "channels" (uid, name, created_at, updated_at) VALUES ('updates', 'Updates', now(), now())`)
+	assert.NoError(t, err, "insert channel")
+
+	tl := timeline.Create(ctx, "updates", "postgres-stream", nil, d.Database)
+	if !assert.NotNil(t, tl) {
+		return
+	}
+
+	item := microsub.Item{Type: "entry", ID: "item-1", Name: "Titel", Published: "2022-01-01T12:00:00Z"}
+	added, err := tl.AddItem(ctx, item)
+	assert.NoError(t, err)
+	assert.True(t, added)
+	assert.NoError(t, tl.MarkRead(ctx, []string{"item-1"}))
+
+	updated, err := tl.UpdateItem(ctx, item, false)
+	assert.NoError(t, err)
+	assert.False(t, updated, "same content")
+
+	item.Name = "Title"
+	updated, err = tl.UpdateItem(ctx, item, false)
+	assert.NoError(t, err)
+	assert.True(t, updated, "changed content")
+
+	items, err := tl.ItemsByUID(ctx, []string{"item-1"})
+	if assert.NoError(t, err) && assert.Len(t, items, 1) {
+		assert.Equal(t, "Title", items[0].Name)
+		assert.True(t, items[0].Read, "read state is kept")
+	}
+
+	item.Name = "Another title"
+	updated, err = tl.UpdateItem(ctx, item, true)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	count, err := tl.Count(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "item is unread again")
+
+	// Items that were stored before the content hash existed are not reported
+	_, err = d.Database.Exec(`UPDATE "items" SET "content_hash" = ''`)
+	assert.NoError(t, err)
+	item.Name = "Old item"
+	updated, err = tl.UpdateItem(ctx, item, false)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+	updated, err = tl.UpdateItem(ctx, item, false)
+	assert.NoError(t, err)
+	assert.False(t, updated, "hash is stored")
+}
+
+func (d *databaseSuite) TestCanceledContext() {
+	t := d.T()
+	_, err := d.Database.Exec(`truncate "sources", "channels", "feeds", "subscriptions", "items" restart identity cascade`)
+	assert.NoError(t, err, "truncate")
+	_, err = d.Database.Exec(`INSERT INTO "channels" (uid, name, created_at, updated_at) VALUES ('canceled', 'Canceled', now(), now())`)
+	assert.NoError(t, err, "insert channel")
+
+	tl := timeline.Create(context.Background(), "canceled", "postgres-stream", nil, d.Database)
+	if !assert.NotNil(t, tl) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = tl.Count(ctx)
+	assert.True(t, errors.Is(err, context.Canceled), "count with canceled context: %v", err)
+
+	_, err = tl.AddItem(ctx, microsub.Item{Type: "entry", ID: "item-1"})
+	assert.True(t, errors.Is(err, context.Canceled), "add item with canceled context: %v", err)
+}
+
+func (d *databaseSuite) TestTimelineConformance() {
+	ctx := context.Background()
+	_, err := d.Database.Exec(`truncate "sources", "channels", "feeds", "subscriptions", "items" restart identity cascade`)
+	assert.NoError(d.T(), err, "truncate")
+
+	pool := newPool(d.RedisURL)
+	for _, timelineType := range []string{"postgres-stream", "sorted-set", "stream"} {
+		timelineType := timelineType
+		d.T().Run(timelineType, func(t *testing.T) {
+			timelinetest.Run(t, func(t *testing.T) (timeline.Backend, string) {
+				uid := util.RandStringBytes(16)
+				_, err := d.Database.Exec(`INSERT INTO "channels" (uid, name, created_at, updated_at) VALUES ($1, $1, now(), now())`, uid)
+				assert.NoError(t, err, "insert channel")
+				return timeline.Create(ctx, uid, timelineType, pool, d.Database), uid + "-"
+			}, timelinetest.Options{})
+		})
+	}
+}
+
+func (d *databaseSuite) TestGlobalConformance() {
+	ctx := context.Background()
+	_, err := d.Database.Exec(`truncate "users", "sources", "channels", "feeds", "subscriptions", "items" restart identity cascade`)
+	assert.NoError(d.T(), err, "truncate")
+
+	pool := newPool(d.RedisURL)
+	timelinetest.RunGlobal(d.T(), func(t *testing.T) (timeline.Backend, []timeline.Backend, string) {
+		var userID int
+		err := d.Database.QueryRow(`INSERT INTO "users" ("url", "me", "token_endpoint") VALUES ($1, $1, $1) RETURNING "id"`, "https://"+util.RandStringBytes(16)+".example/").Scan(&userID)
+		assert.NoError(t, err, "insert user")
+
+		// a user with a channel of each timeline type
+		var channels []timeline.Backend
+		others := make(map[string]timeline.Backend)
+		for _, timelineType := range []string{"postgres-stream", "sorted-set", "stream"} {
+			uid := util.RandStringBytes(16)
+			_, err := d.Database.Exec(`INSERT INTO "channels" (uid, name, user_id) VALUES ($1, $1, $2)`, uid, userID)
+			assert.NoError(t, err, "insert channel")
+			tl := timeline.CreateForUser(ctx, userID, uid, timelineType, pool, d.Database)
+			channels = append(channels, tl)
+			if timelineType != timeline.DefaultType {
+				others[uid] = tl
+			}
+		}
+		return timeline.CreateGlobal(ctx, userID, d.Database, others), channels, util.RandStringBytes(8) + "-"
+	})
+}
+
+func (d *databaseSuite) TestGlobalTimelineGet() {
+	t := d.T()
+	alice := userid.NewContext(context.Background(), 1)
+	b := d.setupUsers()
+
+	// the items of sorted-set channels are kept in Redis between tests
+	uid := util.RandStringBytes(16)
+	_, err := d.Database.Exec(`INSERT INTO "channels" (uid, name, user_id) VALUES ($1, 'Set', 1)`, uid)
+	assert.NoError(t, err, "insert channel")
+	assert.NoError(t, b.saveSetting(alice, uid, channelSetting{ChannelType: "sorted-set"}))
+	tl, err := b.userTimeline(alice, uid)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tl.AddItem(alice, microsub.Item{Type: "entry", ID: uid + "-0", Published: "2022-01-01T12:30:00Z"})
+	assert.NoError(t, err)
+
+	page, err := b.TimelineGet(alice, timeline.GlobalChannel, microsub.TimelineOptions{Limit: 2})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 2) {
+		assert.Equal(t, uid+"-0", page.Items[0].ID)
+		assert.Equal(t, uid, page.Items[0].Channel)
+		assert.Equal(t, "alice-2", page.Items[1].ID)
+		assert.Equal(t, "alice", page.Items[1].Channel)
+	}
+
+	assert.NoError(t, b.MarkRead(alice, timeline.GlobalChannel, []string{uid + "-0"}))
+	count, err := tl.Count(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "marked read in its own channel")
+}
+
+// setupUsers creates two users, each with a channel with items
+func (d *databaseSuite) setupUsers() *memoryBackend {
+	t := d.T()
+	ctx := context.Background()
+	_, err := d.Database.Exec(`truncate "users", "sources", "channels", "feeds", "subscriptions", "items" restart identity cascade`)
+	assert.NoError(t, err, "truncate")
+	_, err = d.Database.Exec(`
+INSERT INTO "users" ("url", "me", "token_endpoint")
+VALUES ('https://alice.example/', 'https://alice.example/', 'https://alice.example/token'),
+       ('https://bob.example/', 'https://bob.example/', 'https://bob.example/token')`)
+	assert.NoError(t, err, "insert users")
+	_, err = d.Database.Exec(`INSERT INTO "channels" (uid, name, user_id) VALUES ('alice', 'Alice', 1), ('bob', 'Bob', 2)`)
+	assert.NoError(t, err, "insert channels")
+	_, err = d.Database.Exec(`INSERT INTO "feeds" ("url") VALUES ('https://alice.example/feed')`)
+	assert.NoError(t, err, "insert feed")
+	_, err = d.Database.Exec(`INSERT INTO "channel_feeds" ("channel_id", "feed_id") VALUES (1, 1)`)
+	assert.NoError(t, err, "insert follow")
+
+	published := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, channel := range []string{"alice", "bob"} {
+		tl := timeline.Create(ctx, channel, "postgres-stream", nil, d.Database)
+		for i := 0; i < 3; i++ {
+			_, err := tl.AddItem(ctx, microsub.Item{
+				Type:      "entry",
+				ID:        fmt.Sprintf("%s-%d", channel, i),
+				Published: published.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+			})
+			assert.NoError(t, err, "add item")
+		}
+	}
+
+	return &memoryBackend{
+		database: d.Database,
+		pool:     newPool(d.RedisURL),
+		broker:   sse.NewBroker(),
+	}
+}
+
+func (d *databaseSuite) unreadCount(channel string) int {
+	ctx := context.Background()
+	count, err := timeline.Create(ctx, channel, "postgres-stream", nil, d.Database).Count(ctx)
+	assert.NoError(d.T(), err)
+	return count
+}
+
+func (d *databaseSuite) TestPruneChannels() {
+	t := d.T()
+	ctx := context.Background()
+	b := d.setupUsers()
+
+	err := b.saveSetting(ctx, "alice", channelSetting{Retention: timeline.Retention{MaxItems: 1}})
+	assert.NoError(t, err)
+	err = b.saveSetting(ctx, "bob", channelSetting{Retention: timeline.Retention{MaxItems: 1, KeepUnread: true}})
+	assert.NoError(t, err)
+
+	b.pruneChannels(ctx)
+
+	assert.Equal(t, 1, d.unreadCount("alice"))
+	assert.Equal(t, 3, d.unreadCount("bob"), "unread items are kept")
+
+	page, err := timeline.Create(ctx, "alice", "postgres-stream", nil, d.Database).Items(ctx, microsub.TimelineOptions{})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "alice-2", page.Items[0].ID, "newest item is kept")
+	}
+}
+
+func (d *databaseSuite) TestPruneChannels_KeepStarred() {
+	t := d.T()
+	alice := userid.NewContext(context.Background(), 1)
+	b := d.setupUsers()
+
+	assert.NoError(t, b.Star(alice, "alice", []string{"alice-0"}))
+	err := b.saveSetting(alice, "alice", channelSetting{Retention: timeline.Retention{MaxItems: 1, KeepStarred: true}})
+	assert.NoError(t, err)
+
+	b.pruneChannels(alice)
+
+	page, err := timeline.Create(alice, "alice", "postgres-stream", nil, d.Database).Items(alice, microsub.TimelineOptions{})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 2) {
+		assert.Equal(t, "alice-2", page.Items[0].ID, "newest item is kept")
+		assert.Equal(t, "alice-0", page.Items[1].ID, "starred item is kept")
+		assert.True(t, page.Items[1].Starred)
+	}
+
+	assert.NoError(t, b.Unstar(alice, "alice", []string{"alice-0"}))
+	b.pruneChannels(alice)
+	assert.Equal(t, 1, d.unreadCount("alice"))
+}
+
+func (d *databaseSuite) TestRetentionGet() {
+	t := d.T()
+	alice := userid.NewContext(context.Background(), 1)
+	b := d.setupUsers()
+
+	err := b.saveSetting(alice, "alice", channelSetting{Retention: timeline.Retention{MaxItems: 1}})
+	assert.NoError(t, err)
+	retention, err := b.RetentionGet(alice, "alice")
+	if assert.NoError(t, err) {
+		assert.Equal(t, microsub.RetentionPolicy{MaxItems: 1}, retention.Policy)
+		assert.Equal(t, 2, retention.Count)
+		assert.Len(t, retention.Items, 2)
+	}
+	assert.Equal(t, 3, d.unreadCount("alice"), "items are not removed")
+
+	_, err = b.RetentionGet(userid.NewContext(context.Background(), 2), "alice")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "channel of other user")
+}
+
+func (d *databaseSuite) TestChannelHasItems() {
+	t := d.T()
+	alice := userid.NewContext(context.Background(), 1)
+	b := d.setupUsers()
+
+	hasItems, err := b.channelHasItems(alice, "alice")
+	assert.NoError(t, err)
+	assert.True(t, hasItems)
+
+	channel, err := b.ChannelsCreate(alice, "Empty")
+	if assert.NoError(t, err) {
+		hasItems, err = b.channelHasItems(alice, channel.UID)
+		assert.NoError(t, err)
+		assert.False(t, hasItems)
+	}
+
+	tl := timeline.Create(alice, "alice", "postgres-stream", nil, d.Database)
+	assert.NoError(t, tl.MarkRead(alice, []string{"alice-0", "alice-1", "alice-2"}))
+	hasItems, err = b.channelHasItems(alice, "alice")
+	assert.NoError(t, err)
+	assert.True(t, hasItems, "read items are items of the channel")
+}
+
+func (d *databaseSuite) TestChannelsOrder() {
+	t := d.T()
+	alice := userid.NewContext(context.Background(), 1)
+	b := d.setupUsers()
+
+	channel, err := b.ChannelsCreate(alice, "Empty")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The channel with unread items is listed where it was ordered
+	assert.NoError(t, b.ChannelsOrder(alice, []string{channel.UID, "alice"}))
+	channels, err := b.ChannelsGetList(alice)
+	if assert.NoError(t, err) && assert.Len(t, channels, 2) {
+		assert.Equal(t, channel.UID, channels[0].UID)
+		assert.Equal(t, "alice", channels[1].UID)
+		assert.Equal(t, 3, channels[1].Unread.UnreadCount)
+	}
+}
+
+func (d *databaseSuite) TestBlockURL() {
+	t := d.T()
+	alice := userid.NewContext(context.Background(), 1)
+	b := d.setupUsers()
+
+	tl := timeline.Create(alice, "alice", "postgres-stream", nil, d.Database)
+	_, err := tl.AddItem(alice, microsub.Item{
+		Type:   "entry",
+		ID:     "spam-1",
+		URL:    "https://spam.example/1",
+		Author: &microsub.Card{URL: "https://spam.example/"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, b.saveItemURLs(alice, "alice", "spam-1", []string{"https://spam.example/1"}))
+
+	events, err := sse.StartConnection(b.broker, 1, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.broker.CloseClient(events)
+
+	assert.NoError(t, b.BlockURL(alice, "alice", "https://spam.example/"))
+	assert.Equal(t, 3, d.unreadCount("alice"))
+
+	var urls int
+	err = d.Database.QueryRow(`SELECT count(*) FROM "item_urls" WHERE "item_uid" = 'spam-1'`).Scan(&urls)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, urls, "urls of blocked items are removed")
+	}
+
+	for {
+		select {
+		case msg := <-events:
+			if msg.Event != "remove items" {
+				continue
+			}
+			assert.Equal(t, removeItemsMessage{"alice", []string{"spam-1"}}, msg.Object)
+		case <-time.After(time.Second):
+			t.Error("no remove items event")
+		}
+		break
+	}
+}
+
+func (d *databaseSuite) TestMutedTimeline() {
+	t := d.T()
+	alice := userid.NewContext(context.Background(), 1)
+	b := d.setupUsers()
+
+	// The muted items are newer than the items of the channel
+	published := time.Date(2022, 1, 1, 13, 0, 0, 0, time.UTC)
+	tl := timeline.Create(alice, "alice", "postgres-stream", nil, d.Database)
+	for i := 0; i < 5; i++ {
+		_, err := tl.AddItem(alice, microsub.Item{
+			Type:      "entry",
+			ID:        fmt.Sprintf("muted-%d", i),
+			Author:    &microsub.Card{URL: "https://muted.example/"},
+			Published: published.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, b.MuteURL(alice, "alice", "https://muted.example/"))
+
+	page, err := b.TimelineGet(alice, "alice", microsub.TimelineOptions{Limit: 2})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 2, "page is filled past the muted items") {
+		assert.Equal(t, "alice-2", page.Items[0].ID)
+		assert.Equal(t, "alice-1", page.Items[1].ID)
+	}
+
+	page, err = b.TimelineGet(alice, "alice", microsub.TimelineOptions{Limit: 2, After: page.Paging.After})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "alice-0", page.Items[0].ID)
+	}
+
+	unread, err := b.channelUnreadCount(alice, "alice", tl)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, unread, "muted items are not unread")
+	}
+
+	channels, err := b.ChannelsGetList(alice)
+	if assert.NoError(t, err) && assert.Len(t, channels, 1) {
+		assert.Equal(t, 3, channels[0].Unread.UnreadCount, "muted items are not unread")
+	}
+}
+
+func (d *databaseSuite) TestMergeDuplicates() {
+	t := d.T()
+	ctx := context.Background()
+	b := d.setupUsers()
+
+	published := time.Date(2022, 1, 2, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	add := func(id, feedID, u string, syndication ...string) {
+		t.Helper()
+		_, err := b.channelAddItemWithMatcher(ctx, "alice", microsub.Item{
+			Type:        "entry",
+			ID:          id,
+			URL:         u,
+			Syndication: syndication,
+			Published:   published,
+			Source:      &microsub.Source{ID: feedID, URL: "https://feed" + feedID + ".example/"},
+		})
+		assert.NoError(t, err)
+	}
+	sources := func(uid string) []string {
+		t.Helper()
+		items, err := timeline.Create(ctx, "alice", "postgres-stream", nil, d.Database).ItemsByUID(ctx, []string{uid})
+		if !assert.NoError(t, err) || !assert.Len(t, items, 1) {
+			return nil
+		}
+		var ids []string
+		for _, source := range items[0].Sources {
+			ids = append(ids, source.ID)
+		}
+		return ids
+	}
+
+	add("rss-1", "1", "https://alice.example/post?utm_source=rss")
+	add("hfeed-1", "2", "http://www.alice.example/post/")
+	assert.Equal(t, 4, d.unreadCount("alice"), "the copy is not added")
+	assert.Equal(t, []string{"1", "2"}, sources("rss-1"), "the sources are stored")
+
+	// Delivering the copy again doesn't change the item
+	add("hfeed-1", "2", "http://www.alice.example/post/")
+	add("rss-1", "1", "https://alice.example/post")
+	assert.Equal(t, 4, d.unreadCount("alice"))
+	assert.Equal(t, []string{"1", "2"}, sources("rss-1"), "sources are kept on updates")
+
+	// Other items of the same feed are not merged
+	add("rss-2", "1", "https://alice.example/post")
+	assert.Equal(t, 5, d.unreadCount("alice"))
+
+	// Syndication links find the original post
+	add("silo-1", "3", "https://silo.example/alice/1")
+	add("hfeed-2", "2", "https://alice.example/post/2", "https://silo.example/alice/1")
+	assert.Equal(t, 6, d.unreadCount("alice"))
+	assert.Equal(t, []string{"3", "2"}, sources("silo-1"))
+
+	// A third feed is added to the sources
+	add("other-1", "4", "https://alice.example/post")
+	assert.Equal(t, 6, d.unreadCount("alice"))
+	assert.Equal(t, []string{"1", "2", "4"}, sources("rss-1"))
+}
+
+func (d *databaseSuite) TestMigrateSearch() {
+	t := d.T()
+	d.setupUsers()
+
+	oldIndex := index
+	defer func() { index = oldIndex }()
+	var err error
+	index, err = bleve.NewMemOnly(bleve.NewIndexMapping())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// entries before the channel was part of the id
+	assert.NoError(t, index.Index("alice-0", indexItem{microsub.Item{ID: "alice-0"}, "alice"}))
+	assert.NoError(t, index.Index("removed", indexItem{microsub.Item{ID: "removed"}, "alice"}))
+
+	assert.NoError(t, migrateSearch(context.Background(), d.Database))
+
+	for id, exists := range map[string]bool{"alice-0": false, "removed": false, "alice:alice-0": true} {
+		doc, err := index.Document(id)
+		assert.NoError(t, err)
+		assert.Equal(t, exists, doc != nil, id)
+	}
+
+	version, err := index.GetInternal(searchVersionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, searchVersion, string(version))
+}
+
+func (d *databaseSuite) TestOtherUsersChannels() {
+	t := d.T()
+	b := d.setupUsers()
+	bob := userid.NewContext(context.Background(), 2)
+
+	_, err := b.ChannelsUpdate(bob, "alice", "Mine")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "update channel of other user")
+
+	err = b.ChannelsDelete(bob, "alice")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "delete channel of other user")
+
+	var name string
+	err = d.Database.QueryRow(`SELECT "name" FROM "channels" WHERE "uid" = 'alice'`).Scan(&name)
+	assert.NoError(t, err, "channel of alice still exists")
+	assert.Equal(t, "Alice", name)
+
+	channels, err := b.ChannelsGetList(bob)
+	if assert.NoError(t, err) && assert.Len(t, channels, 1) {
+		assert.Equal(t, "bob", channels[0].UID)
+	}
+
+	_, err = b.FollowGetList(bob, "alice")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "follow list of other user")
+
+	_, err = b.FollowURL(bob, "alice", "https://bob.example/feed")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "follow in channel of other user")
+
+	err = b.UnfollowURL(bob, "alice", "https://alice.example/feed")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "unfollow in channel of other user")
+
+	alice := userid.NewContext(context.Background(), 1)
+	feeds, err := b.FollowGetList(alice, "alice")
+	if assert.NoError(t, err) {
+		assert.Len(t, feeds, 1)
+	}
+}
+
+func (d *databaseSuite) TestOtherUsersItems() {
+	t := d.T()
+	ctx := context.Background()
+	b := d.setupUsers()
+	bob := userid.NewContext(context.Background(), 2)
+	aliceItems := []string{"alice-0", "alice-1"}
+
+	_, err := b.TimelineGet(bob, "alice", microsub.TimelineOptions{})
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "timeline of other user")
+
+	err = b.MarkRead(bob, "alice", aliceItems)
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "mark read in channel of other user")
+
+	err = b.MarkReadUntil(bob, "alice", "alice-2")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "mark read until in channel of other user")
+
+	err = b.RemoveItems(bob, "alice", aliceItems)
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "remove items in channel of other user")
+
+	// Items of other channels are not changed through an own channel
+	err = b.MarkRead(bob, "bob", aliceItems)
+	assert.NoError(t, err)
+	err = b.MarkRead(bob, timeline.GlobalChannel, aliceItems)
+	assert.NoError(t, err)
+	err = b.MarkReadUntil(bob, "bob", "alice-2")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "mark read until item of other user")
+	err = b.RemoveItems(bob, "bob", aliceItems)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, d.unreadCount("alice"))
+	assert.Equal(t, 3, d.unreadCount("bob"))
+
+	items, err := timeline.CreateForUser(ctx, 2, "bob", "postgres-stream", nil, d.Database).ItemsByUID(ctx, []string{"alice-0"})
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "item of other user")
+	assert.Empty(t, items)
+
+	// The owner can change the items
+	alice := userid.NewContext(context.Background(), 1)
+	err = b.MarkRead(alice, "alice", aliceItems)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, d.unreadCount("alice"))
+
+	tl, err := b.TimelineGet(alice, "alice", microsub.TimelineOptions{})
+	if assert.NoError(t, err) {
+		assert.Len(t, tl.Items, 3)
+	}
+}
+
+func (d *databaseSuite) TestSameItemInMoreChannels() {
+	t := d.T()
+	ctx := context.Background()
+	d.setupUsers()
+
+	item := microsub.Item{
+		Type:      "entry",
+		ID:        "shared",
+		Published: time.Date(2022, 1, 2, 12, 0, 0, 0, time.UTC).Format(time.RFC3339),
+	}
+
+	for _, channel := range []string{"alice", "bob"} {
+		tl := timeline.Create(ctx, channel, "postgres-stream", nil, d.Database)
+		added, err := tl.AddItem(ctx, item)
+		assert.NoError(t, err)
+		assert.True(t, added, "item is added to %s", channel)
+
+		added, err = tl.AddItem(ctx, item)
+		assert.NoError(t, err)
+		assert.False(t, added, "item is added once to %s", channel)
+	}
+
+	// The items are changed separately
+	err := timeline.Create(ctx, "alice", "postgres-stream", nil, d.Database).MarkRead(ctx, []string{"shared"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, d.unreadCount("alice"))
+	assert.Equal(t, 4, d.unreadCount("bob"))
+}
+
+func (d *databaseSuite) TestSharedFeed() {
+	t := d.T()
+	ctx := context.Background()
+	b := d.setupUsers()
+	alice := userid.NewContext(context.Background(), 1)
+	bob := userid.NewContext(context.Background(), 2)
+
+	_, err := d.Database.Exec(`INSERT INTO "channel_feeds" ("channel_id", "feed_id") VALUES (2, 1)`)
+	assert.NoError(t, err, "insert follow of bob")
+
+	channels, err := b.feedChannels(ctx, 1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"alice", "bob"}, channels)
+	}
+
+	body := `<div class="h-feed"><div class="h-entry"><a class="u-url" href="https://alice.example/1">Post</a><p class="p-name">Post</p></div></div>`
+	changed, err := b.fanOutContent(ctx, channels, "1", "https://alice.example/feed", "text/html", strings.NewReader(body))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 4, d.unreadCount("alice"))
+	assert.Equal(t, 4, d.unreadCount("bob"))
+
+	err = b.UnfollowURL(bob, "bob", "https://alice.example/feed")
+	assert.NoError(t, err, "unfollow by bob")
+	assert.Equal(t, 3, d.unreadCount("bob"), "items of the feed are removed from the channel of bob")
+	assert.Equal(t, 4, d.unreadCount("alice"), "items of alice are kept")
+
+	var urls int
+	err = d.Database.QueryRow(`SELECT count(*) FROM "item_urls" WHERE "channel_id" = 2`).Scan(&urls)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, urls, "urls of the removed items are removed")
+
+	feeds, err := b.FollowGetList(alice, "alice")
+	if assert.NoError(t, err) {
+		assert.Len(t, feeds, 1)
+	}
+
+	err = b.UnfollowURL(bob, "bob", "https://alice.example/feed")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "unfollow twice")
+
+	err = b.UnfollowURL(alice, "alice", "https://alice.example/feed")
+	assert.NoError(t, err, "unfollow by alice")
+
+	var count int
+	err = d.Database.QueryRow(`SELECT count(*) FROM "feeds"`).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "feed without follows is removed")
+}
+
 func TestDatabaseSuite(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skip test for database")
@@ -115,8 +905,11 @@ func TestDatabaseSuite(t *testing.T) {
 		},
 	}
 
-	databaseURL = "postgres://postgres@database/ekster_testing?sslmode=disable&user=postgres&password=simple"
-	err := runMigrations(databaseURL)
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = runMigrations(db)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,29 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+CREATE TABLE "blocks"
+(
+    "id"         int primary key generated always as identity,
+    "user_id"    int not null,
+    "channel_id" int null references "channels" (id) on update cascade on delete cascade,
+    "url"        varchar(512) not null,
+    "created_at" timestamptz DEFAULT current_timestamp
+);
+
+-- channel_id is null for users that are blocked in all channels
+CREATE UNIQUE INDEX "blocks_user_id_channel_id_url_key" ON "blocks" ("user_id", coalesce("channel_id", 0), "url");
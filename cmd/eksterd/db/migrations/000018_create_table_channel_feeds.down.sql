@@ -0,0 +1,28 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+-- A feed belongs to one channel again, the other channels lose the feed
+ALTER TABLE "feeds"
+    DROP COLUMN "etag",
+    DROP COLUMN "last_modified",
+    ADD COLUMN "channel_id" int references "channels" (id) on update cascade on delete cascade;
+
+UPDATE "feeds" AS "f"
+SET "channel_id" = (SELECT "cf"."channel_id" FROM "channel_feeds" AS "cf" WHERE "cf"."feed_id" = "f"."id" ORDER BY "cf"."id" LIMIT 1);
+
+DROP TABLE "channel_feeds";
@@ -0,0 +1,28 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+-- The canonical urls of the items in a channel are used to find the same post
+-- from other feeds
+CREATE TABLE "item_urls" (
+     "id" int primary key generated always as identity,
+     "channel_id" int not null references "channels" (id) on update cascade on delete cascade,
+     "url" text not null,
+     "item_uid" text not null,
+     "created_at" timestamptz DEFAULT current_timestamp,
+     unique ("channel_id", "url")
+);
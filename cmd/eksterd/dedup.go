@@ -0,0 +1,282 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/pstuifzand/ekster/pkg/canonical"
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/timeline"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+)
+
+// redirectCacheTime is the number of seconds a resolved redirect is cached
+const redirectCacheTime = 7 * 24 * 60 * 60
+
+// uidKey is the key in "item_urls" for the uid of an item, it points to the
+// item the item was merged into
+func uidKey(uid string) string {
+	return "uid:" + uid
+}
+
+// itemURLs returns the canonical urls of the url, uid and syndication links of
+// the item. A uid that isn't a url is not used.
+func itemURLs(item microsub.Item) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, u := range append([]string{item.URL, item.UID}, item.Syndication...) {
+		c, err := canonical.URL(u)
+		if err != nil || seen[c] {
+			continue
+		}
+		seen[c] = true
+		urls = append(urls, c)
+	}
+	return urls
+}
+
+// itemSources returns all sources of the item
+func itemSources(item microsub.Item) []microsub.Source {
+	if len(item.Sources) > 0 {
+		return item.Sources
+	}
+	if item.Source != nil {
+		return []microsub.Source{*item.Source}
+	}
+	return nil
+}
+
+// sameSource returns true when a and b are the same feed
+func sameSource(a, b microsub.Source) bool {
+	if a.ID != "" || b.ID != "" {
+		return a.ID == b.ID
+	}
+	return a.URL == b.URL
+}
+
+func hasSource(sources []microsub.Source, source microsub.Source) bool {
+	for _, s := range sources {
+		if sameSource(s, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeDuplicate finds the same post from another feed in the channel, by
+// comparing the canonical urls of the items. A post from another feed is
+// merged into the stored item: its source is added to the "_sources" of the
+// stored item, and merged is true. The item doesn't have to be added then.
+//
+// The first feed of a merged item updates its content, for that item the
+// sources of the stored item are copied into item.
+func (b *memoryBackend) mergeDuplicate(ctx context.Context, tl timeline.Backend, channel string, item *microsub.Item) (merged bool, err error) {
+	if item.ID == "" || item.Source == nil {
+		return false, nil
+	}
+
+	urls := itemURLs(*item)
+	keys := append([]string{uidKey(item.ID)}, urls...)
+	found, err := b.findItemURLs(ctx, channel, keys)
+	if err != nil {
+		return false, err
+	}
+
+	// Resolve the redirect of a new item, the other feed could link to the
+	// final url
+	if len(found) == 0 && b.resolveRedirects && item.URL != "" {
+		if resolved, err := canonical.URL(b.resolveRedirect(ctx, item.URL)); err == nil {
+			if !contains(urls, resolved) {
+				urls = append(urls, resolved)
+				keys = append(keys, resolved)
+				found, err = b.findItemURLs(ctx, channel, []string{resolved})
+				if err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+
+	// A known uid is the item itself or a copy that was merged before,
+	// otherwise the first matching url is used
+	target, known := found[uidKey(item.ID)]
+	if !known {
+		for _, u := range urls {
+			if uid, ok := found[u]; ok {
+				target = uid
+				break
+			}
+		}
+	}
+	if target == "" {
+		return false, b.saveItemURLs(ctx, channel, item.ID, keys)
+	}
+
+	stored, err := tl.ItemsByUID(ctx, []string{target})
+	if errors.Is(err, microsub.ErrNotFound) || (err == nil && len(stored) == 0) {
+		// the item was removed, the urls now belong to the new item
+		if err := b.removeItemURLs(ctx, channel, []string{target}); err != nil {
+			return false, err
+		}
+		return false, b.saveItemURLs(ctx, channel, item.ID, keys)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	sources := itemSources(stored[0])
+	if !known && hasSource(sources, *item.Source) {
+		// a different item from the same feed that links to the same url
+		return false, b.saveItemURLs(ctx, channel, item.ID, keys)
+	}
+
+	primary := stored[0].Source
+	if primary == nil && target != item.ID {
+		// only items with a source are merged
+		return false, b.saveItemURLs(ctx, channel, item.ID, keys)
+	}
+
+	if primary == nil || sameSource(*primary, *item.Source) {
+		if len(sources) > 1 {
+			item.Sources = sources
+		}
+		return false, b.saveItemURLs(ctx, channel, target, keys)
+	}
+
+	if err := b.saveItemURLs(ctx, channel, target, keys); err != nil {
+		return true, err
+	}
+	if hasSource(sources, *item.Source) {
+		return true, nil
+	}
+
+	mergedItem := stored[0]
+	mergedItem.Sources = append(sources, *item.Source)
+	if err := tl.UpdateSources(ctx, target, mergedItem.Sources); err != nil {
+		return true, err
+	}
+	b.notifyChannel(ctx, channel, "item updated", newItemMessage{mergedItem, channel})
+	log.Printf("Merged item %s into %s in channel %s", item.ID, target, channel)
+	return true, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// findItemURLs returns the uids of the items in the channel with the urls,
+// by url
+func (b *memoryBackend) findItemURLs(ctx context.Context, channel string, urls []string) (map[string]string, error) {
+	rows, err := b.database.QueryContext(ctx, `
+SELECT "iu"."url", "iu"."item_uid"
+FROM "item_urls" AS "iu"
+INNER JOIN "channels" AS "c" ON "c"."id" = "iu"."channel_id"
+WHERE "c"."uid" = $1 AND "iu"."url" = ANY($2)
+`, channel, pq.Array(urls))
+	if err != nil {
+		return nil, fmt.Errorf("while finding item urls: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]string)
+	for rows.Next() {
+		var u, uid string
+		if err := rows.Scan(&u, &uid); err != nil {
+			return nil, err
+		}
+		found[u] = uid
+	}
+	return found, rows.Err()
+}
+
+// saveItemURLs stores the urls of the item with uid. Urls that belong to
+// another item are not changed.
+func (b *memoryBackend) saveItemURLs(ctx context.Context, channel, uid string, urls []string) error {
+	_, err := b.database.ExecContext(ctx, `
+INSERT INTO "item_urls" ("channel_id", "url", "item_uid")
+SELECT "c"."id", "u"."url", $3
+FROM "channels" AS "c", unnest($2::text[]) AS "u" ("url")
+WHERE "c"."uid" = $1
+ON CONFLICT ("channel_id", "url") DO NOTHING
+`, channel, pq.Array(urls), uid)
+	if err != nil {
+		return fmt.Errorf("while saving item urls: %w", err)
+	}
+	return nil
+}
+
+// removeItemURLs removes the urls of the items with the uids
+func (b *memoryBackend) removeItemURLs(ctx context.Context, channel string, uids []string) error {
+	_, err := b.database.ExecContext(ctx, `
+DELETE FROM "item_urls"
+WHERE "channel_id" = (SELECT "id" FROM "channels" WHERE "uid" = $1) AND "item_uid" = ANY($2)
+`, channel, pq.Array(uids))
+	if err != nil {
+		return fmt.Errorf("while removing item urls: %w", err)
+	}
+	return nil
+}
+
+// resolveRedirect returns the url that rawURL redirects to, or rawURL when it
+// doesn't redirect or can't be fetched. The result is cached in Redis.
+func (b *memoryBackend) resolveRedirect(ctx context.Context, rawURL string) string {
+	var conn redis.Conn
+	cacheKey := fmt.Sprintf("redirect:%s", rawURL)
+	if b.pool != nil {
+		var err error
+		conn, err = b.pool.GetContext(ctx)
+		if err != nil {
+			log.Printf("could not get redis connection: %v", err)
+		} else {
+			defer conn.Close()
+			if resolved, err := redis.String(conn.Do("GET", cacheKey)); err == nil {
+				return resolved
+			}
+		}
+	}
+
+	fetchCtx, cancel := b.fetchContext(ctx)
+	defer cancel()
+
+	resp, err := Fetch2(fetchCtx, rawURL)
+	if err != nil {
+		log.Printf("could not resolve redirect of %s: %v", rawURL, err)
+		return rawURL
+	}
+	resp.Body.Close()
+	resolved := resp.Request.URL.String()
+
+	if conn != nil {
+		if _, err := conn.Do("SETEX", cacheKey, redirectCacheTime, resolved); err != nil {
+			log.Printf("could not cache redirect of %s: %v", rawURL, err)
+		}
+	}
+	return resolved
+}
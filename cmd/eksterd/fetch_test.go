@@ -0,0 +1,69 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchIfModified(t *testing.T) {
+	const etag = `"v1"`
+	const lastModified = "Sat, 01 Jan 2022 12:00:00 GMT"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag || r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		etag         string
+		lastModified string
+		want         int
+	}{
+		{"unconditional", "", "", http.StatusOK},
+		{"etag", etag, "", http.StatusNotModified},
+		{"last modified", "", lastModified, http.StatusNotModified},
+		{"changed", `"v0"`, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := FetchIfModified(context.Background(), server.URL, tt.etag, tt.lastModified)
+			if assert.NoError(t, err) {
+				defer resp.Body.Close()
+				assert.Equal(t, tt.want, resp.StatusCode)
+				if tt.want == http.StatusOK {
+					assert.Equal(t, etag, resp.Header.Get("ETag"))
+					assert.Equal(t, lastModified, resp.Header.Get("Last-Modified"))
+				}
+			}
+		})
+	}
+}
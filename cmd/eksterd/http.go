@@ -22,6 +22,7 @@ import (
 	"database/sql"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -31,11 +32,13 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pstuifzand/ekster/pkg/indieauth"
 	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/timeline"
 	"github.com/pstuifzand/ekster/pkg/userid"
 	"github.com/pstuifzand/ekster/pkg/util"
 
@@ -83,6 +86,7 @@ type settingsPage struct {
 
 	CurrentChannel    microsub.Channel
 	CurrentSetting    channelSetting
+	MaxAgeDays        int
 	ExcludedTypes     map[string]bool
 	ExcludedTypeNames map[string]string
 
@@ -399,7 +403,7 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			page.Feeds, err = h.Backend.FollowGetList(r.Context(), currentChannel)
-			if err != nil {
+			if err != nil && !errors.Is(err, microsub.ErrNotFound) {
 				log.Printf("ERROR: %s\n", err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
@@ -409,15 +413,16 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				if v.UID == currentChannel {
 					page.CurrentChannel = v
 
-					setting, err := h.Backend.loadSetting(v.UID)
+					setting, err := h.Backend.loadSetting(r.Context(), v.UID)
 					if err != nil {
 						log.Println(err)
 					}
 					page.CurrentSetting = setting
 
 					if page.CurrentSetting.ChannelType == "" {
-						page.CurrentSetting.ChannelType = "postgres-stream"
+						page.CurrentSetting.ChannelType = timeline.DefaultType
 					}
+					page.MaxAgeDays = int(setting.Retention.MaxAge / (24 * time.Hour))
 
 					page.ExcludedTypeNames = map[string]string{
 						"repost":   "Reposts",
@@ -601,11 +606,11 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			row := h.Backend.database.QueryRow(`SELECT "id" FROM "users" WHERE "url" = $1`, me)
+			row := h.Backend.database.QueryRowContext(r.Context(), `SELECT "id" FROM "users" WHERE "url" = $1`, me)
 			var userID int
 			err = row.Scan(&userID)
 			if err == sql.ErrNoRows {
-				row = h.Backend.database.QueryRow(
+				row = h.Backend.database.QueryRowContext(r.Context(),
 					`INSERT INTO "users" ("url", "me", "token_endpoint") VALUES ($1, $2, $3) RETURNING "id"`,
 					me,
 					endpoints.Me.String(),
@@ -746,7 +751,15 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// defer h.Backend.save()
 			uid := r.FormValue("uid")
 
-			setting, err := h.Backend.loadSetting(uid)
+			// Only the owner of the channel can change the settings
+			userID, _ := userid.FromContext(r.Context())
+			if _, err := h.Backend.userChannelID(r.Context(), userID, uid); err != nil {
+				log.Println("settings for channel", uid, err)
+				http.Redirect(w, r, "/settings", http.StatusFound)
+				return
+			}
+
+			setting, err := h.Backend.loadSetting(r.Context(), uid)
 			if err != nil {
 				log.Println("loadSetting", uid, err)
 				http.Redirect(w, r, "/settings", http.StatusFound)
@@ -775,15 +788,55 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			channelType := r.FormValue("type")
+			if !isTimelineType(channelType) {
+				log.Println("type is not a timeline type", channelType)
+				http.Redirect(w, r, "/settings/channel?uid="+uid, http.StatusFound)
+				return
+			}
+
+			currentType := setting.ChannelType
+			if currentType == "" {
+				currentType = timeline.DefaultType
+			}
+			if channelType != currentType {
+				// the items are not moved to the new timeline, they would be lost
+				hasItems, err := h.Backend.channelHasItems(r.Context(), uid)
+				if err != nil || hasItems {
+					log.Println("type of channel with items can't be changed", uid, channelType, err)
+					http.Redirect(w, r, "/settings/channel?uid="+uid, http.StatusFound)
+					return
+				}
+			}
+
+			maxAgeDays, err := formInt(r, "max_age_days")
+			if err != nil {
+				log.Println("max_age_days is not a number", err)
+				http.Redirect(w, r, "/settings/channel?uid="+uid, http.StatusFound)
+				return
+			}
+
+			maxItems, err := formInt(r, "max_items")
+			if err != nil {
+				log.Println("max_items is not a number", err)
+				http.Redirect(w, r, "/settings/channel?uid="+uid, http.StatusFound)
+				return
+			}
 
 			setting.ExcludeRegex = excludeRegex
 			setting.IncludeRegex = includeRegex
 			setting.ChannelType = channelType
+			setting.MarkUnreadOnUpdate = r.FormValue("mark_unread_on_update") == "1"
+			setting.Retention = timeline.Retention{
+				MaxAge:      time.Duration(maxAgeDays) * 24 * time.Hour,
+				MaxItems:    maxItems,
+				KeepUnread:  r.FormValue("keep_unread") == "1",
+				KeepStarred: r.FormValue("keep_starred") == "1",
+			}
 			if values, e := r.Form["exclude_type"]; e {
 				setting.ExcludeType = values
 			}
 
-			err = h.Backend.saveSetting(uid, setting)
+			err = h.Backend.saveSetting(r.Context(), uid, setting)
 			if err != nil {
 				log.Println("saveSetting", uid, setting, err)
 			}
@@ -791,7 +844,7 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/settings", http.StatusFound)
 			return
 		} else if r.URL.Path == "/refresh" {
-			h.Backend.RefreshFeeds()
+			h.Backend.RefreshFeeds(r.Context())
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
@@ -800,6 +853,33 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+// formInt returns the value of the form field as a number that is not
+// negative, an empty field is zero
+func formInt(r *http.Request, name string) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s is negative: %d", name, n)
+	}
+	return n, nil
+}
+
+// isTimelineType returns true when timelineType is a registered timeline type
+func isTimelineType(timelineType string) bool {
+	for _, t := range timeline.Types() {
+		if t == timelineType {
+			return true
+		}
+	}
+	return false
+}
+
 func httpSessionLogout(r *http.Request, w http.ResponseWriter, conn redis.Conn) {
 	c, err := r.Cookie("session")
 	if err == http.ErrNoCookie {
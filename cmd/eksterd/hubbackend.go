@@ -20,6 +20,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"expvar"
 	"fmt"
@@ -40,11 +41,11 @@ const LeaseSeconds = 24 * 60 * 60
 
 // HubBackend handles information for the incoming handler
 type HubBackend interface {
-	Feeds() ([]Feed, error)
-	CreateFeed(url string) (int64, error)
-	GetSecret(feedID int64) string
-	UpdateFeed(processor ContentProcessor, feedID int64, contentType string, body io.Reader) error
-	FeedSetLeaseSeconds(feedID int64, leaseSeconds int64) error
+	Feeds(ctx context.Context) ([]Feed, error)
+	CreateFeed(ctx context.Context, url string) (int64, error)
+	GetSecret(ctx context.Context, feedID int64) string
+	UpdateFeed(ctx context.Context, processor ContentProcessor, feedID int64, contentType string, body io.Reader) error
+	FeedSetLeaseSeconds(ctx context.Context, feedID int64, leaseSeconds int64) error
 	Subscribe(feed *Feed) error
 }
 
@@ -73,10 +74,10 @@ func init() {
 	varWebsub = expvar.NewMap("websub")
 }
 
-func (h *hubIncomingBackend) GetSecret(id int64) string {
+func (h *hubIncomingBackend) GetSecret(ctx context.Context, id int64) string {
 	db := h.database
 	var secret string
-	err := db.QueryRow(
+	err := db.QueryRowContext(ctx,
 		`select "subscription_secret" from "subscriptions" where "id" = $1`,
 		id,
 	).Scan(&secret)
@@ -86,7 +87,7 @@ func (h *hubIncomingBackend) GetSecret(id int64) string {
 	return secret
 }
 
-func (h *hubIncomingBackend) CreateFeed(topic string) (int64, error) {
+func (h *hubIncomingBackend) CreateFeed(ctx context.Context, topic string) (int64, error) {
 	log.Println("CreateFeed", topic)
 	db := h.database
 
@@ -94,7 +95,7 @@ func (h *hubIncomingBackend) CreateFeed(topic string) (int64, error) {
 	urlSecret := util.RandStringBytes(32)
 
 	var subscriptionID int
-	err := db.QueryRow(`
+	err := db.QueryRowContext(ctx, `
 INSERT INTO "subscriptions" ("topic","subscription_secret", "url_secret", "lease_seconds", "created_at")
 VALUES ($1, $2, $3, $4, DEFAULT) RETURNING "id"`, topic, secret, urlSecret, 60*60*24*7).Scan(&subscriptionID)
 	if err != nil {
@@ -117,7 +118,7 @@ VALUES ($1, $2, $3, $4, DEFAULT) RETURNING "id"`, topic, secret, urlSecret, 60*6
 	log.Printf("WebSub Hub URL found for topic=%q hub=%q callback=%q\n", topic, hubURL, callbackURL)
 
 	if err == nil && hubURL != "" {
-		_, err := db.Exec(`UPDATE subscriptions SET hub = $1, callback = $2 WHERE id = $3`, hubURL, callbackURL, subscriptionID)
+		_, err := db.ExecContext(ctx, `UPDATE subscriptions SET hub = $1, callback = $2 WHERE id = $3`, hubURL, callbackURL, subscriptionID)
 		if err != nil {
 			return 0, fmt.Errorf("save hub and callback: %w", err)
 		}
@@ -133,16 +134,17 @@ VALUES ($1, $2, $3, $4, DEFAULT) RETURNING "id"`, topic, secret, urlSecret, 60*6
 	return int64(subscriptionID), nil
 }
 
-func (h *hubIncomingBackend) UpdateFeed(processor ContentProcessor, subscriptionID int64, contentType string, body io.Reader) error {
+func (h *hubIncomingBackend) UpdateFeed(ctx context.Context, processor ContentProcessor, subscriptionID int64, contentType string, body io.Reader) error {
 	log.Println("UpdateFeed", subscriptionID)
 
 	db := h.database
-	// Process all channels that contains this feed
-	rows, err := db.Query(`
+	// Process all channels that follow this feed
+	rows, err := db.QueryContext(ctx, `
 select topic, c.uid, f.id, c.name
 from subscriptions s
-inner join feeds f    on f.url = s.topic
-inner join channels c on c.id = f.channel_id
+inner join feeds f          on f.url = s.topic
+inner join channel_feeds cf on cf.feed_id = f.id
+inner join channels c       on c.id = cf.channel_id
 where s.id = $1
 `,
 		subscriptionID,
@@ -168,7 +170,7 @@ where s.id = $1
 		}
 
 		log.Printf("Updating feed %s %q in %q (%s)\n", feedID, topic, channelName, channel)
-		_, err = processor.ProcessContent(channel, feedID, topic, contentType, buf)
+		_, err = processor.ProcessContent(ctx, channel, feedID, topic, contentType, buf)
 		if err != nil {
 			log.Printf("could not process content for channel %s: %s", channelName, err)
 		}
@@ -180,9 +182,9 @@ where s.id = $1
 	return err
 }
 
-func (h *hubIncomingBackend) FeedSetLeaseSeconds(subscriptionID int64, leaseSeconds int64) error {
+func (h *hubIncomingBackend) FeedSetLeaseSeconds(ctx context.Context, subscriptionID int64, leaseSeconds int64) error {
 	db := h.database
-	_, err := db.Exec(`
+	_, err := db.ExecContext(ctx, `
 update subscriptions
 set lease_seconds = $1,
     resubscribe_at = now() + $2 * interval '1' second
@@ -192,16 +194,16 @@ where id = $3
 }
 
 // Feeds returns a list of subscribed feeds
-func (h *hubIncomingBackend) Feeds() ([]Feed, error) {
+func (h *hubIncomingBackend) Feeds(ctx context.Context) ([]Feed, error) {
 	db := h.database
 	var feeds []Feed
 
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(ctx, `
 		select s.id, topic, hub, callback, subscription_secret, lease_seconds, resubscribe_at
 		from subscriptions s
 		inner join feeds f on f.url = s.topic
-		inner join channels c on c.id = f.channel_id
 		where hub is not null
+		and exists (select 1 from channel_feeds cf where cf.feed_id = f.id)
 	`)
 	if err != nil {
 		return nil, err
@@ -240,13 +242,14 @@ func (h *hubIncomingBackend) run() error {
 	quit := make(chan struct{})
 
 	go func() {
+		ctx := context.Background()
 		for {
 			select {
 			case <-ticker.C:
 				log.Println("Getting feeds for WebSub started")
 				varWebsub.Add("runs", 1)
 
-				feeds, err := h.Feeds()
+				feeds, err := h.Feeds(ctx)
 				if err != nil {
 					log.Println("Feeds failed:", err)
 					log.Println("Getting feeds for WebSub completed")
@@ -72,7 +72,7 @@ func (h *incomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, fmt.Sprintf("error in hub.lease_seconds format %q: %s", leaseSeconds, err), http.StatusBadRequest)
 				return
 			}
-			err = h.Backend.FeedSetLeaseSeconds(feed, leaseSeconds)
+			err = h.Backend.FeedSetLeaseSeconds(r.Context(), feed, leaseSeconds)
 			if err != nil {
 				log.Printf("error in while setting hub.lease_seconds: %s", err)
 				http.Error(w, fmt.Sprintf("error in while setting hub.lease_seconds: %s", err), http.StatusBadRequest)
@@ -93,7 +93,7 @@ func (h *incomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// find secret
-	secret := h.Backend.GetSecret(feed)
+	secret := h.Backend.GetSecret(r.Context(), feed)
 	if secret == "" {
 		log.Printf("missing secret for feed %d\n", feed)
 		http.Error(w, "Unknown", http.StatusBadRequest)
@@ -118,7 +118,7 @@ func (h *incomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ct := r.Header.Get("Content-Type")
-	err = h.Backend.UpdateFeed(h.Processor, feed, ct, bytes.NewBuffer(feedContent))
+	err = h.Backend.UpdateFeed(r.Context(), h.Processor, feed, ct, bytes.NewBuffer(feedContent))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("could not update feed: %s (%s)", ct, err), http.StatusBadRequest)
 		return
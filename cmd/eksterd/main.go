@@ -22,10 +22,12 @@ Eksterd is a microsub server that is extendable.
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	_ "expvar"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -35,6 +37,8 @@ import (
 
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/pstuifzand/ekster/pkg/auth"
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/server"
 	"github.com/pstuifzand/ekster/pkg/userid"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -51,8 +55,19 @@ type AppOptions struct {
 	RedisServer string
 	BaseURL     string
 	DatabaseURL string
-	pool        *redis.Pool
-	database    *sql.DB
+	// RequestTimeout cancels the work of a Microsub request after this
+	// duration, zero disables it
+	RequestTimeout time.Duration
+	// FetchTimeout is the maximum duration of fetching a feed
+	FetchTimeout time.Duration
+	// PruneInterval is the time between removing expired items, zero
+	// disables it
+	PruneInterval time.Duration
+	// ResolveRedirects resolves the redirects of new items to find the same
+	// post from other feeds
+	ResolveRedirects bool
+	pool             *redis.Pool
+	database         *sql.DB
 }
 
 //go:embed db/migrations/*.sql
@@ -70,6 +85,23 @@ func newPool(addr string) *redis.Pool {
 	}
 }
 
+// WithTimeout cancels the context of requests to handler after timeout. The
+// events action is a long running connection and doesn't get a timeout.
+func WithTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("action") == "events" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // WithAuth adds authorization to a http.Handler
 func WithAuth(handler http.Handler, b *memoryBackend) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -83,16 +115,16 @@ func WithAuth(handler http.Handler, b *memoryBackend) http.Handler {
 		userID, err := strconv.Atoi(userIDStr)
 		if err != nil {
 			log.Println(r.URL.Path, "does not contain a user id")
-			http.Error(w, "No user id found in url", http.StatusBadRequest)
+			server.RespondError(w, fmt.Errorf("no user id found in url: %w", microsub.ErrInvalidRequest))
 			return
 		}
 
 		var me, tokenEndpoint string
-		row := b.database.QueryRow(`SELECT "url", "token_endpoint" FROM "users" WHERE "id" = $1`, userID)
+		row := b.database.QueryRowContext(r.Context(), `SELECT "url", "token_endpoint" FROM "users" WHERE "id" = $1`, userID)
 		err = row.Scan(&me, &tokenEndpoint)
 		if err == sql.ErrNoRows {
 			log.Println("no user found with id", userID)
-			http.Error(w, "No user found with id", http.StatusBadRequest)
+			server.RespondError(w, fmt.Errorf("no user found with id %d: %w", userID, microsub.ErrNotFound))
 			return
 		}
 
@@ -114,17 +146,18 @@ func WithAuth(handler http.Handler, b *memoryBackend) http.Handler {
 		}
 		if !authorized {
 			log.Printf("Token could not be validated")
-			http.Error(w, "Can't validate token", http.StatusForbidden)
+			server.RespondError(w, fmt.Errorf("can't validate token: %w", microsub.ErrUnauthorized))
 			return
 		}
 
 		if token.Me != me {
 			log.Printf("Missing \"me\" in token response: %#v\n", token)
-			http.Error(w, "Wrong me", http.StatusForbidden)
+			server.RespondError(w, fmt.Errorf("wrong me: %w", microsub.ErrUnauthorized))
 			return
 		}
 
 		ctx := userid.NewContext(r.Context(), userID)
+		ctx = auth.NewContext(ctx, token)
 		r = r.WithContext(ctx)
 
 		handler.ServeHTTP(w, r)
@@ -142,6 +175,10 @@ func main() {
 	flag.StringVar(&options.RedisServer, "redis", "redis:6379", "redis server")
 	flag.StringVar(&options.BaseURL, "baseurl", "", "http server baseurl")
 	flag.StringVar(&options.DatabaseURL, "db", "host=database user=postgres password=simple dbname=ekster sslmode=disable", "database url")
+	flag.DurationVar(&options.RequestTimeout, "request-timeout", 30*time.Second, "maximum duration of a microsub request, 0 disables the timeout")
+	flag.DurationVar(&options.FetchTimeout, "fetch-timeout", DefaultFetchTimeout, "maximum duration of fetching a feed")
+	flag.DurationVar(&options.PruneInterval, "prune-interval", DefaultPruneInterval, "time between removing expired items, 0 disables pruning")
+	flag.BoolVar(&options.ResolveRedirects, "resolve-redirects", false, "resolve redirects of new items to find duplicates, fetches the url of each new item")
 
 	flag.Parse()
 
@@ -83,13 +83,31 @@ type memoryBackend struct {
 	pool *redis.Pool
 
 	database *sql.DB
+
+	// fetchTimeout is the maximum duration of fetching a feed
+	fetchTimeout time.Duration
+
+	// pruneInterval is the time between two runs of the pruner, zero
+	// disables the pruner
+	pruneInterval time.Duration
+
+	// resolveRedirects resolves the redirects of the urls of new items, to
+	// find the same post from other feeds
+	resolveRedirects bool
 }
 
+// DefaultFetchTimeout is used when the fetch timeout is not set
+const DefaultFetchTimeout = 5 * time.Second
+
 type channelSetting struct {
 	ExcludeRegex string
 	IncludeRegex string
 	ExcludeType  []string
 	ChannelType  string
+	// MarkUnreadOnUpdate marks items unread again when their content changes
+	MarkUnreadOnUpdate bool
+	// Retention is the policy for removing old items from the channel
+	Retention timeline.Retention
 }
 
 type channelMessage struct {
@@ -102,18 +120,35 @@ type channelDeletedMessage struct {
 	UID     string `json:"uid"`
 }
 
+type channelsOrderMessage struct {
+	Version  int      `json:"version"`
+	Channels []string `json:"channels"`
+}
+
 type newItemMessage struct {
 	Item    microsub.Item `json:"item"`
 	Channel string        `json:"channel"`
 }
 
+type markItemsMessage struct {
+	Channel       string   `json:"channel"`
+	Entries       []string `json:"entries,omitempty"`
+	LastReadEntry string   `json:"last_read_entry,omitempty"`
+}
+
+type removeItemsMessage struct {
+	Channel string   `json:"channel"`
+	Entries []string `json:"entries"`
+}
+
 type feed struct {
-	UID         string // channel
-	ID          int
-	URL         string
-	Tier        int
-	Unmodified  int
-	NextFetchAt time.Time
+	ID           int
+	URL          string
+	Tier         int
+	Unmodified   int
+	NextFetchAt  time.Time
+	ETag         string
+	LastModified string
 }
 
 func (b *memoryBackend) AuthTokenAccepted(header string, r *auth.TokenResponse, endpoint string) (bool, error) {
@@ -140,11 +175,17 @@ func (b *memoryBackend) ChannelsGetList(ctx context.Context) ([]microsub.Channel
 	userID, _ := userid.FromContext(ctx)
 
 	var channels []microsub.Channel
-	rows, err := b.database.Query(`
+	rows, err := b.database.QueryContext(ctx, `
 		SELECT c.uid, c.name, count(i.channel_id) as unread
 		FROM "channels" "c" left join items i on c.id = i.channel_id and i.is_read = 0
+			and not exists (
+				select 1 from mutes m
+				where m.user_id = c.user_id and (m.channel_id is null or m.channel_id = c.id)
+				and m.url = i.data->'author'->>'url'
+			)
 		WHERE "c"."user_id" = $1
-		GROUP BY c.id;
+		GROUP BY c.id
+		ORDER BY c.priority, c.id;
 	`, userID)
 
 	if err != nil {
@@ -162,9 +203,6 @@ func (b *memoryBackend) ChannelsGetList(ctx context.Context) ([]microsub.Channel
 		}})
 	}
 
-	util.StablePartition(channels, 0, len(channels), func(i int) bool {
-		return channels[i].Unread.HasUnread()
-	})
 	return channels, nil
 }
 
@@ -199,11 +237,12 @@ func (b *memoryBackend) ChannelsCreate(ctx context.Context, name string) (micros
 	for {
 		varMicrosub.Add("ChannelsCreate.RandStringBytes", 1)
 		channel.UID = util.RandStringBytes(24)
-		result, err := b.database.Exec(
-			`insert into "channels" ("uid", "name", "user_id", "created_at") values ($1, $2, $3, DEFAULT)`,
+		result, err := b.database.ExecContext(ctx,
+			`insert into "channels" ("uid", "name", "user_id", "priority", "created_at") values ($1, $2, $3, $4, DEFAULT)`,
 			channel.UID,
 			channel.Name,
 			userID,
+			DefaultPrio,
 		)
 		if err != nil {
 			log.Println("channels insert", err)
@@ -215,7 +254,7 @@ func (b *memoryBackend) ChannelsCreate(ctx context.Context, name string) (micros
 		}
 		if n, err := result.RowsAffected(); err == nil {
 			if n > 0 {
-				b.broker.Notifier <- sse.Message{Event: "new channel", Object: channelMessage{1, channel}}
+				b.notifyUser(userID, "new channel", channelMessage{1, channel})
 			}
 		}
 		return channel, nil
@@ -224,45 +263,105 @@ func (b *memoryBackend) ChannelsCreate(ctx context.Context, name string) (micros
 
 // ChannelsUpdate updates a channels
 func (b *memoryBackend) ChannelsUpdate(ctx context.Context, uid, name string) (microsub.Channel, error) {
-	_, err := b.database.Exec(`UPDATE "channels" SET "name" = $1 WHERE "uid" = $2`, name, uid)
+	userID, _ := userid.FromContext(ctx)
+	result, err := b.database.ExecContext(ctx, `UPDATE "channels" SET "name" = $1 WHERE "uid" = $2 AND "user_id" = $3`, name, uid, userID)
 	if err != nil {
 		return microsub.Channel{}, err
 	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return microsub.Channel{}, fmt.Errorf("channel %q: %w", uid, microsub.ErrNotFound)
+	}
 	c := microsub.Channel{
 		UID:    uid,
 		Name:   name,
 		Unread: microsub.Unread{},
 	}
 
-	b.broker.Notifier <- sse.Message{Event: "update channel", Object: channelMessage{1, c}}
+	b.notifyUser(userID, "update channel", channelMessage{1, c})
 
 	return c, nil
 }
 
 // ChannelsDelete deletes a channel
 func (b *memoryBackend) ChannelsDelete(ctx context.Context, uid string) error {
-	_, err := b.database.Exec(`delete from "channels" where "uid" = $1`, uid)
+	userID, _ := userid.FromContext(ctx)
+	result, err := b.database.ExecContext(ctx, `delete from "channels" where "uid" = $1 and "user_id" = $2`, uid, userID)
 	if err != nil {
 		return err
 	}
-	b.broker.Notifier <- sse.Message{Event: "delete channel", Object: channelDeletedMessage{1, uid}}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("channel %q: %w", uid, microsub.ErrNotFound)
+	}
+	b.notifyUser(userID, "delete channel", channelDeletedMessage{1, uid})
+	return nil
+}
+
+// ChannelsOrder sets the order of the channels to the order of uids
+func (b *memoryBackend) ChannelsOrder(ctx context.Context, uids []string) error {
+	userID, _ := userid.FromContext(ctx)
+
+	tx, err := b.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for prio, uid := range uids {
+		_, err = tx.ExecContext(ctx, `UPDATE "channels" SET "priority" = $1 WHERE "uid" = $2 AND "user_id" = $3`, prio, uid, userID)
+		if err != nil {
+			return fmt.Errorf("while ordering channel %s: %w", uid, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	b.notifyUser(userID, "order channels", channelsOrderMessage{1, uids})
+
 	return nil
 }
-func (b *memoryBackend) updateFeed(feed feed) error {
-	_, err := b.database.Exec(`
+
+func (b *memoryBackend) updateFeed(ctx context.Context, feed feed) error {
+	_, err := b.database.ExecContext(ctx, `
 UPDATE "feeds"
-SET "tier" = $2, "unmodified" = $3, "next_fetch_at" = $4
+SET "tier" = $2, "unmodified" = $3, "next_fetch_at" = $4, "etag" = $5, "last_modified" = $6
 WHERE "id" = $1
-`, feed.ID, feed.Tier, feed.Unmodified, feed.NextFetchAt)
+`, feed.ID, feed.Tier, feed.Unmodified, feed.NextFetchAt, feed.ETag, feed.LastModified)
 	return err
 }
 
-func (b *memoryBackend) getFeeds() ([]feed, error) {
-	rows, err := b.database.Query(`
-SELECT "f"."id", "f"."url", "c"."uid", "f"."tier","f"."unmodified","f"."next_fetch_at"
+// feedChannels returns the uids of the channels that follow the feed
+func (b *memoryBackend) feedChannels(ctx context.Context, feedID int) ([]string, error) {
+	rows, err := b.database.QueryContext(ctx, `
+SELECT "c"."uid"
+FROM "channel_feeds" AS "cf"
+INNER JOIN "channels" AS "c" ON "c"."id" = "cf"."channel_id"
+WHERE "cf"."feed_id" = $1
+ORDER BY "cf"."id"
+`, feedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		channels = append(channels, uid)
+	}
+	return channels, rows.Err()
+}
+
+func (b *memoryBackend) getFeeds(ctx context.Context) ([]feed, error) {
+	rows, err := b.database.QueryContext(ctx, `
+SELECT "f"."id", "f"."url", "f"."tier", "f"."unmodified", "f"."next_fetch_at", "f"."etag", "f"."last_modified"
 FROM "feeds" AS "f"
-INNER JOIN public.channels c ON c.id = f.channel_id
-WHERE next_fetch_at IS NULL OR next_fetch_at < now()
+WHERE ("next_fetch_at" IS NULL OR "next_fetch_at" < now())
+AND EXISTS (SELECT 1 FROM "channel_feeds" AS "cf" WHERE "cf"."feed_id" = "f"."id")
 `)
 	if err != nil {
 		return nil, err
@@ -271,11 +370,11 @@ WHERE next_fetch_at IS NULL OR next_fetch_at < now()
 	var feeds []feed
 	for rows.Next() {
 		var feedID int
-		var feedURL, UID string
+		var feedURL, etag, lastModified string
 		var tier, unmodified int
 		var nextFetchAt sql.NullTime
 
-		err = rows.Scan(&feedID, &feedURL, &UID, &tier, &unmodified, &nextFetchAt)
+		err = rows.Scan(&feedID, &feedURL, &tier, &unmodified, &nextFetchAt, &etag, &lastModified)
 		if err != nil {
 			log.Printf("while scanning feeds: %s", err)
 			continue
@@ -291,12 +390,13 @@ WHERE next_fetch_at IS NULL OR next_fetch_at < now()
 		feeds = append(
 			feeds,
 			feed{
-				UID:         UID,
-				ID:          feedID,
-				URL:         feedURL,
-				Tier:        tier,
-				Unmodified:  unmodified,
-				NextFetchAt: fetchTime,
+				ID:           feedID,
+				URL:          feedURL,
+				Tier:         tier,
+				Unmodified:   unmodified,
+				NextFetchAt:  fetchTime,
+				ETag:         etag,
+				LastModified: lastModified,
 			},
 		)
 	}
@@ -308,26 +408,37 @@ func (b *memoryBackend) run() {
 	b.ticker = time.NewTicker(1 * time.Minute)
 	b.quit = make(chan struct{})
 
+	// closing quit cancels a refresh that is running
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-b.quit
+		cancel()
+	}()
+
 	go func() {
-		b.RefreshFeeds()
+		b.RefreshFeeds(ctx)
 
 		for {
 			select {
 			case <-b.ticker.C:
-				b.RefreshFeeds()
-			case <-b.quit:
+				b.RefreshFeeds(ctx)
+			case <-ctx.Done():
 				b.ticker.Stop()
 				return
 			}
 		}
 	}()
+
+	if b.pruneInterval > 0 {
+		go b.runPruner(ctx, b.pruneInterval)
+	}
 }
 
-func (b *memoryBackend) RefreshFeeds() {
+func (b *memoryBackend) RefreshFeeds(ctx context.Context) {
 	log.Println("Feed update process started")
 	defer log.Println("Feed update process completed")
 
-	feeds, err := b.getFeeds()
+	feeds, err := b.getFeeds(ctx)
 	if err != nil {
 		return
 	}
@@ -337,9 +448,9 @@ func (b *memoryBackend) RefreshFeeds() {
 	count := 0
 	for _, feed := range feeds {
 		log.Println("Processing", feed.URL)
-		err := b.refreshFeed(feed)
+		err := b.refreshFeed(ctx, feed)
 		if err != nil {
-			b.addNotification("Error while fetching feed", feed, err)
+			b.addNotification(ctx, "Error while fetching feed", feed, err)
 			continue
 		}
 
@@ -347,24 +458,37 @@ func (b *memoryBackend) RefreshFeeds() {
 	}
 
 	if count > 0 {
-		_ = b.updateChannelUnreadCount("notifications")
+		_ = b.updateChannelUnreadCount(ctx, "notifications")
 	}
 	log.Printf("Processed %d feeds", count)
 }
 
-func (b *memoryBackend) refreshFeed(feed feed) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (b *memoryBackend) refreshFeed(ctx context.Context, feed feed) error {
+	channels, err := b.feedChannels(ctx, feed.ID)
+	if err != nil {
+		return fmt.Errorf("while finding channels of %s: %w", feed.URL, err)
+	}
+
+	// The feed is fetched once for all channels that follow it
+	log.Printf("Fetching feed=%d fetchURL=%s for %d channels\n", feed.ID, feed.URL, len(channels))
+	fetchCtx, cancel := b.fetchContext(ctx)
 	defer cancel()
 
-	resp, err := b.Fetch3(ctx, feed.UID, feed.URL)
+	resp, err := FetchIfModified(fetchCtx, feed.URL, feed.ETag, feed.LastModified)
 	if err != nil {
-		return fmt.Errorf("while Fetch3 of %s: %w", feed.URL, err)
+		return fmt.Errorf("while fetching %s: %w", feed.URL, err)
 	}
 	defer resp.Body.Close()
 
-	changed, err := b.ProcessContent(feed.UID, fmt.Sprintf("%d", feed.ID), feed.URL, resp.Header.Get("Content-Type"), resp.Body)
-	if err != nil {
-		return fmt.Errorf("in ProcessContent of %s: %w", feed.URL, err)
+	changed := false
+	if resp.StatusCode != http.StatusNotModified {
+		feed.ETag = resp.Header.Get("ETag")
+		feed.LastModified = resp.Header.Get("Last-Modified")
+
+		changed, err = b.fanOutContent(ctx, channels, strconv.Itoa(feed.ID), feed.URL, resp.Header.Get("Content-Type"), resp.Body)
+		if err != nil {
+			return fmt.Errorf("in ProcessContent of %s: %w", feed.URL, err)
+		}
 	}
 
 	if changed {
@@ -392,7 +516,7 @@ func (b *memoryBackend) refreshFeed(feed feed) error {
 
 	log.Printf("Next Fetch in %d minutes at %v", minutes, feed.NextFetchAt.Format(time.RFC3339))
 
-	err = b.updateFeed(feed)
+	err = b.updateFeed(ctx, feed)
 	if err != nil {
 		log.Printf("Error: while updating feed %v: %v", feed, err)
 		// don't return error, because it becomes a notification
@@ -402,8 +526,36 @@ func (b *memoryBackend) refreshFeed(feed feed) error {
 	return nil
 }
 
-func (b *memoryBackend) addNotification(name string, feed feed, err error) {
-	_, err = b.channelAddItem("notifications", microsub.Item{
+// fetchContext returns the context for fetching a feed, it's canceled after
+// the fetch timeout
+func (b *memoryBackend) fetchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := b.fetchTimeout
+	if timeout <= 0 {
+		timeout = DefaultFetchTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// fanOutContent processes the body of the feed for each of the channels
+func (b *memoryBackend) fanOutContent(ctx context.Context, channels []string, feedID, fetchURL, contentType string, body io.Reader) (bool, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, channel := range channels {
+		channelChanged, err := b.ProcessContent(ctx, channel, feedID, fetchURL, contentType, bytes.NewReader(data))
+		if err != nil {
+			return changed, fmt.Errorf("channel %s: %w", channel, err)
+		}
+		changed = changed || channelChanged
+	}
+	return changed, nil
+}
+
+func (b *memoryBackend) addNotification(ctx context.Context, name string, feed feed, err error) {
+	_, err = b.channelAddItem(ctx, "notifications", microsub.Item{
 		Type: "entry",
 		Source: &microsub.Source{
 			ID:   strconv.Itoa(feed.ID),
@@ -421,97 +573,544 @@ func (b *memoryBackend) addNotification(name string, feed feed, err error) {
 	}
 }
 
-func (b *memoryBackend) TimelineGet(ctx context.Context, before, after, channel string) (microsub.Timeline, error) {
+func (b *memoryBackend) TimelineGet(ctx context.Context, channel string, options microsub.TimelineOptions) (microsub.Timeline, error) {
 	log.Printf("TimelineGet %s\n", channel)
 
-	// Check if feed exists
-	_, err := b.FollowGetList(ctx, channel)
-	if err != nil {
-		return microsub.Timeline{Items: []microsub.Item{}}, err
+	if channel != timeline.GlobalChannel {
+		// Check if feed exists
+		_, err := b.FollowGetList(ctx, channel)
+		if err != nil {
+			return microsub.Timeline{Items: []microsub.Item{}}, err
+		}
 	}
 
-	timelineBackend, err := b.getTimeline(channel)
+	timelineBackend, err := b.userTimeline(ctx, channel)
 	if err != nil {
 		return microsub.Timeline{}, err
 	}
 
-	// _ = b.updateChannelUnreadCount(channel)
+	// _ = b.updateChannelUnreadCount(ctx, channel)
 
-	return timelineBackend.Items(before, after)
+	// Muted items are left out after the backend has paged, so keep fetching
+	// pages until this page is full or the timeline runs out of items
+	limit := timeline.PageLimit(options)
+	backwards := options.Before != ""
+
+	// Items in the global channel are muted by the mutes of their own channel
+	mutes := make(map[string]map[string]bool)
+
+	var tl microsub.Timeline
+	items := []microsub.Item{}
+	for {
+		options.Limit = limit - len(items)
+		page, err := timelineBackend.Items(ctx, options)
+		if err != nil {
+			return page, err
+		}
+
+		var pageItems []microsub.Item
+		for _, item := range page.Items {
+			itemChannel := item.Channel
+			if itemChannel == "" {
+				itemChannel = channel
+			}
+			muted, e := mutes[itemChannel]
+			if !e {
+				muted, err = b.channelAuthorURLs(ctx, mutesTable, itemChannel)
+				if err != nil {
+					return page, err
+				}
+				mutes[itemChannel] = muted
+			}
+			if muted[itemAuthorURL(item)] {
+				continue
+			}
+			pageItems = append(pageItems, item)
+		}
+
+		if backwards {
+			// Newer pages go in front of the items
+			items = append(pageItems, items...)
+			if tl.Paging.After == "" {
+				tl.Paging.After = page.Paging.After
+			}
+			tl.Paging.Before = page.Paging.Before
+			options.Before = page.Paging.Before
+		} else {
+			items = append(items, pageItems...)
+			if tl.Paging.Before == "" {
+				tl.Paging.Before = page.Paging.Before
+			}
+			tl.Paging.After = page.Paging.After
+			options.After = page.Paging.After
+		}
+
+		cursor := page.Paging.After
+		if backwards {
+			cursor = page.Paging.Before
+		}
+		if len(items) >= limit || len(page.Items) == 0 || cursor == "" {
+			break
+		}
+	}
+	tl.Items = items
+
+	return tl, nil
 }
 
 func (b *memoryBackend) FollowGetList(ctx context.Context, uid string) ([]microsub.Feed, error) {
-	rows, err := b.database.Query(`SELECT "f"."url" FROM "feeds" AS "f" INNER JOIN channels c on c.id = f.channel_id WHERE c.uid = $1`, uid)
+	userID, _ := userid.FromContext(ctx)
+	channelID, err := b.userChannelID(ctx, userID, uid)
 	if err != nil {
 		return nil, err
 	}
 
+	rows, err := b.database.QueryContext(ctx, `
+SELECT "f"."id", "f"."url", "f"."name", "f"."photo", "f"."description", "f"."author"
+FROM "feeds" AS "f"
+INNER JOIN "channel_feeds" AS "cf" ON "cf"."feed_id" = "f"."id"
+WHERE "cf"."channel_id" = $1
+ORDER BY "cf"."id"
+`, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
 	var feeds []microsub.Feed
 	for rows.Next() {
-		var feedURL string
-		err = rows.Scan(&feedURL)
+		feed, err := scanFeed(rows)
 		if err != nil {
 			continue
 		}
-		feeds = append(feeds, microsub.Feed{
-			Type: "feed",
-			URL:  feedURL,
-		})
+		feeds = append(feeds, feed)
 	}
 	return feeds, nil
 }
 
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFeed(row rowScanner) (microsub.Feed, error) {
+	var feedID int
+	var feed microsub.Feed
+	err := row.Scan(&feedID, &feed.URL, &feed.Name, &feed.Photo, &feed.Description, &feed.Author)
+	if err != nil {
+		return feed, err
+	}
+	feed.ID = strconv.Itoa(feedID)
+	feed.Type = "feed"
+	return feed, nil
+}
+
+// feedHeader returns the stored header of the feed
+func (b *memoryBackend) feedHeader(ctx context.Context, feedID string) (microsub.Feed, error) {
+	row := b.database.QueryRowContext(ctx, `
+SELECT "id", "url", "name", "photo", "description", "author"
+FROM "feeds"
+WHERE "id" = $1
+`, feedID)
+	return scanFeed(row)
+}
+
+// updateFeedHeader stores the name, photo, description and author of the feed
+func (b *memoryBackend) updateFeedHeader(ctx context.Context, feedID string, header microsub.Feed) error {
+	_, err := b.database.ExecContext(ctx, `
+UPDATE "feeds"
+SET "name" = $2, "photo" = $3, "description" = $4, "author" = $5
+WHERE "id" = $1
+`, feedID, header.Name, header.Photo, header.Description, &header.Author)
+	return err
+}
+
 func (b *memoryBackend) FollowURL(ctx context.Context, uid string, url string) (microsub.Feed, error) {
 	subFeed := microsub.Feed{Type: "feed", URL: url}
 
-	var channelID int
-	err := b.database.QueryRow(`SELECT "id" FROM "channels" WHERE "uid" = $1`, uid).Scan(&channelID)
+	userID, _ := userid.FromContext(ctx)
+	channelID, err := b.userChannelID(ctx, userID, uid)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return microsub.Feed{}, fmt.Errorf("channel does not exist: %w", err)
-		}
 		return microsub.Feed{}, err
 	}
 
-	var feedID int
-	err = b.database.QueryRow(
-		`INSERT INTO "feeds" ("channel_id", "url", "tier", "unmodified", "next_fetch_at") VALUES ($1, $2, 1, 0, now()) RETURNING "id"`,
+	feedID, created, err := b.findOrCreateFeed(ctx, subFeed.URL)
+	if err != nil {
+		return subFeed, err
+	}
+	subFeed.ID = strconv.Itoa(feedID)
+
+	_, err = b.database.ExecContext(ctx,
+		`INSERT INTO "channel_feeds" ("channel_id", "feed_id") VALUES ($1, $2) ON CONFLICT DO NOTHING`,
 		channelID,
-		subFeed.URL,
-	).Scan(&feedID)
+		feedID,
+	)
 	if err != nil {
 		return subFeed, err
 	}
 
 	var newFeed = feed{
 		ID:          feedID,
-		UID:         uid,
 		URL:         url,
 		Tier:        1,
 		Unmodified:  0,
 		NextFetchAt: time.Now(),
 	}
-	resp, err := b.Fetch3(ctx, uid, subFeed.URL)
+	fetchCtx, cancel := b.fetchContext(ctx)
+	defer cancel()
+
+	resp, err := b.Fetch3(fetchCtx, uid, subFeed.URL)
 	if err != nil {
 		log.Println(err)
-		b.addNotification("Error while fetching feed", newFeed, err)
-		_ = b.updateChannelUnreadCount("notifications")
-		return subFeed, err
+		b.addNotification(ctx, "Error while fetching feed", newFeed, err)
+		_ = b.updateChannelUnreadCount(ctx, "notifications")
+		return subFeed, fmt.Errorf("fetching %s: %v: %w", subFeed.URL, err, microsub.ErrUpstream)
 	}
 	defer resp.Body.Close()
 
-	_, _ = b.ProcessContent(uid, fmt.Sprintf("%d", feedID), subFeed.URL, resp.Header.Get("Content-Type"), resp.Body)
+	_, _ = b.ProcessContent(ctx, uid, subFeed.ID, subFeed.URL, resp.Header.Get("Content-Type"), resp.Body)
 
-	_, _ = b.hubBackend.CreateFeed(url)
+	// Only the first follow of a feed subscribes to its hub
+	if created {
+		_, _ = b.hubBackend.CreateFeed(ctx, url)
+	}
+
+	if header, err := b.feedHeader(ctx, subFeed.ID); err == nil {
+		subFeed = header
+	}
 
 	return subFeed, nil
 }
 
 func (b *memoryBackend) UnfollowURL(ctx context.Context, uid string, url string) error {
-	_, err := b.database.Exec(`DELETE FROM "feeds" "f" USING "channels" "c" WHERE "c"."id" = "f"."channel_id" AND f.url = $1 AND c.uid = $2`, url, uid)
+	userID, _ := userid.FromContext(ctx)
+	channelID, err := b.userChannelID(ctx, userID, uid)
+	if err != nil {
+		return err
+	}
+
+	tx, err := b.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var feedID int
+	err = tx.QueryRowContext(ctx, `
+DELETE FROM "channel_feeds" AS "cf"
+USING "feeds" AS "f"
+WHERE "cf"."feed_id" = "f"."id" AND "cf"."channel_id" = $1 AND "f"."url" = $2
+RETURNING "cf"."feed_id"
+`, channelID, url).Scan(&feedID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("feed %q in channel %q: %w", url, uid, microsub.ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM "items" WHERE "channel_id" = $1 AND "feed_id" = $2 RETURNING "uid"`, channelID, feedID)
+	if err != nil {
+		return fmt.Errorf("while removing items of feed %q: %w", url, err)
+	}
+	var uids []string
+	for rows.Next() {
+		var itemUID string
+		if err := rows.Scan(&itemUID); err != nil {
+			rows.Close()
+			return fmt.Errorf("while removing items of feed %q: %w", url, err)
+		}
+		uids = append(uids, itemUID)
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("while removing items of feed %q: %w", url, err)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("while removing items of feed %q: %w", url, err)
+	}
+
+	// The feed and its subscription are removed when no channel follows it anymore
+	_, err = tx.ExecContext(ctx, `
+DELETE FROM "feeds"
+WHERE "id" = $1 AND NOT EXISTS (SELECT 1 FROM "channel_feeds" WHERE "feed_id" = $1)
+`, feedID)
+	if err != nil {
+		return fmt.Errorf("while removing feed %q: %w", url, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+	for _, itemUID := range uids {
+		if err := removeFromSearch(uid, itemUID); err != nil {
+			log.Printf("could not remove item %s from search: %s", itemUID, err)
+		}
+	}
+	if err := b.removeItemURLs(ctx, uid, uids); err != nil {
+		log.Printf("could not remove urls of items from channel %s: %s", uid, err)
+	}
+	b.notifyChannel(ctx, uid, "remove items", removeItemsMessage{uid, uids})
+	if err := b.updateChannelUnreadCount(ctx, uid); err != nil {
+		log.Printf("could not update unread count of channel %s: %s", uid, err)
+	}
+	return nil
+}
+
+// findOrCreateFeed returns the id of the shared feed for the url, and whether
+// it was created
+func (b *memoryBackend) findOrCreateFeed(ctx context.Context, url string) (int, bool, error) {
+	var feedID int
+	err := b.database.QueryRowContext(ctx,
+		`INSERT INTO "feeds" ("url", "tier", "unmodified", "next_fetch_at") VALUES ($1, 1, 0, now()) ON CONFLICT ("url") DO NOTHING RETURNING "id"`,
+		url,
+	).Scan(&feedID)
+	if err == nil {
+		return feedID, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	err = b.database.QueryRowContext(ctx, `SELECT "id" FROM "feeds" WHERE "url" = $1`, url).Scan(&feedID)
+	if err != nil {
+		return 0, false, err
+	}
+	return feedID, false, nil
+}
+
+// userChannelID returns the id of the channel, when it belongs to the user
+func (b *memoryBackend) userChannelID(ctx context.Context, userID int, channel string) (int, error) {
+	var channelID int
+	err := b.database.QueryRowContext(ctx, `SELECT "id" FROM "channels" WHERE "uid" = $1 AND "user_id" = $2`, channel, userID).Scan(&channelID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("channel %q: %w", channel, microsub.ErrNotFound)
+	}
+	return channelID, err
+}
+
+// channelIDOrGlobal returns the id of the channel of the user, or an invalid
+// value when channel is empty or "global".
+func (b *memoryBackend) channelIDOrGlobal(ctx context.Context, userID int, channel string) (sql.NullInt64, error) {
+	var channelID sql.NullInt64
+	if channel == "" || channel == "global" {
+		return channelID, nil
+	}
+	id, err := b.userChannelID(ctx, userID, channel)
+	if err != nil {
+		return channelID, err
+	}
+	return sql.NullInt64{Int64: int64(id), Valid: true}, nil
+}
+
+// Tables that contain lists of authors per channel
+const (
+	mutesTable  = "mutes"
+	blocksTable = "blocks"
+)
+
+// authorListGet returns the authors in the list for the channel of the user
+func (b *memoryBackend) authorListGet(ctx context.Context, table, channel string) ([]microsub.Card, error) {
+	userID, _ := userid.FromContext(ctx)
+
+	channelID, err := b.channelIDOrGlobal(ctx, userID, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := b.database.QueryContext(ctx, fmt.Sprintf(`
+SELECT "url"
+FROM %q
+WHERE "user_id" = $1 AND "channel_id" IS NOT DISTINCT FROM $2
+ORDER BY "created_at"
+`, table), userID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []microsub.Card{}
+	for rows.Next() {
+		var authorURL string
+		err = rows.Scan(&authorURL)
+		if err != nil {
+			continue
+		}
+		cards = append(cards, microsub.Card{
+			Type: "card",
+			URL:  authorURL,
+		})
+	}
+	return cards, nil
+}
+
+// authorListAdd adds the url to the list for the channel of the user
+func (b *memoryBackend) authorListAdd(ctx context.Context, table, channel, url string) error {
+	userID, _ := userid.FromContext(ctx)
+
+	channelID, err := b.channelIDOrGlobal(ctx, userID, channel)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.database.ExecContext(ctx,
+		fmt.Sprintf(`INSERT INTO %q ("user_id", "channel_id", "url", "created_at") VALUES ($1, $2, $3, DEFAULT) ON CONFLICT DO NOTHING`, table),
+		userID,
+		channelID,
+		url,
+	)
+	return err
+}
+
+// authorListRemove removes the url from the list for the channel of the user
+func (b *memoryBackend) authorListRemove(ctx context.Context, table, channel, url string) error {
+	userID, _ := userid.FromContext(ctx)
+
+	channelID, err := b.channelIDOrGlobal(ctx, userID, channel)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.database.ExecContext(ctx,
+		fmt.Sprintf(`DELETE FROM %q WHERE "user_id" = $1 AND "channel_id" IS NOT DISTINCT FROM $2 AND "url" = $3`, table),
+		userID,
+		channelID,
+		url,
+	)
 	return err
 }
 
+// channelAuthorURLs returns the urls in the list that apply to the channel,
+// including the urls that the owner of the channel added globally.
+func (b *memoryBackend) channelAuthorURLs(ctx context.Context, table, channel string) (map[string]bool, error) {
+	rows, err := b.database.QueryContext(ctx, fmt.Sprintf(`
+SELECT "a"."url"
+FROM %q AS "a"
+INNER JOIN "channels" AS "c" ON "c"."user_id" = "a"."user_id"
+WHERE "c"."uid" = $1 AND ("a"."channel_id" IS NULL OR "a"."channel_id" = "c"."id")
+`, table), channel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := make(map[string]bool)
+	for rows.Next() {
+		var authorURL string
+		err = rows.Scan(&authorURL)
+		if err != nil {
+			continue
+		}
+		urls[authorURL] = true
+	}
+	return urls, rows.Err()
+}
+
+// itemAuthorURL returns the url of the author of the item
+func itemAuthorURL(item microsub.Item) string {
+	if item.Author == nil {
+		return ""
+	}
+	return item.Author.URL
+}
+
+func (b *memoryBackend) MuteGetList(ctx context.Context, channel string) ([]microsub.Card, error) {
+	return b.authorListGet(ctx, mutesTable, channel)
+}
+
+func (b *memoryBackend) MuteURL(ctx context.Context, channel string, url string) error {
+	err := b.authorListAdd(ctx, mutesTable, channel, url)
+	if err != nil {
+		return err
+	}
+	if channel != timeline.GlobalChannel {
+		_ = b.updateChannelUnreadCount(ctx, channel)
+	}
+	return nil
+}
+
+func (b *memoryBackend) UnmuteURL(ctx context.Context, channel string, url string) error {
+	err := b.authorListRemove(ctx, mutesTable, channel, url)
+	if err != nil {
+		return err
+	}
+	if channel != timeline.GlobalChannel {
+		_ = b.updateChannelUnreadCount(ctx, channel)
+	}
+	return nil
+}
+
+func (b *memoryBackend) BlockGetList(ctx context.Context, channel string) ([]microsub.Card, error) {
+	return b.authorListGet(ctx, blocksTable, channel)
+}
+
+// BlockURL blocks the url and removes the existing items of the author from
+// the channels the block applies to.
+func (b *memoryBackend) BlockURL(ctx context.Context, channel string, url string) error {
+	err := b.authorListAdd(ctx, blocksTable, channel, url)
+	if err != nil {
+		return err
+	}
+
+	userID, _ := userid.FromContext(ctx)
+	channelID, err := b.channelIDOrGlobal(ctx, userID, channel)
+	if err != nil {
+		return err
+	}
+
+	rows, err := b.database.QueryContext(ctx, `
+DELETE FROM "items" AS "i"
+USING "channels" AS "c"
+WHERE "c"."id" = "i"."channel_id"
+  AND "c"."user_id" = $1
+  AND ($2::int IS NULL OR "c"."id" = $2)
+  AND "i"."data"->'author'->>'url' = $3
+RETURNING "c"."uid", "i"."uid"
+`, userID, channelID, url)
+	if err != nil {
+		return fmt.Errorf("while removing items of blocked author: %w", err)
+	}
+	defer rows.Close()
+
+	removed := make(map[string][]string)
+	for rows.Next() {
+		var channelUID, itemUID string
+		err = rows.Scan(&channelUID, &itemUID)
+		if err != nil {
+			continue
+		}
+		err = removeFromSearch(channelUID, itemUID)
+		if err != nil {
+			log.Printf("could not remove blocked item %s from search: %s", itemUID, err)
+		}
+		removed[channelUID] = append(removed[channelUID], itemUID)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for channelUID, uids := range removed {
+		if err = b.removeItemURLs(ctx, channelUID, uids); err != nil {
+			log.Printf("could not remove urls of items from channel %s: %s", channelUID, err)
+		}
+		b.notifyChannel(ctx, channelUID, "remove items", removeItemsMessage{channelUID, uids})
+
+		err = b.updateChannelUnreadCount(ctx, channelUID)
+		if err != nil {
+			log.Printf("error while updating unread count for %s: %s", channelUID, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBackend) UnblockURL(ctx context.Context, channel string, url string) error {
+	return b.authorListRemove(ctx, blocksTable, channel, url)
+}
+
 func checkURL(u string) bool {
 	testURL, err := url.Parse(u)
 	if err != nil {
@@ -554,11 +1153,25 @@ func (b *memoryBackend) ItemSearch(ctx context.Context, channel, query string) (
 		return nil, fmt.Errorf("querySearch failed: %w", err)
 	}
 
-	tl, err := b.getTimeline(channel)
+	tl, err := b.userTimeline(ctx, channel)
 	if err != nil {
 		return nil, fmt.Errorf("querySearch failed: %w", err)
 	}
-	return tl.ItemsByUID(ids)
+
+	// The search index contains the items of all users, the global timeline
+	// only finds the items of this user. Items that were removed from the
+	// channel can still be in the index.
+	items := []microsub.Item{}
+	for _, id := range ids {
+		found, err := tl.ItemsByUID(ctx, []string{id})
+		if errors.Is(err, microsub.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, found...)
+	}
+	return items, nil
 }
 
 func (b *memoryBackend) Search(ctx context.Context, query string) ([]microsub.Feed, error) {
@@ -593,7 +1206,7 @@ func (b *memoryBackend) Search(ctx context.Context, query string) ([]microsub.Fe
 		defer feedResp.Body.Close()
 
 		// TODO: Combine FeedHeader and FeedItems so we can use it here
-		parsedFeed, err := fetch.FeedHeader(cachingFetch, fetchURL.String(), feedResp.Header.Get("Content-Type"), feedResp.Body)
+		parsedFeed, err := fetch.FeedHeader(ctx, cachingFetch, fetchURL.String(), feedResp.Header.Get("Content-Type"), feedResp.Body)
 		if err != nil {
 			log.Printf("Error in parse of %s - %v\n", fetchURL, err)
 			continue
@@ -616,7 +1229,7 @@ func (b *memoryBackend) Search(ctx context.Context, query string) ([]microsub.Fe
 					// FIXME: don't defer in for loop (possible memory leak)
 					defer feedResp.Body.Close()
 
-					parsedFeed, err := fetch.FeedHeader(cachingFetch, alt, feedResp.Header.Get("Content-Type"), feedResp.Body)
+					parsedFeed, err := fetch.FeedHeader(ctx, cachingFetch, alt, feedResp.Header.Get("Content-Type"), feedResp.Body)
 					if err != nil {
 						log.Printf("Error in parse of %s - %v\n", alt, err)
 						continue
@@ -635,11 +1248,11 @@ func (b *memoryBackend) PreviewURL(ctx context.Context, previewURL string) (micr
 	cachingFetch := WithCaching(b.pool, fetch.FetcherFunc(Fetch2))
 	resp, err := cachingFetch.Fetch(previewURL)
 	if err != nil {
-		return microsub.Timeline{}, fmt.Errorf("error while fetching %s: %v", previewURL, err)
+		return microsub.Timeline{}, fmt.Errorf("error while fetching %s: %v: %w", previewURL, err, microsub.ErrUpstream)
 	}
 	defer resp.Body.Close()
 
-	items, err := ProcessSourcedItems(cachingFetch, previewURL, resp.Header.Get("content-type"), resp.Body)
+	items, err := ProcessSourcedItems(ctx, cachingFetch, previewURL, resp.Header.Get("content-type"), resp.Body)
 	if err != nil {
 		return microsub.Timeline{}, fmt.Errorf("error while fetching %s: %v", previewURL, err)
 	}
@@ -650,90 +1263,283 @@ func (b *memoryBackend) PreviewURL(ctx context.Context, previewURL string) (micr
 }
 
 func (b *memoryBackend) MarkRead(ctx context.Context, channel string, uids []string) error {
-	tl, err := b.getTimeline(channel)
+	return b.markItems(ctx, channel, "mark read", markItemsMessage{Channel: channel, Entries: uids}, func(tl timeline.Backend) error {
+		return tl.MarkRead(ctx, uids)
+	})
+}
+
+func (b *memoryBackend) MarkReadUntil(ctx context.Context, channel string, lastReadEntry string) error {
+	return b.markItems(ctx, channel, "mark read", markItemsMessage{Channel: channel, LastReadEntry: lastReadEntry}, func(tl timeline.Backend) error {
+		return tl.MarkReadUntil(ctx, lastReadEntry)
+	})
+}
+
+func (b *memoryBackend) MarkUnread(ctx context.Context, channel string, uids []string) error {
+	return b.markItems(ctx, channel, "mark unread", markItemsMessage{Channel: channel, Entries: uids}, func(tl timeline.Backend) error {
+		return tl.MarkUnread(ctx, uids)
+	})
+}
+
+func (b *memoryBackend) Star(ctx context.Context, channel string, uids []string) error {
+	tl, err := b.userTimeline(ctx, channel)
 	if err != nil {
 		return err
 	}
+	return tl.Star(ctx, uids)
+}
+
+func (b *memoryBackend) Unstar(ctx context.Context, channel string, uids []string) error {
+	tl, err := b.userTimeline(ctx, channel)
+	if err != nil {
+		return err
+	}
+	return tl.Unstar(ctx, uids)
+}
 
-	if err = tl.MarkRead(uids); err != nil {
+// markItems changes the read state of items in the channel with mark, and
+// notifies the clients about the change. For the global channel, the unread
+// counts of the channels of the items are updated.
+func (b *memoryBackend) markItems(ctx context.Context, channel, event string, msg markItemsMessage, mark func(tl timeline.Backend) error) error {
+	tl, err := b.userTimeline(ctx, channel)
+	if err != nil {
 		return err
 	}
 
-	if err = b.updateChannelUnreadCount(channel); err != nil {
+	if err = mark(tl); err != nil {
 		return err
 	}
 
+	channels := []string{channel}
+	if channel == timeline.GlobalChannel {
+		userID, _ := userid.FromContext(ctx)
+		channels, err = b.itemChannels(ctx, userID, tl, msg.Entries)
+		if err != nil {
+			return err
+		}
+		b.notifyUser(userID, event, msg)
+	} else {
+		b.notifyChannel(ctx, channel, event, msg)
+	}
+
+	for _, c := range channels {
+		if err = b.updateChannelUnreadCount(ctx, c); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (b *memoryBackend) Events(ctx context.Context) (chan sse.Message, error) {
-	return sse.StartConnection(b.broker)
+// itemChannels returns the channels of the user that contain the items, or
+// all channels of the user when uids is empty. The items of channels that
+// are not in the database are found in the global timeline tl.
+func (b *memoryBackend) itemChannels(ctx context.Context, userID int, tl timeline.Backend, uids []string) ([]string, error) {
+	query := `SELECT "uid" FROM "channels" WHERE "user_id" = $1`
+	args := []interface{}{userID}
+	if len(uids) > 0 {
+		query = `
+SELECT DISTINCT "c"."uid"
+FROM "items" AS "i"
+INNER JOIN "channels" AS "c" ON "c"."id" = "i"."channel_id"
+WHERE "c"."user_id" = $1 AND "i"."uid" = ANY($2)
+`
+		args = append(args, pq.Array(uids))
+	}
+
+	rows, err := b.database.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []string
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var uid string
+		if err = rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		channels = append(channels, uid)
+		seen[uid] = true
+	}
+	if err = rows.Err(); err != nil || len(uids) == 0 {
+		return channels, err
+	}
+
+	items, err := tl.ItemsByUID(ctx, uids)
+	if errors.Is(err, microsub.ErrNotFound) {
+		return channels, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Channel != "" && !seen[item.Channel] {
+			channels = append(channels, item.Channel)
+			seen[item.Channel] = true
+		}
+	}
+	return channels, nil
 }
 
-// ProcessSourcedItems processes items and adds the Source
-func ProcessSourcedItems(fetcher fetch.Fetcher, fetchURL, contentType string, body io.Reader) ([]microsub.Item, error) {
-	// When the source is available from the Header, we fill the Source of the item
+func (b *memoryBackend) RemoveItems(ctx context.Context, channel string, uids []string) error {
+	if channel == timeline.GlobalChannel {
+		return fmt.Errorf("items can't be removed from the %s channel: %w", channel, microsub.ErrInvalidRequest)
+	}
 
-	bodyBytes, err := ioutil.ReadAll(body)
+	tl, err := b.userTimeline(ctx, channel)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var source *microsub.Source
-	if header, err := fetch.FeedHeader(fetcher, fetchURL, contentType, bytes.NewBuffer(bodyBytes)); err == nil {
-		source = &microsub.Source{
-			ID:    header.URL,
-			URL:   header.URL,
-			Name:  header.Name,
-			Photo: header.Photo,
+	if err = tl.RemoveItems(ctx, uids); err != nil {
+		return err
+	}
+
+	for _, uid := range uids {
+		err = removeFromSearch(channel, uid)
+		if err != nil {
+			log.Printf("could not remove item %s from search: %s", uid, err)
 		}
-	} else {
-		source = &microsub.Source{
-			ID:  fetchURL,
-			URL: fetchURL,
+	}
+	if err = b.removeItemURLs(ctx, channel, uids); err != nil {
+		log.Printf("could not remove urls of items from channel %s: %s", channel, err)
+	}
+
+	b.notifyChannel(ctx, channel, "remove items", removeItemsMessage{channel, uids})
+
+	if err = b.updateChannelUnreadCount(ctx, channel); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *memoryBackend) Events(ctx context.Context, lastEventID string) (chan sse.Message, error) {
+	userID, _ := userid.FromContext(ctx)
+	var lastID int64
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Last-Event-ID %q: %w", lastEventID, microsub.ErrInvalidRequest)
 		}
+		lastID = id
+	}
+	return sse.StartConnection(b.broker, userID, lastID)
+}
+
+// notifyUser sends an event to the connections of the user
+func (b *memoryBackend) notifyUser(userID int, event string, object interface{}) {
+	b.broker.Notifier <- sse.Message{UserID: userID, Event: event, Object: object}
+}
+
+// notifyChannel sends an event to the connections of the user that owns the channel
+func (b *memoryBackend) notifyChannel(ctx context.Context, channel, event string, object interface{}) {
+	var userID int
+	err := b.database.QueryRowContext(ctx, `SELECT "user_id" FROM "channels" WHERE "uid" = $1`, channel).Scan(&userID)
+	if err != nil {
+		log.Printf("could not find user of channel %s for event %q: %v", channel, event, err)
+		return
 	}
+	b.notifyUser(userID, event, object)
+}
 
-	items, err := fetch.FeedItems(fetcher, fetchURL, contentType, bytes.NewBuffer(bodyBytes))
+// ProcessSourcedItems processes items and adds the Source
+func ProcessSourcedItems(ctx context.Context, fetcher fetch.Fetcher, fetchURL, contentType string, body io.Reader) ([]microsub.Item, error) {
+	header, items, err := processSourcedFeed(ctx, fetcher, fetchURL, contentType, body)
 	if err != nil {
 		return nil, err
 	}
 
+	setItemsSource(items, sourceFromHeader(fetchURL, header))
+
+	return items, nil
+}
+
+// processSourcedFeed returns the header and the items of a feed. The header
+// is empty when it could not be found.
+func processSourcedFeed(ctx context.Context, fetcher fetch.Fetcher, fetchURL, contentType string, body io.Reader) (microsub.Feed, []microsub.Item, error) {
+	bodyBytes, err := ioutil.ReadAll(body)
+	if err != nil {
+		return microsub.Feed{}, nil, err
+	}
+
+	header, err := fetch.FeedHeader(ctx, fetcher, fetchURL, contentType, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		header = microsub.Feed{}
+	}
+
+	items, err := fetch.FeedItems(ctx, fetcher, fetchURL, contentType, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return header, nil, err
+	}
+
+	return header, items, nil
+}
+
+// sourceFromHeader returns the Source for items from the header of the feed
+func sourceFromHeader(fetchURL string, header microsub.Feed) *microsub.Source {
+	// When the source is available from the Header, we fill the Source of the item
+	if header.URL == "" {
+		return &microsub.Source{
+			ID:    fetchURL,
+			URL:   fetchURL,
+			Name:  header.Name,
+			Photo: header.Photo,
+		}
+	}
+	return &microsub.Source{
+		ID:    header.URL,
+		URL:   header.URL,
+		Name:  header.Name,
+		Photo: header.Photo,
+	}
+}
+
+func setItemsSource(items []microsub.Item, source *microsub.Source) {
 	for i, item := range items {
 		item.Read = false
 		item.Source = source
 		items[i] = item
 	}
-
-	return items, nil
 }
 
 // ContentProcessor processes content for a channel and feed
 type ContentProcessor interface {
-	ProcessContent(channel, feedID, fetchURL, contentType string, body io.Reader) (bool, error)
+	ProcessContent(ctx context.Context, channel, feedID, fetchURL, contentType string, body io.Reader) (bool, error)
 }
 
 // ProcessContent processes content of a feed, returns if the feed has changed or not
-func (b *memoryBackend) ProcessContent(channel, feedID, fetchURL, contentType string, body io.Reader) (bool, error) {
+func (b *memoryBackend) ProcessContent(ctx context.Context, channel, feedID, fetchURL, contentType string, body io.Reader) (bool, error) {
 	cachingFetch := WithCaching(b.pool, fetch.FetcherFunc(Fetch2))
 
-	items, err := ProcessSourcedItems(cachingFetch, fetchURL, contentType, body)
+	header, items, err := processSourcedFeed(ctx, cachingFetch, fetchURL, contentType, body)
 	if err != nil {
 		return false, err
 	}
 
+	if header.Type != "" {
+		if err := b.updateFeedHeader(ctx, feedID, header); err != nil {
+			log.Printf("could not update header of feed %s: %v", feedID, err)
+		}
+	} else if stored, err := b.feedHeader(ctx, feedID); err == nil {
+		header = stored
+	}
+
+	source := sourceFromHeader(fetchURL, header)
+	source.ID = feedID
+	setItemsSource(items, source)
+
 	changed := false
 
 	for _, item := range items {
-		item.Source.ID = feedID
-		added, err := b.channelAddItemWithMatcher(channel, item)
+		added, err := b.channelAddItemWithMatcher(ctx, channel, item)
 		if err != nil {
 			log.Printf("ERROR: (feedID=%s) %s\n", feedID, err)
 		}
 		changed = changed || added
 	}
 
-	err = b.updateChannelUnreadCount(channel)
+	err = b.updateChannelUnreadCount(ctx, channel)
 	if err != nil {
 		return changed, err
 	}
@@ -747,7 +1553,7 @@ func (b *memoryBackend) Fetch3(ctx context.Context, channel, fetchURL string) (*
 	return Fetch2(ctx, fetchURL)
 }
 
-func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.Item) (bool, error) {
+func (b *memoryBackend) channelAddItemWithMatcher(ctx context.Context, channel string, item microsub.Item) (bool, error) {
 	// an item is posted
 	// check for all channels as channel
 	// if regex matches item
@@ -766,7 +1572,7 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 	//
 	// 		if matchItem(item, re) {
 	// 			log.Printf("Included %#v\n", item)
-	// 			added, err := b.channelAddItem(channelKey, item)
+	// 			added, err := b.channelAddItem(ctx, channelKey, item)
 	// 			if err != nil {
 	// 				continue
 	// 			}
@@ -785,15 +1591,26 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 
 	// Update all channels that have added items, because the include_regex matches
 	for _, value := range updatedChannels {
-		err := b.updateChannelUnreadCount(value)
+		err := b.updateChannelUnreadCount(ctx, value)
 		if err != nil {
 			log.Printf("error while updating unread count for %s: %s", value, err)
 			continue
 		}
 	}
 
+	// Skip items from blocked and muted authors
+	for _, table := range []string{blocksTable, mutesTable} {
+		urls, err := b.channelAuthorURLs(ctx, table, channel)
+		if err != nil {
+			return false, fmt.Errorf("channelAuthorURLs in channelAddItemWithMatcher: %v", err)
+		}
+		if urls[itemAuthorURL(item)] {
+			return false, nil
+		}
+	}
+
 	// Check for the exclude regex
-	setting, _ := b.loadSetting(channel)
+	setting, _ := b.loadSetting(ctx, channel)
 
 	if len(setting.ExcludeType) > 0 {
 		for _, v := range setting.ExcludeType {
@@ -834,7 +1651,21 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 		}
 	}
 
-	added, err := b.channelAddItem(channel, item)
+	tl, err := b.getTimeline(ctx, channel)
+	if err != nil {
+		return false, err
+	}
+
+	// The same post from another feed is merged into the stored item
+	merged, err := b.mergeDuplicate(ctx, tl, channel, &item)
+	if err != nil {
+		return false, fmt.Errorf("mergeDuplicate in channelAddItemWithMatcher: %v", err)
+	}
+	if merged {
+		return false, nil
+	}
+
+	added, err := b.channelAddItem(ctx, channel, item)
 
 	if err != nil {
 		return added, err
@@ -874,38 +1705,54 @@ func matchItemText(item microsub.Item, re *regexp.Regexp) bool {
 	return re.MatchString(item.Name)
 }
 
-func (b *memoryBackend) channelAddItem(channel string, item microsub.Item) (bool, error) {
-	timelineBackend, err := b.getTimeline(channel)
+// channelAddItem adds the item to the channel, or updates the stored item when
+// its content changed. Returns true when the item was added or updated.
+func (b *memoryBackend) channelAddItem(ctx context.Context, channel string, item microsub.Item) (bool, error) {
+	timelineBackend, err := b.getTimeline(ctx, channel)
 	if err != nil {
 		return false, err
 	}
 
-	added, err := timelineBackend.AddItem(item)
+	added, err := timelineBackend.AddItem(ctx, item)
 	if err != nil {
 		return added, err
 	}
 
 	// Sent message to Server-Sent-Events
 	if added {
-		b.broker.Notifier <- sse.Message{Event: "new item", Object: newItemMessage{item, channel}}
+		b.notifyChannel(ctx, channel, "new item", newItemMessage{item, channel})
+		return added, nil
+	}
+
+	setting, _ := b.loadSetting(ctx, channel)
+	return b.channelUpdateItem(ctx, timelineBackend, channel, item, setting.MarkUnreadOnUpdate)
+}
+
+// channelUpdateItem updates the stored item when its content changed. Returns
+// true when the item was updated.
+func (b *memoryBackend) channelUpdateItem(ctx context.Context, tl timeline.Backend, channel string, item microsub.Item, markUnread bool) (bool, error) {
+	updated, err := tl.UpdateItem(ctx, item, markUnread)
+	if err != nil {
+		return false, err
+	}
+
+	if updated {
+		b.notifyChannel(ctx, channel, "item updated", newItemMessage{item, channel})
 	}
 
-	return added, err
+	return updated, nil
 }
 
 // ErrNotUpdated is used when the unread count is not updated
 var ErrNotUpdated = errors.New("timeline unread count not updated")
 
-// ErrNotFound is used when the timeline is not found
-var ErrNotFound = errors.New("timeline not found")
-
-func (b *memoryBackend) updateChannelUnreadCount(channel string) error {
-	tl, err := b.getTimeline(channel)
+func (b *memoryBackend) updateChannelUnreadCount(ctx context.Context, channel string) error {
+	tl, err := b.getTimeline(ctx, channel)
 	if err != nil {
 		return err
 	}
 
-	unread, err := tl.Count()
+	unread, err := b.channelUnreadCount(ctx, channel, tl)
 	if err != nil {
 		return ErrNotUpdated
 	}
@@ -916,11 +1763,41 @@ func (b *memoryBackend) updateChannelUnreadCount(channel string) error {
 	}
 
 	// Sent message to Server-Sent-Events
-	b.broker.Notifier <- sse.Message{Event: "new item in channel", Object: c}
+	b.notifyChannel(ctx, channel, "new item in channel", c)
 
 	return nil
 }
 
+// channelUnreadCount counts the unread items in the channel that are not muted
+func (b *memoryBackend) channelUnreadCount(ctx context.Context, channel string, tl timeline.Backend) (int, error) {
+	muted, err := b.channelAuthorURLs(ctx, mutesTable, channel)
+	if err != nil {
+		return 0, err
+	}
+	if len(muted) == 0 {
+		return tl.Count(ctx)
+	}
+
+	isRead := false
+	options := microsub.TimelineOptions{IsRead: &isRead, Limit: timeline.MaxLimit}
+	unread := 0
+	for {
+		page, err := tl.Items(ctx, options)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range page.Items {
+			if !muted[itemAuthorURL(item)] {
+				unread++
+			}
+		}
+		if len(page.Items) == 0 || page.Paging.After == "" {
+			return unread, nil
+		}
+		options.After = page.Paging.After
+	}
+}
+
 // WithCaching adds caching to a fetch.Fetcher
 func WithCaching(pool *redis.Pool, ff fetch.Fetcher) fetch.Fetcher {
 	ff2 := (func(ctx context.Context, fetchURL string) (*http.Response, error) {
@@ -976,6 +1853,12 @@ var ErrBlackList = errors.New("Blacklisted URL")
 
 // Fetch2 fetches stuff
 func Fetch2(ctx context.Context, fetchURL string) (*http.Response, error) {
+	return FetchIfModified(ctx, fetchURL, "", "")
+}
+
+// FetchIfModified fetches fetchURL with a conditional request when etag or
+// lastModified are set. An unchanged feed returns a 304 Not Modified response.
+func FetchIfModified(ctx context.Context, fetchURL, etag, lastModified string) (*http.Response, error) {
 	if !strings.HasPrefix(fetchURL, "http") {
 		return nil, fmt.Errorf("error parsing %s as url, has no http(s) prefix", fetchURL)
 	}
@@ -994,10 +1877,16 @@ func Fetch2(ctx context.Context, fetchURL string) (*http.Response, error) {
 		return nil, ErrBlackList
 	}
 
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
 
 	client := http.Client{}
 	resp, err := client.Do(req)
@@ -1008,8 +1897,8 @@ func Fetch2(ctx context.Context, fetchURL string) (*http.Response, error) {
 	return resp, err
 }
 
-func (b *memoryBackend) loadSetting(uid string) (channelSetting, error) {
-	row := b.database.QueryRow(`SELECT "id" FROM "channels" WHERE "uid" = $1`, uid)
+func (b *memoryBackend) loadSetting(ctx context.Context, uid string) (channelSetting, error) {
+	row := b.database.QueryRowContext(ctx, `SELECT "id" FROM "channels" WHERE "uid" = $1`, uid)
 	var channelID int
 	err := row.Scan(&channelID)
 	if err != nil {
@@ -1019,7 +1908,7 @@ func (b *memoryBackend) loadSetting(uid string) (channelSetting, error) {
 	var settingsID int
 	var setting channelSetting
 
-	row = b.database.QueryRow(`SELECT "id", "settings" FROM "channel_settings" WHERE "channel_id" = $1`, channelID)
+	row = b.database.QueryRowContext(ctx, `SELECT "id", "settings" FROM "channel_settings" WHERE "channel_id" = $1`, channelID)
 
 	err = row.Scan(&settingsID, &setting)
 	if err == sql.ErrNoRows {
@@ -1032,15 +1921,15 @@ func (b *memoryBackend) loadSetting(uid string) (channelSetting, error) {
 	return setting, nil
 }
 
-func (b *memoryBackend) saveSetting(uid string, setting channelSetting) error {
-	row := b.database.QueryRow(`SELECT "id" FROM "channels" WHERE "uid" = $1`, uid)
+func (b *memoryBackend) saveSetting(ctx context.Context, uid string, setting channelSetting) error {
+	row := b.database.QueryRowContext(ctx, `SELECT "id" FROM "channels" WHERE "uid" = $1`, uid)
 	var channelID int
 	err := row.Scan(&channelID)
 	if err != nil {
 		return err
 	}
 
-	_, err = b.database.Exec(`
+	_, err = b.database.ExecContext(ctx, `
 INSERT INTO "channel_settings" (channel_id, settings, created_at)
 VALUES ($1, $2, now())
 ON CONFLICT (channel_id) DO UPDATE
@@ -1051,16 +1940,98 @@ ON CONFLICT (channel_id) DO UPDATE
 	return err
 }
 
-func (b *memoryBackend) getTimeline(channel string) (timeline.Backend, error) {
-	// Set a default timeline type if not set
-	timelineType := "postgres-stream"
-	tl := timeline.Create(channel, timelineType, b.pool, b.database)
+// userTimeline returns the timeline of the channel of the user from the
+// context, or the timeline with the items of all channels of the user for
+// the global channel. Channels of other users are not found.
+func (b *memoryBackend) userTimeline(ctx context.Context, channel string) (timeline.Backend, error) {
+	userID, _ := userid.FromContext(ctx)
+	var tl timeline.Backend
+	if channel == timeline.GlobalChannel {
+		channels, err := b.channelTimelines(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		tl = timeline.CreateGlobal(ctx, userID, b.database, channels)
+	} else {
+		tl = timeline.CreateForUser(ctx, userID, channel, b.channelType(ctx, channel), b.pool, b.database)
+	}
 	if tl == nil {
-		return tl, fmt.Errorf("timeline id %q: %w", channel, ErrNotFound)
+		return nil, fmt.Errorf("timeline id %q: %w", channel, microsub.ErrNotFound)
 	}
 	return tl, nil
 }
 
+// channelTimelines returns the timelines of the channels of the user that
+// are not of the timeline.DefaultType, by uid
+func (b *memoryBackend) channelTimelines(ctx context.Context, userID int) (map[string]timeline.Backend, error) {
+	rows, err := b.database.QueryContext(ctx, `
+SELECT "c"."uid", "s"."settings"
+FROM "channels" AS "c"
+INNER JOIN "channel_settings" AS "s" ON "s"."channel_id" = "c"."id"
+WHERE "c"."user_id" = $1
+`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]string)
+	for rows.Next() {
+		var uid string
+		var setting channelSetting
+		if err = rows.Scan(&uid, &setting); err != nil {
+			return nil, err
+		}
+		if setting.ChannelType != "" && setting.ChannelType != timeline.DefaultType {
+			types[uid] = setting.ChannelType
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	timelines := make(map[string]timeline.Backend)
+	for uid, channelType := range types {
+		tl := timeline.CreateForUser(ctx, userID, uid, channelType, b.pool, b.database)
+		if tl == nil {
+			return nil, fmt.Errorf("timeline id %q: %w", uid, microsub.ErrNotFound)
+		}
+		timelines[uid] = tl
+	}
+	return timelines, nil
+}
+
+func (b *memoryBackend) getTimeline(ctx context.Context, channel string) (timeline.Backend, error) {
+	tl := timeline.Create(ctx, channel, b.channelType(ctx, channel), b.pool, b.database)
+	if tl == nil {
+		return tl, fmt.Errorf("timeline id %q: %w", channel, microsub.ErrNotFound)
+	}
+	return tl, nil
+}
+
+// channelHasItems returns true when the timeline of the channel has items
+func (b *memoryBackend) channelHasItems(ctx context.Context, channel string) (bool, error) {
+	tl, err := b.getTimeline(ctx, channel)
+	if err != nil {
+		return false, err
+	}
+	n, err := tl.Len(ctx)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// channelType returns the timeline type from the settings of the channel, or
+// timeline.DefaultType when it's not set
+func (b *memoryBackend) channelType(ctx context.Context, channel string) string {
+	setting, err := b.loadSetting(ctx, channel)
+	if err != nil || setting.ChannelType == "" {
+		return timeline.DefaultType
+	}
+	return setting.ChannelType
+}
+
 // Scan helps to scan json data from database
 func (item *channelSetting) Scan(value interface{}) error {
 	b, ok := value.([]byte)
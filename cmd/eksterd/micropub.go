@@ -105,12 +105,12 @@ func (h *micropubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Name: fmt.Sprintf("Source %d", sourceID),
 		}
 
-		_, err = h.Backend.channelAddItemWithMatcher(channel, *item)
+		_, err = h.Backend.channelAddItemWithMatcher(r.Context(), channel, *item)
 		if err != nil {
 			log.Printf("could not add item to channel %s: %v", channel, err)
 		}
 
-		err = h.Backend.updateChannelUnreadCount(channel)
+		err = h.Backend.updateChannelUnreadCount(r.Context(), channel)
 		if err != nil {
 			log.Printf("could not update channel unread content %s: %v", channel, err)
 		}
@@ -175,7 +175,7 @@ func getChannelFromAuthorization(r *http.Request, conn redis.Conn, database *sql
 	// backward compatible
 	sourceID := r.URL.Query().Get("source_id")
 	if sourceID != "" {
-		row := database.QueryRow(`
+		row := database.QueryRowContext(r.Context(), `
 SELECT s.id as source_id, c.uid
 FROM "sources" AS "s"
 INNER JOIN "channels" AS "c" ON s.channel_id = c.id
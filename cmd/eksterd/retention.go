@@ -0,0 +1,218 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/timeline"
+	"github.com/pstuifzand/ekster/pkg/userid"
+)
+
+// DefaultPruneInterval is the time between two runs of the pruner
+const DefaultPruneInterval = 1 * time.Hour
+
+// pruneBatchSize is the maximum number of items that is removed at once
+const pruneBatchSize = 100
+
+// notificationsRetention is used for the notifications channel when it
+// doesn't have a retention policy, otherwise fetch errors are kept forever
+var notificationsRetention = timeline.Retention{MaxAge: 30 * 24 * time.Hour}
+
+// retentionPreviewLimit is the maximum number of items that RetentionGet returns
+const retentionPreviewLimit = timeline.MaxLimit
+
+// channelRetention returns the retention policy of the channel, the
+// notifications channel uses notificationsRetention when it has no policy
+func channelRetention(channel string, setting channelSetting) timeline.Retention {
+	if channel == "notifications" && !setting.Retention.Enabled() {
+		return notificationsRetention
+	}
+	return setting.Retention
+}
+
+// runPruner prunes the channels every interval until ctx is canceled
+func (b *memoryBackend) runPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.pruneChannels(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneChannels removes the expired items of all channels with a retention policy
+func (b *memoryBackend) pruneChannels(ctx context.Context) {
+	log.Println("Pruning channels started")
+	defer log.Println("Pruning channels completed")
+
+	policies, err := b.retentionPolicies(ctx)
+	if err != nil {
+		log.Printf("could not load retention policies: %v", err)
+		return
+	}
+
+	for channel, policy := range policies {
+		removed, err := b.pruneChannel(ctx, channel, policy)
+		if err != nil {
+			log.Printf("could not prune channel %s: %v", channel, err)
+		}
+		if removed > 0 {
+			log.Printf("Pruned %d items from channel %s", removed, channel)
+		}
+	}
+}
+
+// retentionPolicies returns the retention policies of the channels that have one
+func (b *memoryBackend) retentionPolicies(ctx context.Context) (map[string]timeline.Retention, error) {
+	rows, err := b.database.QueryContext(ctx, `
+SELECT "c"."uid", "s"."settings"
+FROM "channels" AS "c"
+INNER JOIN "channel_settings" AS "s" ON "s"."channel_id" = "c"."id"
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := map[string]timeline.Retention{
+		"notifications": notificationsRetention,
+	}
+	for rows.Next() {
+		var uid string
+		var setting channelSetting
+		if err := rows.Scan(&uid, &setting); err != nil {
+			return nil, err
+		}
+		if policy := channelRetention(uid, setting); policy.Enabled() {
+			policies[uid] = policy
+		}
+	}
+	return policies, rows.Err()
+}
+
+// pruneChannel removes the items of the channel that the policy removes, in
+// batches of pruneBatchSize. It returns the number of removed items.
+func (b *memoryBackend) pruneChannel(ctx context.Context, channel string, policy timeline.Retention) (int, error) {
+	tl, err := b.getTimeline(ctx, channel)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	removed := 0
+	for {
+		uids, err := timeline.Expired(ctx, tl, policy, now, pruneBatchSize)
+		if err != nil {
+			return removed, fmt.Errorf("while finding expired items: %w", err)
+		}
+		if len(uids) == 0 {
+			break
+		}
+
+		if err := tl.RemoveItems(ctx, uids); err != nil {
+			return removed, err
+		}
+		for _, uid := range uids {
+			if err := removeFromSearch(channel, uid); err != nil {
+				log.Printf("could not remove item %s from search: %s", uid, err)
+			}
+		}
+		if err := b.removeItemURLs(ctx, channel, uids); err != nil {
+			log.Printf("could not remove urls of items from channel %s: %s", channel, err)
+		}
+		b.notifyChannel(ctx, channel, "remove items", removeItemsMessage{channel, uids})
+
+		removed += len(uids)
+		varMicrosub.Add("PrunedItems", int64(len(uids)))
+
+		if len(uids) < pruneBatchSize {
+			break
+		}
+	}
+
+	if removed > 0 {
+		if err := b.updateChannelUnreadCount(ctx, channel); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// RetentionGet returns the retention policy of the channel and the items that
+// the pruner would remove now. Muted items are included, because the pruner
+// removes them too.
+func (b *memoryBackend) RetentionGet(ctx context.Context, channel string) (microsub.Retention, error) {
+	if channel == timeline.GlobalChannel {
+		return microsub.Retention{}, fmt.Errorf("channel %q has no retention policy: %w", channel, microsub.ErrInvalidRequest)
+	}
+
+	userID, _ := userid.FromContext(ctx)
+	if _, err := b.userChannelID(ctx, userID, channel); err != nil {
+		return microsub.Retention{}, err
+	}
+
+	tl, err := b.userTimeline(ctx, channel)
+	if err != nil {
+		return microsub.Retention{}, err
+	}
+
+	setting, err := b.loadSetting(ctx, channel)
+	if err != nil {
+		return microsub.Retention{}, err
+	}
+	policy := channelRetention(channel, setting)
+
+	uids, err := timeline.Expired(ctx, tl, policy, time.Now(), math.MaxInt32)
+	if err != nil {
+		return microsub.Retention{}, fmt.Errorf("while finding expired items: %w", err)
+	}
+
+	retention := microsub.Retention{
+		Policy: microsub.RetentionPolicy{
+			MaxAgeDays:  int(policy.MaxAge / (24 * time.Hour)),
+			MaxItems:    policy.MaxItems,
+			KeepUnread:  policy.KeepUnread,
+			KeepStarred: policy.KeepStarred,
+		},
+		Count: len(uids),
+		Items: []microsub.Item{},
+	}
+	if len(uids) > retentionPreviewLimit {
+		uids = uids[:retentionPreviewLimit]
+	}
+	if len(uids) > 0 {
+		items, err := tl.ItemsByUID(ctx, uids)
+		if err != nil {
+			return microsub.Retention{}, err
+		}
+		retention.Items = items
+	}
+	return retention, nil
+}
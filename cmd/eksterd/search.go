@@ -19,15 +19,26 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/lib/pq"
 	"github.com/pstuifzand/ekster/pkg/microsub"
 )
 
 var index bleve.Index
 
+// searchVersionKey is the internal key of the version of the search index
+var searchVersionKey = []byte("ekster:search_version")
+
+// searchVersion 2 contains the channel in the id of the items
+const searchVersion = "2"
+
 func initSearch() error {
 	if _, err := os.Stat("items.bleve"); os.IsNotExist(err) {
 		mapping := bleve.NewIndexMapping()
@@ -35,14 +46,95 @@ func initSearch() error {
 		if err != nil {
 			return err
 		}
-	} else {
-		index, err = bleve.Open("items.bleve")
+		return index.SetInternal(searchVersionKey, []byte(searchVersion))
+	}
+
+	var err error
+	index, err = bleve.Open("items.bleve")
+	if err != nil {
+		return fmt.Errorf("while opening search index: %v", err)
+	}
+	return nil
+}
+
+// migrateSearch indexes the items again, that were indexed with only their uid,
+// before the same item could be in more channels. The old entries are removed
+// and the items in the database are indexed with the channel in their id. It
+// runs once, the index remembers its version.
+func migrateSearch(ctx context.Context, db *sql.DB) error {
+	if index == nil {
+		return nil
+	}
+	version, err := index.GetInternal(searchVersionKey)
+	if err != nil {
+		return fmt.Errorf("while reading search version: %v", err)
+	}
+	if string(version) == searchVersion {
+		return nil
+	}
+
+	log.Println("Migrating search index")
+
+	var oldIDs []string
+	const pageSize = 1000
+	for from := 0; ; from += pageSize {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), pageSize, from, false)
+		res, err := index.SearchInContext(ctx, req)
 		if err != nil {
-			return fmt.Errorf("while opening search index: %v", err)
+			return fmt.Errorf("while listing search index: %v", err)
+		}
+		for _, hit := range res.Hits {
+			if !strings.Contains(hit.ID, ":") {
+				oldIDs = append(oldIDs, hit.ID)
+			}
+		}
+		if len(res.Hits) < pageSize {
+			break
 		}
-		return nil
 	}
-	return nil
+
+	batch := index.NewBatch()
+	for _, id := range oldIDs {
+		batch.Delete(id)
+	}
+	if err := index.Batch(batch); err != nil {
+		return fmt.Errorf("while removing old search entries: %v", err)
+	}
+
+	if len(oldIDs) > 0 {
+		rows, err := db.QueryContext(ctx, `
+SELECT "c"."uid", "i"."uid", "i"."data"
+FROM "items" AS "i"
+INNER JOIN "channels" AS "c" ON "c"."id" = "i"."channel_id"
+WHERE "i"."uid" = ANY($1)
+`, pq.Array(oldIDs))
+		if err != nil {
+			return fmt.Errorf("while reading items for search index: %v", err)
+		}
+		defer rows.Close()
+
+		batch = index.NewBatch()
+		for rows.Next() {
+			var channel, uid string
+			var item microsub.Item
+			if err := rows.Scan(&channel, &uid, &item); err != nil {
+				return fmt.Errorf("while reading items for search index: %v", err)
+			}
+			item.ID = uid
+			if err := batch.Index(searchID(channel, uid), indexItem{item, channel}); err != nil {
+				return fmt.Errorf("while indexing item: %v", err)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("while reading items for search index: %v", err)
+		}
+		if err := index.Batch(batch); err != nil {
+			return fmt.Errorf("while indexing items: %v", err)
+		}
+	}
+
+	log.Printf("Migrated %d entries of the search index", len(oldIDs))
+	return index.SetInternal(searchVersionKey, []byte(searchVersion))
 }
 
 type indexItem struct {
@@ -50,10 +142,16 @@ type indexItem struct {
 	Channel string `json:"channel"`
 }
 
+// searchID returns the id of the item in the search index. The same item can
+// be in more channels, so the id contains the channel.
+func searchID(channel, uid string) string {
+	return channel + ":" + uid
+}
+
 func addToSearch(item microsub.Item, channel string) error {
 	if index != nil {
 		indexItem := indexItem{item, channel}
-		err := index.Index(item.ID, indexItem)
+		err := index.Index(searchID(channel, item.ID), indexItem)
 		if err != nil {
 			return fmt.Errorf("while indexing item: %v", err)
 		}
@@ -61,6 +159,16 @@ func addToSearch(item microsub.Item, channel string) error {
 	return nil
 }
 
+func removeFromSearch(channel, uid string) error {
+	if index != nil {
+		err := index.Delete(searchID(channel, uid))
+		if err != nil {
+			return fmt.Errorf("while removing item from index: %v", err)
+		}
+	}
+	return nil
+}
+
 func getStringArray(fields map[string]interface{}, key string) []string {
 	if value, e := fields[key]; e {
 		if str, ok := value.([]string); ok {
@@ -101,7 +209,11 @@ func querySearch(channel, query string) ([]string, error) {
 	hits := res.Hits
 	var ids []string
 	for _, hit := range hits {
+		// Items that were indexed before the channel was part of the id, only have the uid
 		itemIDStr := hit.ID
+		if i := strings.Index(itemIDStr, ":"); i >= 0 {
+			itemIDStr = itemIDStr[i+1:]
+		}
 		ids = append(ids, itemIDStr)
 	}
 
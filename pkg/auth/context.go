@@ -0,0 +1,48 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+type key int
+
+const tokenKey key = 0
+
+// NewContext creates a new context with the token as a value
+func NewContext(ctx context.Context, token TokenResponse) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// FromContext retrieves the token from the context
+func FromContext(ctx context.Context) (TokenResponse, bool) {
+	token, ok := ctx.Value(tokenKey).(TokenResponse)
+	return token, ok
+}
+
+// HasScope returns true when scope is one of the space separated scopes of the token
+func (r TokenResponse) HasScope(scope string) bool {
+	for _, s := range strings.Fields(r.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
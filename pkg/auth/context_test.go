@@ -0,0 +1,47 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenResponse_HasScope(t *testing.T) {
+	token := TokenResponse{Scope: "read  follow channels"}
+	assert.True(t, token.HasScope("read"))
+	assert.True(t, token.HasScope("follow"))
+	assert.True(t, token.HasScope("channels"))
+	assert.False(t, token.HasScope("mute"))
+	assert.False(t, token.HasScope(""))
+	assert.False(t, TokenResponse{}.HasScope("read"))
+}
+
+func TestContext(t *testing.T) {
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := NewContext(context.Background(), TokenResponse{Me: "https://example.com/", Scope: "read"})
+	token, ok := FromContext(ctx)
+	if assert.True(t, ok) {
+		assert.Equal(t, "https://example.com/", token.Me)
+		assert.Equal(t, "read", token.Scope)
+	}
+}
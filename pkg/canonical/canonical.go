@@ -0,0 +1,88 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package canonical normalizes URLs, so the same post can be recognized when
+// it's linked with different URLs.
+package canonical
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// trackingParams are query parameters that are removed, because they don't
+// change the page
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"yclid":   true,
+	"igshid":  true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_hsenc":  true,
+	"_hsmi":   true,
+	"ref_src": true,
+	"ref_url": true,
+}
+
+// URL returns the canonical form of rawURL. It is used to compare URLs, it
+// isn't always a URL that can be fetched.
+//
+// The scheme is https, the host is lower case without "www." and the default
+// port, the fragment and tracking parameters like utm_source are removed, the
+// other query parameters are sorted and trailing slashes are removed.
+func URL(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("not a http url: %q", rawURL)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("url without host: %q", rawURL)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	query := u.Query()
+	for key := range query {
+		if strings.HasPrefix(key, "utm_") || trackingParams[key] {
+			query.Del(key)
+		}
+	}
+
+	canonical := url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     strings.TrimRight(u.Path, "/"),
+		RawQuery: query.Encode(),
+	}
+	if canonical.Path == "" {
+		canonical.Path = "/"
+	}
+	return canonical.String(), nil
+}
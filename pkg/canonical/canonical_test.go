@@ -0,0 +1,60 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package canonical_test
+
+import (
+	"testing"
+
+	"github.com/pstuifzand/ekster/pkg/canonical"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   string
+	}{
+		{"https://example.com/post/1", "https://example.com/post/1"},
+		{"http://example.com/post/1", "https://example.com/post/1"},
+		{"HTTPS://WWW.Example.COM/post/1/", "https://example.com/post/1"},
+		{"https://example.com:443/post/1", "https://example.com/post/1"},
+		{"https://example.com:8080/post/1", "https://example.com:8080/post/1"},
+		{"https://example.com", "https://example.com/"},
+		{"https://example.com/post/1#comments", "https://example.com/post/1"},
+		{"https://example.com/post/1?utm_source=rss&utm_medium=feed", "https://example.com/post/1"},
+		{"https://example.com/post/1?fbclid=abc&id=2&page=1", "https://example.com/post/1?id=2&page=1"},
+		{"https://example.com/post/1?page=1&id=2", "https://example.com/post/1?id=2&page=1"},
+		{" https://example.com/Post/1 ", "https://example.com/Post/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rawURL, func(t *testing.T) {
+			got, err := canonical.URL(tt.rawURL)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestURL_NotHTTP(t *testing.T) {
+	for _, rawURL := range []string{"", "1234", "tag:example.com,2022:post-1", "mailto:alice@example.com", "/post/1", "https://"} {
+		_, err := canonical.URL(rawURL)
+		assert.Error(t, err, rawURL)
+	}
+}
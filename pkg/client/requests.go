@@ -19,14 +19,17 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/pstuifzand/ekster/pkg/microsub"
@@ -40,9 +43,19 @@ type Client struct {
 	Token            string
 
 	Logging bool
+
+	// UseJSON sends the arguments of POST requests as a JSON body
+	UseJSON bool
+
+	// UseWebSocket reads events from a WebSocket connection instead of an event stream
+	UseWebSocket bool
 }
 
 func (c *Client) microsubGetRequest(ctx context.Context, action string, args map[string]string) (*http.Response, error) {
+	return c.microsubGetRequestWithHeader(ctx, action, args, nil)
+}
+
+func (c *Client) microsubGetRequestWithHeader(ctx context.Context, action string, args map[string]string, header http.Header) (*http.Response, error) {
 	client := http.Client{}
 
 	u := *c.MicrosubEndpoint
@@ -58,6 +71,9 @@ func (c *Client) microsubGetRequest(ctx context.Context, action string, args map
 		return nil, err
 	}
 
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
 
 	if c.Logging {
@@ -66,32 +82,100 @@ func (c *Client) microsubGetRequest(ctx context.Context, action string, args map
 	}
 
 	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	if c.Logging {
 		x, _ := httputil.DumpResponse(res, true)
 		log.Printf("RESPONSE:\n\n%s\n\n", x)
 	}
 
-	return res, err
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, errorFromResponse(res)
+	}
+
+	return res, nil
 }
 
-func (c *Client) microsubPostRequest(ctx context.Context, action string, args map[string]string) (*http.Response, error) {
-	client := http.Client{}
+// errorFromResponse returns the error from an unsuccessful response. A JSON
+// error body is returned as a *microsub.Error, so errors.Is can be used to
+// check for the errors in pkg/microsub.
+func errorFromResponse(res *http.Response) error {
+	msg, _ := ioutil.ReadAll(res.Body)
+
+	var merr microsub.Error
+	if err := json.Unmarshal(msg, &merr); err == nil && merr.Code != "" {
+		return &merr
+	}
 
+	return fmt.Errorf("unsuccessful response: %d: %q", res.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// newPostRequest creates a POST request for the action. The args are sent in
+// the query and data as a form body, or both as a JSON body when UseJSON is set.
+func (c *Client) newPostRequest(ctx context.Context, action string, args map[string]string, data url.Values) (*http.Request, error) {
 	u := *c.MicrosubEndpoint
 	q := u.Query()
-	q.Add("action", action)
-	for k, v := range args {
-		q.Add(k, v)
+
+	var body io.Reader
+	var contentType string
+
+	if c.UseJSON {
+		values := map[string]interface{}{
+			"action": action,
+		}
+		for k, v := range args {
+			values[k] = v
+		}
+		for k, v := range data {
+			if strings.HasSuffix(k, "[]") {
+				values[strings.TrimSuffix(k, "[]")] = v
+			} else if len(v) == 1 {
+				values[k] = v[0]
+			} else {
+				values[k] = v
+			}
+		}
+		b, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	} else {
+		q.Add("action", action)
+		for k, v := range args {
+			q.Add(k, v)
+		}
+		if data != nil {
+			body = strings.NewReader(data.Encode())
+			contentType = "application/x-www-form-urlencoded"
+		}
 	}
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+
+	return req, nil
+}
+
+func (c *Client) microsubPostRequest(ctx context.Context, action string, args map[string]string) (*http.Response, error) {
+	client := http.Client{}
+
+	req, err := c.newPostRequest(ctx, action, args, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	if c.Logging {
 		x, _ := httputil.DumpRequestOut(req, true)
@@ -99,6 +183,9 @@ func (c *Client) microsubPostRequest(ctx context.Context, action string, args ma
 	}
 
 	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	if c.Logging {
 		x, _ := httputil.DumpResponse(res, true)
@@ -106,8 +193,8 @@ func (c *Client) microsubPostRequest(ctx context.Context, action string, args ma
 	}
 
 	if res.StatusCode != 200 {
-		msg, _ := ioutil.ReadAll(res.Body)
-		return nil, fmt.Errorf("unsuccessful response: %d: %q", res.StatusCode, strings.TrimSpace(string(msg)))
+		defer res.Body.Close()
+		return nil, errorFromResponse(res)
 	}
 
 	return res, err
@@ -116,26 +203,19 @@ func (c *Client) microsubPostRequest(ctx context.Context, action string, args ma
 func (c *Client) microsubPostFormRequest(ctx context.Context, action string, args map[string]string, data url.Values) (*http.Response, error) {
 	client := http.Client{}
 
-	u := *c.MicrosubEndpoint
-	q := u.Query()
-	q.Add("action", action)
-	for k, v := range args {
-		q.Add(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(data.Encode()))
+	req, err := c.newPostRequest(ctx, action, args, data)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
-
 	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	if res.StatusCode != 200 {
-		msg, _ := ioutil.ReadAll(res.Body)
-		return nil, fmt.Errorf("unsuccessful response: %d: %q", res.StatusCode, strings.TrimSpace(string(msg)))
+		defer res.Body.Close()
+		return nil, errorFromResponse(res)
 	}
 
 	return res, err
@@ -149,13 +229,6 @@ func (c *Client) ChannelsGetList(ctx context.Context) ([]microsub.Channel, error
 		return []microsub.Channel{}, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return []microsub.Channel{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return []microsub.Channel{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 
 	type channelsResponse struct {
 		Channels []microsub.Channel `json:"channels"`
@@ -169,23 +242,25 @@ func (c *Client) ChannelsGetList(ctx context.Context) ([]microsub.Channel, error
 }
 
 // TimelineGet gets a timeline from a Microsub server
-func (c *Client) TimelineGet(ctx context.Context, before, after, channel string) (microsub.Timeline, error) {
+func (c *Client) TimelineGet(ctx context.Context, channel string, options microsub.TimelineOptions) (microsub.Timeline, error) {
 	args := make(map[string]string)
-	args["after"] = after
-	args["before"] = before
+	args["after"] = options.After
+	args["before"] = options.Before
 	args["channel"] = channel
+	if options.IsRead != nil {
+		args["is_read"] = strconv.FormatBool(*options.IsRead)
+	}
+	if options.Source != "" {
+		args["source"] = options.Source
+	}
+	if options.Limit > 0 {
+		args["limit"] = strconv.Itoa(options.Limit)
+	}
 	res, err := c.microsubGetRequest(ctx, "timeline", args)
 	if err != nil {
 		return microsub.Timeline{}, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return microsub.Timeline{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return microsub.Timeline{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 	dec := json.NewDecoder(res.Body)
 	var timeline microsub.Timeline
 	err = dec.Decode(&timeline)
@@ -206,13 +281,6 @@ func (c *Client) PreviewURL(ctx context.Context, url string) (microsub.Timeline,
 	defer res.Body.Close()
 
 	var timeline microsub.Timeline
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return timeline, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return timeline, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 	dec := json.NewDecoder(res.Body)
 	err = dec.Decode(&timeline)
 	if err != nil {
@@ -221,22 +289,33 @@ func (c *Client) PreviewURL(ctx context.Context, url string) (microsub.Timeline,
 	return timeline, nil
 }
 
+// RetentionGet gets the retention policy of a channel and the items it would remove.
+func (c *Client) RetentionGet(ctx context.Context, channel string) (microsub.Retention, error) {
+	args := make(map[string]string)
+	args["channel"] = channel
+	res, err := c.microsubGetRequest(ctx, "retention", args)
+	if err != nil {
+		return microsub.Retention{}, err
+	}
+	defer res.Body.Close()
+	var retention microsub.Retention
+	dec := json.NewDecoder(res.Body)
+	err = dec.Decode(&retention)
+	if err != nil {
+		return microsub.Retention{}, err
+	}
+	return retention, nil
+}
+
 // FollowGetList gets the list of followed feeds.
 func (c *Client) FollowGetList(ctx context.Context, channel string) ([]microsub.Feed, error) {
 	args := make(map[string]string)
 	args["channel"] = channel
 	res, err := c.microsubGetRequest(ctx, "follow", args)
 	if err != nil {
-		return []microsub.Feed{}, nil
+		return []microsub.Feed{}, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return []microsub.Feed{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return []microsub.Feed{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 	dec := json.NewDecoder(res.Body)
 	type followResponse struct {
 		Items []microsub.Feed `json:"items"`
@@ -244,7 +323,7 @@ func (c *Client) FollowGetList(ctx context.Context, channel string) ([]microsub.
 	var response followResponse
 	err = dec.Decode(&response)
 	if err != nil {
-		return []microsub.Feed{}, nil
+		return []microsub.Feed{}, err
 	}
 	return response.Items, nil
 }
@@ -255,14 +334,14 @@ func (c *Client) ChannelsCreate(ctx context.Context, name string) (microsub.Chan
 	args["name"] = name
 	res, err := c.microsubPostRequest(ctx, "channels", args)
 	if err != nil {
-		return microsub.Channel{}, nil
+		return microsub.Channel{}, err
 	}
 	defer res.Body.Close()
 	var channel microsub.Channel
 	dec := json.NewDecoder(res.Body)
 	err = dec.Decode(&channel)
 	if err != nil {
-		return microsub.Channel{}, nil
+		return microsub.Channel{}, err
 	}
 	return channel, nil
 }
@@ -299,6 +378,24 @@ func (c *Client) ChannelsDelete(ctx context.Context, uid string) error {
 	return nil
 }
 
+// ChannelsOrder sets the order of the channels.
+func (c *Client) ChannelsOrder(ctx context.Context, uids []string) error {
+	args := make(map[string]string)
+	args["method"] = "order"
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("channels[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest(ctx, "channels", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
 // FollowURL follows a url.
 func (c *Client) FollowURL(ctx context.Context, channel, url string) (microsub.Feed, error) {
 	args := make(map[string]string)
@@ -393,15 +490,194 @@ func (c *Client) MarkRead(ctx context.Context, channel string, uids []string) er
 	return nil
 }
 
-// Events open an event channel to the server.
-func (c *Client) Events(ctx context.Context) (chan sse.Message, error) {
+// MarkReadUntil marks an item and all items before it read on the server.
+func (c *Client) MarkReadUntil(ctx context.Context, channel string, lastReadEntry string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = "mark_read"
+
+	data := url.Values{}
+	data.Set("last_read_entry", lastReadEntry)
+
+	res, err := c.microsubPostFormRequest(ctx, "timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// MarkUnread marks an item unread on the server.
+func (c *Client) MarkUnread(ctx context.Context, channel string, uids []string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = "mark_unread"
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("entry[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest(ctx, "timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Star stars items on the server.
+func (c *Client) Star(ctx context.Context, channel string, uids []string) error {
+	return c.timelineEntries(ctx, channel, "star", uids)
+}
+
+// Unstar removes the star of items on the server.
+func (c *Client) Unstar(ctx context.Context, channel string, uids []string) error {
+	return c.timelineEntries(ctx, channel, "unstar", uids)
+}
+
+// timelineEntries sends the method of the timeline action for the items
+func (c *Client) timelineEntries(ctx context.Context, channel, method string, uids []string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = method
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("entry[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest(ctx, "timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// RemoveItems removes items from a channel on the server.
+func (c *Client) RemoveItems(ctx context.Context, channel string, uids []string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = "remove"
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("entry[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest(ctx, "timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// MuteGetList gets the list of muted users for a channel.
+func (c *Client) MuteGetList(ctx context.Context, channel string) ([]microsub.Card, error) {
+	args := make(map[string]string)
+	args["channel"] = channel
+	res, err := c.microsubGetRequest(ctx, "mute", args)
+	if err != nil {
+		return []microsub.Card{}, err
+	}
+	defer res.Body.Close()
+	dec := json.NewDecoder(res.Body)
+	type muteResponse struct {
+		Items []microsub.Card `json:"items"`
+	}
+	var response muteResponse
+	err = dec.Decode(&response)
+	if err != nil {
+		return []microsub.Card{}, err
+	}
+	return response.Items, nil
+}
+
+// MuteURL mutes a url in a channel.
+func (c *Client) MuteURL(ctx context.Context, channel, url string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["url"] = url
+	res, err := c.microsubPostRequest(ctx, "mute", args)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// UnmuteURL unmutes a url in a channel.
+func (c *Client) UnmuteURL(ctx context.Context, channel, url string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["url"] = url
+	res, err := c.microsubPostRequest(ctx, "unmute", args)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// BlockGetList gets the list of blocked users for a channel.
+func (c *Client) BlockGetList(ctx context.Context, channel string) ([]microsub.Card, error) {
+	args := make(map[string]string)
+	args["channel"] = channel
+	res, err := c.microsubGetRequest(ctx, "block", args)
+	if err != nil {
+		return []microsub.Card{}, err
+	}
+	defer res.Body.Close()
+	dec := json.NewDecoder(res.Body)
+	type blockResponse struct {
+		Items []microsub.Card `json:"items"`
+	}
+	var response blockResponse
+	err = dec.Decode(&response)
+	if err != nil {
+		return []microsub.Card{}, err
+	}
+	return response.Items, nil
+}
+
+// BlockURL blocks a url in a channel.
+func (c *Client) BlockURL(ctx context.Context, channel, url string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["url"] = url
+	res, err := c.microsubPostRequest(ctx, "block", args)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// UnblockURL unblocks a url in a channel.
+func (c *Client) UnblockURL(ctx context.Context, channel, url string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["url"] = url
+	res, err := c.microsubPostRequest(ctx, "unblock", args)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Events open an event channel to the server. The events are read from a
+// WebSocket connection when UseWebSocket is set.
+func (c *Client) Events(ctx context.Context, lastEventID string) (chan sse.Message, error) {
 
 	ch := make(chan sse.Message)
 
 	errorCounter := 0
 	go func() {
 		for {
-			res, err := c.microsubGetRequest(ctx, "events", nil)
+			read, err := c.openEvents(ctx, lastEventID)
 			if err != nil {
 				log.Printf("could not request events: %+v", err)
 				errorCounter++
@@ -411,7 +687,22 @@ func (c *Client) Events(ctx context.Context) (chan sse.Message, error) {
 				continue
 			}
 
-			err = sse.Reader(res.Body, ch)
+			// Remember the last event id, so we can continue after it when we reconnect
+			messages := make(sse.MessageChan)
+			done := make(chan struct{})
+			go func() {
+				for msg := range messages {
+					if msg.ID != 0 {
+						lastEventID = strconv.FormatInt(msg.ID, 10)
+					}
+					ch <- msg
+				}
+				close(done)
+			}()
+
+			err = read(messages)
+			close(messages)
+			<-done
 			if err != nil {
 				log.Printf("could not create reader: %+v", err)
 				break
@@ -423,3 +714,31 @@ func (c *Client) Events(ctx context.Context) (chan sse.Message, error) {
 
 	return ch, nil
 }
+
+// openEvents opens a connection for events. The returned function reads
+// the events into a channel and closes the connection.
+func (c *Client) openEvents(ctx context.Context, lastEventID string) (func(sse.MessageChan) error, error) {
+	if c.UseWebSocket {
+		conn, err := c.DialEvents(ctx, lastEventID)
+		if err != nil {
+			return nil, err
+		}
+		return func(messages sse.MessageChan) error {
+			defer conn.Close()
+			return conn.Read(messages)
+		}, nil
+	}
+
+	header := http.Header{}
+	if lastEventID != "" {
+		header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := c.microsubGetRequestWithHeader(ctx, "events", nil, header)
+	if err != nil {
+		return nil, err
+	}
+	return func(messages sse.MessageChan) error {
+		defer res.Body.Close()
+		return sse.Reader(res.Body, messages)
+	}, nil
+}
@@ -0,0 +1,109 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pstuifzand/ekster/pkg/sse"
+	"golang.org/x/net/websocket"
+)
+
+// EventsConn is a WebSocket connection for events. Besides receiving events,
+// commands can be sent back over the connection.
+type EventsConn struct {
+	ws        *websocket.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// DialEvents opens a WebSocket connection for events. When lastEventID is not
+// empty, the server first sends the events after it.
+func (c *Client) DialEvents(ctx context.Context, lastEventID string) (*EventsConn, error) {
+	u := *c.MicrosubEndpoint
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	q := u.Query()
+	q.Add("action", "events")
+	u.RawQuery = q.Encode()
+
+	origin := *c.MicrosubEndpoint
+	origin.Path = "/"
+	origin.RawQuery = ""
+
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header = http.Header{}
+	config.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	if lastEventID != "" {
+		config.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &EventsConn{ws: ws, closed: make(chan struct{})}
+
+	// Close the connection when the context is done, this stops Read
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-conn.closed:
+		}
+	}()
+
+	return conn, nil
+}
+
+// Read sends the events from the connection to ch, until the connection is closed
+func (conn *EventsConn) Read(ch sse.MessageChan) error {
+	return sse.ReadWebSocket(conn.ws, ch)
+}
+
+// MarkRead marks the entries in the channel as read
+func (conn *EventsConn) MarkRead(channel string, uids []string) error {
+	return websocket.JSON.Send(conn.ws, sse.Command{Method: "mark_read", Channel: channel, Entries: uids})
+}
+
+// MarkReadUntil marks the entries in the channel up to lastReadEntry as read
+func (conn *EventsConn) MarkReadUntil(channel, lastReadEntry string) error {
+	return websocket.JSON.Send(conn.ws, sse.Command{Method: "mark_read", Channel: channel, LastReadEntry: lastReadEntry})
+}
+
+// Close closes the connection
+func (conn *EventsConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		err = conn.ws.Close()
+	})
+	return err
+}
@@ -47,7 +47,7 @@ import (
 )
 
 // FeedHeader returns a new microsub.Feed with the information parsed from body.
-func FeedHeader(fetcher Fetcher, fetchURL, contentType string, body io.Reader) (microsub.Feed, error) {
+func FeedHeader(ctx context.Context, fetcher Fetcher, fetchURL, contentType string, body io.Reader) (microsub.Feed, error) {
 	log.Printf("ProcessContent %s\n", fetchURL)
 	log.Println("Found " + contentType)
 
@@ -60,7 +60,7 @@ func FeedHeader(fetcher Fetcher, fetchURL, contentType string, body io.Reader) (
 		author, ok := jf2.SimplifyMicroformatDataAuthor(data)
 		if !ok {
 			if strings.HasPrefix(author.URL, "http") {
-				resp, err := fetcher.Fetch(author.URL)
+				resp, err := fetcher.FetchWithContext(ctx, author.URL)
 				if err != nil {
 					return feed, err
 				}
@@ -133,7 +133,7 @@ func FeedHeader(fetcher Fetcher, fetchURL, contentType string, body io.Reader) (
 }
 
 // FeedItems returns the items from the url, parsed from body.
-func FeedItems(fetcher Fetcher, fetchURL, contentType string, body io.Reader) ([]microsub.Item, error) {
+func FeedItems(ctx context.Context, fetcher Fetcher, fetchURL, contentType string, body io.Reader) ([]microsub.Item, error) {
 	log.Printf("ProcessContent %s\n", fetchURL)
 	log.Println("Found " + contentType)
 
@@ -256,7 +256,7 @@ func FeedItems(fetcher Fetcher, fetchURL, contentType string, body io.Reader) ([
 	for i, v := range items {
 		// Process mentions inside the content
 		if v.Content != nil && v.Content.HTML != "" {
-			mentions, err := parseContentMentions(fetcher, v.Content.HTML)
+			mentions, err := parseContentMentions(ctx, fetcher, v.Content.HTML)
 			if err != nil {
 				log.Println("parseContentMentions", err)
 				continue
@@ -283,7 +283,7 @@ type mention struct {
 	Item microsub.Item
 }
 
-func parseContentMentions(fetcher Fetcher, s string) ([]mention, error) {
+func parseContentMentions(ctx context.Context, fetcher Fetcher, s string) ([]mention, error) {
 	node, err := html.Parse(strings.NewReader(s))
 	if err != nil {
 		return nil, err
@@ -292,7 +292,7 @@ func parseContentMentions(fetcher Fetcher, s string) ([]mention, error) {
 	var mentions []mention
 
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		newMentions, err := parseContentMentionsRec(fetcher, c)
+		newMentions, err := parseContentMentionsRec(ctx, fetcher, c)
 		if err != nil {
 			log.Println("parseContentMentionsRec", err)
 			continue
@@ -309,7 +309,7 @@ func parseContentMentions(fetcher Fetcher, s string) ([]mention, error) {
 // ErrNoMention is used when not mention was found
 var ErrNoMention = errors.New("No mention")
 
-func parseContentMentionProcessLink(fetcher Fetcher, node *html.Node) (mention, error) {
+func parseContentMentionProcessLink(ctx context.Context, fetcher Fetcher, node *html.Node) (mention, error) {
 	href := getAttrPtr(node, "href")
 	if href == nil {
 		return mention{}, ErrNoMention
@@ -322,7 +322,7 @@ func parseContentMentionProcessLink(fetcher Fetcher, node *html.Node) (mention,
 		return mention{}, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	resp, err := fetcher.FetchWithContext(ctx, *href)
@@ -362,10 +362,10 @@ func parseContentMentionProcessLink(fetcher Fetcher, node *html.Node) (mention,
 	}, nil
 }
 
-func parseContentMentionsRec(fetcher Fetcher, node *html.Node) ([]mention, error) {
+func parseContentMentionsRec(ctx context.Context, fetcher Fetcher, node *html.Node) ([]mention, error) {
 	var mentions []mention
 	if isAtom(node, atom.A) {
-		mention, err := parseContentMentionProcessLink(fetcher, node)
+		mention, err := parseContentMentionProcessLink(ctx, fetcher, node)
 		if err != nil {
 			log.Println("parseContentMentionProcessLink", err)
 		} else {
@@ -377,7 +377,7 @@ func parseContentMentionsRec(fetcher Fetcher, node *html.Node) ([]mention, error
 	}
 
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		newMentions, err := parseContentMentionsRec(fetcher, c)
+		newMentions, err := parseContentMentionsRec(ctx, fetcher, c)
 		if err != nil {
 			log.Println("parseContentMentionsRec", err)
 			continue
@@ -157,6 +157,8 @@ func itemPtr(item *microsub.Item, key string) *[]string {
 		return &item.Photo
 	} else if key == "category" {
 		return &item.Category
+	} else if key == "syndication" {
+		return &item.Syndication
 	}
 	return nil
 }
@@ -201,7 +203,7 @@ func simplifyToItem(itemType string, item map[string][]interface{}, author micro
 					}
 				}
 			}
-		case "photo":
+		case "photo", "syndication":
 			if resultPtr := itemPtr(&feedItem, k); resultPtr != nil {
 				for _, c := range v {
 					if photo, ok := c.(string); ok {
@@ -243,4 +243,8 @@ func TestConvertItemNoteWithCheckout(t *testing.T) {
 		t,
 		"not sure if it&#39;s cheaper to buy all the Microsoft Flight Simulator accessories or actually train for a pilots license <a href=\"https://aaronparecki.com/emoji/%F0%9F%A4%94\" class=\"emoji\">🤔</a> <a href=\"https://youtu.be/shpK1Gjvnuo\"><span class=\"protocol\">https://</span>youtu.be/shpK1Gjvnuo</a>",
 		results[0].Content.HTML)
+	assert.Equal(
+		t,
+		[]string{"https://twitter.com/aaronpk/status/1296996514011602944", "https://micro.blog/aaronpk/10141453"},
+		results[0].Syndication)
 }
@@ -38,3 +38,23 @@ func (item *Item) Scan(value interface{}) error {
 func (item *Item) Value() (driver.Value, error) {
 	return json.Marshal(item)
 }
+
+// Scan helps to scan json data from database, a NULL value results in an empty Card
+func (card *Card) Scan(value interface{}) error {
+	if value == nil {
+		*card = Card{}
+		return nil
+	}
+
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, &card)
+}
+
+// Value helps to add json data to database
+func (card *Card) Value() (driver.Value, error) {
+	return json.Marshal(card)
+}
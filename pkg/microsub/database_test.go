@@ -0,0 +1,45 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package microsub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CardScanNull(t *testing.T) {
+	card := Card{Name: "Test"}
+	err := card.Scan(nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Card{}, card)
+	}
+}
+
+func Test_CardValueScan(t *testing.T) {
+	card := Card{Type: "card", Name: "Test", URL: "https://example.com/"}
+	value, err := card.Value()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var scanned Card
+	err = scanned.Scan(value)
+	if assert.NoError(t, err) {
+		assert.Equal(t, card, scanned)
+	}
+}
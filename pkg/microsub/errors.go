@@ -0,0 +1,52 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package microsub
+
+// Error is an error as returned by a Microsub server. The Code is one of the
+// error codes from the spec, like "not_found" or "invalid_request".
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Errors that can be returned by a backend. Wrap them to add a description,
+// and use errors.Is to check for them.
+var (
+	ErrNotFound          = &Error{Code: "not_found", Description: "not found"}
+	ErrInvalidRequest    = &Error{Code: "invalid_request", Description: "invalid request"}
+	ErrUnauthorized      = &Error{Code: "unauthorized", Description: "unauthorized"}
+	ErrInsufficientScope = &Error{Code: "insufficient_scope", Description: "insufficient scope"}
+	ErrUpstream          = &Error{Code: "upstream_error", Description: "could not fetch upstream url"}
+)
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Description
+}
+
+// Is reports if target is an Error with the same Code. This makes errors
+// decoded from a response match the errors above.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code
+}
@@ -0,0 +1,41 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package microsub
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ErrorIs(t *testing.T) {
+	err := fmt.Errorf("channel %q: %w", "test", ErrNotFound)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.False(t, errors.Is(err, ErrInvalidRequest))
+
+	decoded := &Error{Code: "not_found", Description: "channel \"test\": not found"}
+	assert.True(t, errors.Is(decoded, ErrNotFound))
+	assert.False(t, errors.Is(decoded, ErrUnauthorized))
+}
+
+func Test_ErrorString(t *testing.T) {
+	assert.Equal(t, "not found", ErrNotFound.Error())
+	assert.Equal(t, "test_code", (&Error{Code: "test_code"}).Error())
+}
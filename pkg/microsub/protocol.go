@@ -80,29 +80,39 @@ type Content struct {
 
 // Item is a post object
 type Item struct {
-	Type       string          `json:"type"`
-	Name       string          `json:"name,omitempty" mf2:"name"`
-	Published  string          `json:"published,omitempty" mf2:"published"`
-	Updated    string          `json:"updated,omitempty" mf2:"updated"`
-	URL        string          `json:"url,omitempty" mf2:"url"`
-	UID        string          `json:"uid,omitempty" mf2:"uid"`
-	Author     *Card           `json:"author,omitempty" mf2:"author"`
-	Category   []string        `json:"category,omitempty" mf2:"category"`
-	Photo      []string        `json:"photo,omitempty" mf2:"photo"`
-	LikeOf     []string        `json:"like-of,omitempty" mf2:"like-of"`
-	BookmarkOf []string        `json:"bookmark-of,omitempty" mf2:"bookmark-of"`
-	RepostOf   []string        `json:"repost-of,omitempty" mf2:"repost-of"`
-	InReplyTo  []string        `json:"in-reply-to,omitempty" mf2:"in-reply-to"`
-	MentionOf  []string        `json:"mention-of,omitempty" mf2:"mention-of"`
-	Content    *Content        `json:"content,omitempty" mf2:"content"`
-	Summary    string          `json:"summary,omitempty" mf2:"summary"`
-	Latitude   string          `json:"latitude,omitempty" mf2:"latitude"`
-	Longitude  string          `json:"longitude,omitempty" mf2:"longitude"`
-	Checkin    *Card           `json:"checkin,omitempty" mf2:"checkin"`
-	Refs       map[string]Item `json:"refs,omitempty"`
-	ID         string          `json:"_id,omitempty"`
-	Read       bool            `json:"_is_read"`
-	Source     *Source         `json:"_source,omitempty"`
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty" mf2:"name"`
+	Published   string          `json:"published,omitempty" mf2:"published"`
+	Updated     string          `json:"updated,omitempty" mf2:"updated"`
+	URL         string          `json:"url,omitempty" mf2:"url"`
+	UID         string          `json:"uid,omitempty" mf2:"uid"`
+	Author      *Card           `json:"author,omitempty" mf2:"author"`
+	Category    []string        `json:"category,omitempty" mf2:"category"`
+	Photo       []string        `json:"photo,omitempty" mf2:"photo"`
+	LikeOf      []string        `json:"like-of,omitempty" mf2:"like-of"`
+	BookmarkOf  []string        `json:"bookmark-of,omitempty" mf2:"bookmark-of"`
+	RepostOf    []string        `json:"repost-of,omitempty" mf2:"repost-of"`
+	InReplyTo   []string        `json:"in-reply-to,omitempty" mf2:"in-reply-to"`
+	MentionOf   []string        `json:"mention-of,omitempty" mf2:"mention-of"`
+	Syndication []string        `json:"syndication,omitempty" mf2:"syndication"`
+	Content     *Content        `json:"content,omitempty" mf2:"content"`
+	Summary     string          `json:"summary,omitempty" mf2:"summary"`
+	Latitude    string          `json:"latitude,omitempty" mf2:"latitude"`
+	Longitude   string          `json:"longitude,omitempty" mf2:"longitude"`
+	Checkin     *Card           `json:"checkin,omitempty" mf2:"checkin"`
+	Refs        map[string]Item `json:"refs,omitempty"`
+	ID          string          `json:"_id,omitempty"`
+	Read        bool            `json:"_is_read"`
+	Source      *Source         `json:"_source,omitempty"`
+
+	// Sources lists all sources of an item that was received from more feeds
+	Sources []Source `json:"_sources,omitempty"`
+
+	// Channel is the UID of the channel of the item, it is set in timelines with items from more channels
+	Channel string `json:"_channel,omitempty"`
+
+	// Starred is set for items that the user starred, the retention policy of a channel can keep them
+	Starred bool `json:"_is_starred,omitempty"`
 }
 
 // Source is an Item source
@@ -119,6 +129,22 @@ type Pagination struct {
 	Before string `json:"before,omitempty"`
 }
 
+// TimelineOptions contains the paging and filter options for a timeline
+type TimelineOptions struct {
+	// Before and After are the cursors from the Pagination of a Timeline
+	Before string
+	After  string
+
+	// Limit is the maximum number of items, the server uses a default when it is zero
+	Limit int
+
+	// IsRead filters items by read state, when nil all items are returned
+	IsRead *bool
+
+	// Source filters items by the feed they came from, the Feed ID returned by FollowGetList
+	Source string
+}
+
 // Timeline is a combination of items and paging information
 type Timeline struct {
 	Items  []Item     `json:"items"`
@@ -127,6 +153,7 @@ type Timeline struct {
 
 // Feed is one microsub feed.
 type Feed struct {
+	ID          string `json:"_id,omitempty"`
 	Type        string `json:"type"`
 	URL         string `json:"url"`
 	Name        string `json:"name,omitempty"`
@@ -135,16 +162,45 @@ type Feed struct {
 	Author      Card   `json:"author,omitempty"`
 }
 
+// RetentionPolicy is the policy that removes old items from a channel
+type RetentionPolicy struct {
+	MaxAgeDays  int  `json:"max_age_days"`
+	MaxItems    int  `json:"max_items"`
+	KeepUnread  bool `json:"keep_unread"`
+	KeepStarred bool `json:"keep_starred"`
+}
+
+// Retention contains the retention policy of a channel and the items that
+// the policy would remove now
+type Retention struct {
+	Policy RetentionPolicy `json:"policy"`
+	// Count is the number of items that would be removed, Items contains
+	// the first of them
+	Count int    `json:"count"`
+	Items []Item `json:"items"`
+}
+
 // Microsub is the main protocol that should be implemented by a backend
 type Microsub interface {
 	ChannelsGetList(ctx context.Context) ([]Channel, error)
 	ChannelsCreate(ctx context.Context, name string) (Channel, error)
 	ChannelsUpdate(ctx context.Context, uid, name string) (Channel, error)
 	ChannelsDelete(ctx context.Context, uid string) error
+	ChannelsOrder(ctx context.Context, uids []string) error
 
-	TimelineGet(ctx context.Context, before, after, channel string) (Timeline, error)
+	TimelineGet(ctx context.Context, channel string, options TimelineOptions) (Timeline, error)
 
 	MarkRead(ctx context.Context, channel string, entry []string) error
+	MarkReadUntil(ctx context.Context, channel string, lastReadEntry string) error
+	MarkUnread(ctx context.Context, channel string, entry []string) error
+	// Star and Unstar change the starred state of the items
+	Star(ctx context.Context, channel string, entry []string) error
+	Unstar(ctx context.Context, channel string, entry []string) error
+	RemoveItems(ctx context.Context, channel string, entry []string) error
+
+	// RetentionGet returns the retention policy of the channel and the items
+	// it would remove, without removing them
+	RetentionGet(ctx context.Context, channel string) (Retention, error)
 
 	FollowGetList(ctx context.Context, uid string) ([]Feed, error)
 	FollowURL(ctx context.Context, uid string, url string) (Feed, error)
@@ -156,7 +212,16 @@ type Microsub interface {
 
 	ItemSearch(ctx context.Context, channel, query string) ([]Item, error)
 
-	Events(ctx context.Context) (chan sse.Message, error)
+	MuteGetList(ctx context.Context, channel string) ([]Card, error)
+	MuteURL(ctx context.Context, channel string, url string) error
+	UnmuteURL(ctx context.Context, channel string, url string) error
+
+	BlockGetList(ctx context.Context, channel string) ([]Card, error)
+	BlockURL(ctx context.Context, channel string, url string) error
+	UnblockURL(ctx context.Context, channel string, url string) error
+
+	// Events returns the events of the user, starting after lastEventID when it is not empty
+	Events(ctx context.Context, lastEventID string) (chan sse.Message, error)
 }
 
 // MarshalJSON encodes an Unread value as JSON
@@ -24,17 +24,22 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 
 	"github.com/pstuifzand/ekster/pkg/microsub"
 	"github.com/pstuifzand/ekster/pkg/sse"
 )
 
 var (
-	entryRegex = regexp.MustCompile(`^entry\[\d+\]$`)
+	arrayKeyRegex = regexp.MustCompile(`^(\w+)\[(\d+)\]$`)
 )
 
 // Constants used for the responses
@@ -58,6 +63,123 @@ func respondJSON(w http.ResponseWriter, value interface{}) {
 	}
 }
 
+// RespondError writes err as a JSON error response. The status code follows
+// from the microsub.Error that err wraps, other errors are internal server errors.
+func RespondError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	code := "internal_error"
+
+	var merr *microsub.Error
+	if errors.As(err, &merr) {
+		code = merr.Code
+		switch {
+		case errors.Is(merr, microsub.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(merr, microsub.ErrInvalidRequest):
+			status = http.StatusBadRequest
+		case errors.Is(merr, microsub.ErrUnauthorized):
+			status = http.StatusUnauthorized
+		case errors.Is(merr, microsub.ErrInsufficientScope):
+			status = http.StatusForbidden
+		case errors.Is(merr, microsub.ErrUpstream):
+			status = http.StatusBadGateway
+		}
+	}
+
+	w.Header().Set("Content-Type", OutputContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(microsub.Error{
+		Code:        code,
+		Description: err.Error(),
+	})
+}
+
+// arrayFromValues returns the values from the "name", "name[]" or
+// "name[N]" keys, the last ones ordered by N
+func arrayFromValues(values url.Values, name string) []string {
+	if v, e := values[name]; e {
+		return v
+	}
+	if v, e := values[name+"[]"]; e {
+		return v
+	}
+	type indexedValue struct {
+		index int
+		value []string
+	}
+	var indexed []indexedValue
+	for k, v := range values {
+		if m := arrayKeyRegex.FindStringSubmatch(k); m != nil && m[1] == name {
+			index, _ := strconv.Atoi(m[2])
+			indexed = append(indexed, indexedValue{index, v})
+		}
+	}
+	sort.Slice(indexed, func(i, j int) bool {
+		return indexed[i].index < indexed[j].index
+	})
+	result := []string{}
+	for _, iv := range indexed {
+		result = append(result, iv.value...)
+	}
+	return result
+}
+
+// postValues returns the values of a POST request. The values of a JSON body
+// are merged with the query values, so the same dispatch can be used as for
+// form bodies.
+func postValues(r *http.Request) (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return r.Form, nil
+	}
+
+	values := url.Values{}
+	for k, v := range r.Form {
+		values[k] = v
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("could not decode json body: %w", err)
+	}
+
+	for k, v := range body {
+		switch v := v.(type) {
+		case []interface{}:
+			var arr []string
+			for _, e := range v {
+				s, err := jsonScalar(e)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value in %q: %w", k, err)
+				}
+				arr = append(arr, s)
+			}
+			values[k] = arr
+		default:
+			s, err := jsonScalar(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %w", k, err)
+			}
+			values.Set(k, s)
+		}
+	}
+
+	return values, nil
+}
+
+func jsonScalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
+}
+
 // NewMicrosubHandler is the main entry point for the microsub server
 // It returns a handler for HTTP and a broker that will send events.
 func NewMicrosubHandler(backend microsub.Microsub) (http.Handler, *sse.Broker) {
@@ -84,29 +206,62 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 		values := r.URL.Query()
 		action := values.Get("action")
+		if err := checkScope(r.Context(), r.Method, action, values.Get("method")); err != nil {
+			RespondError(w, err)
+			return
+		}
 		if action == "channels" {
 			channels, err := h.backend.ChannelsGetList(r.Context())
 			if err != nil {
 				log.Println(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				RespondError(w, err)
 				return
 			}
 			respondJSON(w, map[string][]microsub.Channel{
 				"channels": channels,
 			})
 		} else if action == "timeline" {
-			timeline, err := h.backend.TimelineGet(r.Context(), values.Get("before"), values.Get("after"), values.Get("channel"))
+			options := microsub.TimelineOptions{
+				Before: values.Get("before"),
+				After:  values.Get("after"),
+				Source: values.Get("source"),
+			}
+			if isRead := values.Get("is_read"); isRead != "" {
+				b, err := strconv.ParseBool(isRead)
+				if err != nil {
+					RespondError(w, fmt.Errorf("invalid value for is_read %q: %w", isRead, microsub.ErrInvalidRequest))
+					return
+				}
+				options.IsRead = &b
+			}
+			if limit := values.Get("limit"); limit != "" {
+				n, err := strconv.Atoi(limit)
+				if err != nil || n < 1 {
+					RespondError(w, fmt.Errorf("invalid value for limit %q: %w", limit, microsub.ErrInvalidRequest))
+					return
+				}
+				options.Limit = n
+			}
+			timeline, err := h.backend.TimelineGet(r.Context(), values.Get("channel"), options)
 			if err != nil {
 				log.Println(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				RespondError(w, err)
 				return
 			}
 			respondJSON(w, timeline)
+		} else if action == "retention" {
+			retention, err := h.backend.RetentionGet(r.Context(), values.Get("channel"))
+			if err != nil {
+				log.Println(err)
+				RespondError(w, err)
+				return
+			}
+			respondJSON(w, retention)
 		} else if action == "preview" {
 			timeline, err := h.backend.PreviewURL(r.Context(), values.Get("url"))
 			if err != nil {
 				log.Println(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				RespondError(w, err)
 				return
 			}
 			respondJSON(w, timeline)
@@ -115,17 +270,45 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			following, err := h.backend.FollowGetList(r.Context(), channel)
 			if err != nil {
 				log.Println(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				RespondError(w, err)
 				return
 			}
 			respondJSON(w, map[string][]microsub.Feed{
 				"items": following,
 			})
+		} else if action == "mute" {
+			channel := values.Get("channel")
+			muted, err := h.backend.MuteGetList(r.Context(), channel)
+			if err != nil {
+				log.Println(err)
+				RespondError(w, err)
+				return
+			}
+			respondJSON(w, map[string][]microsub.Card{
+				"items": muted,
+			})
+		} else if action == "block" {
+			channel := values.Get("channel")
+			blocked, err := h.backend.BlockGetList(r.Context(), channel)
+			if err != nil {
+				log.Println(err)
+				RespondError(w, err)
+				return
+			}
+			respondJSON(w, map[string][]microsub.Card{
+				"items": blocked,
+			})
 		} else if action == "events" {
-			events, err := h.backend.Events(r.Context())
+			events, err := h.backend.Events(r.Context(), r.Header.Get("Last-Event-ID"))
 			if err != nil {
 				log.Println(err)
-				http.Error(w, "could not start sse connection", http.StatusInternalServerError)
+				RespondError(w, err)
+				return
+			}
+
+			if isWebSocket(r) {
+				h.serveWebSocket(w, r, events)
+				return
 			}
 
 			// Remove this client from the map of connected clients
@@ -145,27 +328,45 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			err = sse.WriteMessages(w, events)
 			if err != nil {
 				log.Println(err)
-				http.Error(w, "internal server error", http.StatusInternalServerError)
+				RespondError(w, err)
 			}
 		} else {
-			http.Error(w, fmt.Sprintf("unknown action %s", action), http.StatusBadRequest)
+			RespondError(w, fmt.Errorf("unknown action %q: %w", action, microsub.ErrInvalidRequest))
 			return
 		}
 		return
 	} else if r.Method == http.MethodPost {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 
-		values := r.Form
+		values, err := postValues(r)
+		if err != nil {
+			RespondError(w, fmt.Errorf("%s: %w", err, microsub.ErrInvalidRequest))
+			return
+		}
 		action := values.Get("action")
+		if err := checkScope(r.Context(), r.Method, action, values.Get("method")); err != nil {
+			RespondError(w, err)
+			return
+		}
 		if action == "channels" {
 			name := values.Get("name")
 			method := values.Get("method")
 			uid := values.Get("channel")
+			if method == "order" {
+				err := h.backend.ChannelsOrder(r.Context(), arrayFromValues(values, "channels"))
+				if err != nil {
+					log.Println(err)
+					RespondError(w, err)
+					return
+				}
+				respondJSON(w, []string{})
+				return
+			}
 			if method == "delete" {
 				err := h.backend.ChannelsDelete(r.Context(), uid)
 				if err != nil {
 					log.Println(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					RespondError(w, err)
 					return
 				}
 				respondJSON(w, []string{})
@@ -176,7 +377,7 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				channel, err := h.backend.ChannelsCreate(r.Context(), name)
 				if err != nil {
 					log.Println(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					RespondError(w, err)
 					return
 				}
 				respondJSON(w, channel)
@@ -184,7 +385,7 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				channel, err := h.backend.ChannelsUpdate(r.Context(), uid, name)
 				if err != nil {
 					log.Println(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					RespondError(w, err)
 					return
 				}
 				respondJSON(w, channel)
@@ -195,7 +396,7 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// h.HubIncomingBackend.CreateFeed(url, uid)
 			feed, err := h.backend.FollowURL(r.Context(), uid, url)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				RespondError(w, err)
 				return
 			}
 			respondJSON(w, feed)
@@ -204,14 +405,50 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			url := values.Get("url")
 			err := h.backend.UnfollowURL(r.Context(), uid, url)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				RespondError(w, err)
+				return
+			}
+			respondJSON(w, []string{})
+		} else if action == "mute" {
+			uid := values.Get("channel")
+			url := values.Get("url")
+			err := h.backend.MuteURL(r.Context(), uid, url)
+			if err != nil {
+				RespondError(w, err)
+				return
+			}
+			respondJSON(w, []string{})
+		} else if action == "unmute" {
+			uid := values.Get("channel")
+			url := values.Get("url")
+			err := h.backend.UnmuteURL(r.Context(), uid, url)
+			if err != nil {
+				RespondError(w, err)
+				return
+			}
+			respondJSON(w, []string{})
+		} else if action == "block" {
+			uid := values.Get("channel")
+			url := values.Get("url")
+			err := h.backend.BlockURL(r.Context(), uid, url)
+			if err != nil {
+				RespondError(w, err)
+				return
+			}
+			respondJSON(w, []string{})
+		} else if action == "unblock" {
+			uid := values.Get("channel")
+			url := values.Get("url")
+			err := h.backend.UnblockURL(r.Context(), uid, url)
+			if err != nil {
+				RespondError(w, err)
 				return
 			}
 			respondJSON(w, []string{})
 		} else if action == "preview" {
 			timeline, err := h.backend.PreviewURL(r.Context(), values.Get("url"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				RespondError(w, err)
 				return
 			}
 			respondJSON(w, timeline)
@@ -221,10 +458,7 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if channel == "" {
 				feeds, err := h.backend.Search(r.Context(), query)
 				if err != nil {
-					respondJSON(w, map[string]interface{}{
-						"query": query,
-						"error": err.Error(),
-					})
+					RespondError(w, err)
 					return
 				}
 				respondJSON(w, map[string][]microsub.Feed{
@@ -233,10 +467,7 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			} else {
 				items, err := h.backend.ItemSearch(r.Context(), channel, query)
 				if err != nil {
-					respondJSON(w, map[string]interface{}{
-						"query": query,
-						"error": err.Error(),
-					})
+					RespondError(w, err)
 					return
 				}
 				log.Printf("Searching for %s in %s (%d results)", query, channel, len(items))
@@ -245,44 +476,79 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					"items": items,
 				})
 			}
-		} else if action == "timeline" || r.PostForm.Get("action") == "timeline" {
+		} else if action == "timeline" {
 			method := values.Get("method")
 
-			if method == "mark_read" || r.PostForm.Get("method") == "mark_read" {
-				values = r.Form
+			if method == "mark_read" {
 				channel := values.Get("channel")
-				var markAsRead []string
-				if uids, e := values["entry"]; e {
-					markAsRead = uids
-				} else if uids, e := values["entry[]"]; e {
-					markAsRead = uids
+				markAsRead := arrayFromValues(values, "entry")
+
+				if lastReadEntry := values.Get("last_read_entry"); lastReadEntry != "" {
+					err := h.backend.MarkReadUntil(r.Context(), channel, lastReadEntry)
+					if err != nil {
+						RespondError(w, err)
+						return
+					}
+				} else if len(markAsRead) > 0 {
+					err := h.backend.MarkRead(r.Context(), channel, markAsRead)
+					if err != nil {
+						RespondError(w, err)
+						return
+					}
 				} else {
-					uids := []string{}
-					for k, v := range values {
-						if entryRegex.MatchString(k) {
-							uids = append(uids, v...)
-						}
+					log.Println("No uids specified for mark read")
+				}
+			} else if method == "mark_unread" {
+				channel := values.Get("channel")
+				markAsUnread := arrayFromValues(values, "entry")
+
+				if len(markAsUnread) > 0 {
+					err := h.backend.MarkUnread(r.Context(), channel, markAsUnread)
+					if err != nil {
+						RespondError(w, err)
+						return
 					}
-					markAsRead = uids
+				} else {
+					log.Println("No uids specified for mark unread")
 				}
+			} else if method == "star" || method == "unstar" {
+				channel := values.Get("channel")
+				entries := arrayFromValues(values, "entry")
 
-				if len(markAsRead) > 0 {
-					err := h.backend.MarkRead(r.Context(), channel, markAsRead)
+				if len(entries) > 0 {
+					star := h.backend.Star
+					if method == "unstar" {
+						star = h.backend.Unstar
+					}
+					err := star(r.Context(), channel, entries)
 					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						RespondError(w, err)
 						return
 					}
 				} else {
-					log.Println("No uids specified for mark read")
+					log.Printf("No uids specified for %s", method)
+				}
+			} else if method == "remove" {
+				channel := values.Get("channel")
+				remove := arrayFromValues(values, "entry")
+
+				if len(remove) > 0 {
+					err := h.backend.RemoveItems(r.Context(), channel, remove)
+					if err != nil {
+						RespondError(w, err)
+						return
+					}
+				} else {
+					log.Println("No uids specified for remove")
 				}
 			} else {
-				http.Error(w, fmt.Sprintf("unknown method in timeline %s\n", method), http.StatusInternalServerError)
+				RespondError(w, fmt.Errorf("unknown method in timeline %q: %w", method, microsub.ErrInvalidRequest))
 				return
 			}
 
 			respondJSON(w, []string{})
 		} else {
-			http.Error(w, fmt.Sprintf("unknown action %s\n", action), http.StatusBadRequest)
+			RespondError(w, fmt.Errorf("unknown action %q: %w", action, microsub.ErrInvalidRequest))
 		}
 		return
 	}
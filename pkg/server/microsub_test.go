@@ -20,11 +20,15 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/pstuifzand/ekster/pkg/client"
@@ -37,8 +41,10 @@ func init() {
 }
 
 func createServerClient() (*httptest.Server, *client.Client) {
-	backend := &NullBackend{}
+	return createBackendServerClient(&NullBackend{})
+}
 
+func createBackendServerClient(backend microsub.Microsub) (*httptest.Server, *client.Client) {
 	handler, _ := NewMicrosubHandler(backend)
 
 	server := httptest.NewServer(handler)
@@ -87,6 +93,66 @@ func TestServer_ChannelsCreate(t *testing.T) {
 	}
 }
 
+func TestServer_ChannelsCreateJSON(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	c.UseJSON = true
+
+	ctx := context.Background()
+	channel, err := c.ChannelsCreate(ctx, "test")
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "test", channel.Name)
+	}
+}
+
+func TestServer_MarkReadJSON(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	c.UseJSON = true
+
+	ctx := context.Background()
+	err := c.MarkRead(ctx, "0001", []string{"test"})
+	assert.NoError(t, err)
+}
+
+func TestServer_PostInvalidJSON(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+
+	resp, err := http.Post(c.MicrosubEndpoint.String(), "application/json", strings.NewReader(`{"action":`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, resp.StatusCode)
+	}
+}
+
+func Test_postValues(t *testing.T) {
+	body := `{"action":"timeline","method":"mark_read","channel":"0001","entry":["a","b"],"limit":20,"is_read":false}`
+	r := httptest.NewRequest(http.MethodPost, "/microsub?extra=1", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	_ = r.ParseForm()
+
+	values, err := postValues(r)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "timeline", values.Get("action"))
+		assert.Equal(t, "mark_read", values.Get("method"))
+		assert.Equal(t, "0001", values.Get("channel"))
+		assert.Equal(t, []string{"a", "b"}, arrayFromValues(values, "entry"))
+		assert.Equal(t, "20", values.Get("limit"))
+		assert.Equal(t, "false", values.Get("is_read"))
+		assert.Equal(t, "1", values.Get("extra"))
+	}
+}
+
+func Test_postValuesNested(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/microsub", strings.NewReader(`{"action":{"name":"test"}}`))
+	r.Header.Set("Content-Type", "application/json")
+	_ = r.ParseForm()
+
+	_, err := postValues(r)
+	assert.Error(t, err)
+}
+
 func TestServer_ChannelsDelete(t *testing.T) {
 	server, c := createServerClient()
 	defer server.Close()
@@ -103,16 +169,125 @@ func TestServer_ChannelsUpdate(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestServer_ChannelsOrder(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.ChannelsOrder(ctx, []string{"0002", "0001", "0003"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "order", uids: []string{"0002", "0001", "0003"}}, backend.call)
+	}
+}
+
+func Test_arrayFromValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		values url.Values
+		want   []string
+	}{
+		{"plain", url.Values{"channels": {"a", "b"}}, []string{"a", "b"}},
+		{"brackets", url.Values{"channels[]": {"a", "b"}}, []string{"a", "b"}},
+		{"indexed", url.Values{"channels[1]": {"b"}, "channels[0]": {"a"}, "channels[10]": {"c"}, "entry[2]": {"x"}}, []string{"a", "b", "c"}},
+		{"missing", url.Values{"entry[]": {"x"}}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, arrayFromValues(tt.values, "channels"))
+		})
+	}
+}
+
 func TestServer_TimelineGet(t *testing.T) {
 	server, c := createServerClient()
 	defer server.Close()
 	ctx := context.Background()
-	timeline, err := c.TimelineGet(ctx, "", "", "0001")
+	timeline, err := c.TimelineGet(ctx, "0001", microsub.TimelineOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, len(timeline.Items))
+	}
+}
+
+func TestServer_RetentionGet(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	retention, err := c.RetentionGet(ctx, "0001")
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "retention", channel: "0001"}, backend.call)
+		assert.Equal(t, 0, retention.Count)
+		assert.Equal(t, 0, len(retention.Items))
+	}
+}
+
+func TestServer_TimelineGetUnread(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	ctx := context.Background()
+	isRead := false
+	timeline, err := c.TimelineGet(ctx, "0001", microsub.TimelineOptions{IsRead: &isRead})
 	if assert.NoError(t, err) {
 		assert.Equal(t, 0, len(timeline.Items))
 	}
 }
 
+func TestServer_TimelineGetSource(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	ctx := context.Background()
+	timeline, err := c.TimelineGet(ctx, "0001", microsub.TimelineOptions{Source: "1"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, len(timeline.Items))
+	}
+}
+
+func TestServer_TimelineGetInvalidIsRead(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+
+	u := c.MicrosubEndpoint
+	q := u.Query()
+	q.Add("action", "timeline")
+	q.Add("channel", "0001")
+	q.Add("is_read", "maybe")
+	u.RawQuery = q.Encode()
+
+	resp, err := http.Get(u.String())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, resp.StatusCode)
+	}
+}
+
+func TestServer_TimelineGetLimit(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	ctx := context.Background()
+	timeline, err := c.TimelineGet(ctx, "0001", microsub.TimelineOptions{Limit: 5})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, len(timeline.Items))
+	}
+}
+
+func TestServer_TimelineGetInvalidLimit(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+
+	for _, limit := range []string{"many", "0", "-1"} {
+		u := c.MicrosubEndpoint
+		q := url.Values{}
+		q.Add("action", "timeline")
+		q.Add("channel", "0001")
+		q.Add("limit", limit)
+		u.RawQuery = q.Encode()
+
+		resp, err := http.Get(u.String())
+		if assert.NoError(t, err) {
+			assert.Equal(t, 400, resp.StatusCode, "limit %q", limit)
+		}
+	}
+}
+
 func TestServer_FollowGetList(t *testing.T) {
 	server, c := createServerClient()
 	defer server.Close()
@@ -120,6 +295,7 @@ func TestServer_FollowGetList(t *testing.T) {
 	feeds, err := c.FollowGetList(ctx, "0001")
 	if assert.NoError(t, err) {
 		assert.Equal(t, 1, len(feeds))
+		assert.Equal(t, "1", feeds[0].ID)
 		assert.Equal(t, "test", feeds[0].Name)
 		assert.Equal(t, "feed", feeds[0].Type)
 		assert.Equal(t, "https://example.com/", feeds[0].URL)
@@ -171,11 +347,137 @@ func TestServer_Search(t *testing.T) {
 }
 
 func TestServer_MarkRead(t *testing.T) {
-	server, c := createServerClient()
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
 	defer server.Close()
 	ctx := context.Background()
 	err := c.MarkRead(ctx, "0001", []string{"test"})
-	assert.NoError(t, err)
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "mark_read", channel: "0001", uids: []string{"test"}}, backend.call)
+	}
+}
+
+func TestServer_MarkReadUntil(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.MarkReadUntil(ctx, "0001", "test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "mark_read_until", channel: "0001", uids: []string{"test"}}, backend.call)
+	}
+}
+
+func TestServer_MarkUnread(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.MarkUnread(ctx, "0001", []string{"test"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "mark_unread", channel: "0001", uids: []string{"test"}}, backend.call)
+	}
+}
+
+func TestServer_Star(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.Star(ctx, "0001", []string{"test"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "star", channel: "0001", uids: []string{"test"}}, backend.call)
+	}
+}
+
+func TestServer_Unstar(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.Unstar(ctx, "0001", []string{"test"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "unstar", channel: "0001", uids: []string{"test"}}, backend.call)
+	}
+}
+
+func TestServer_MuteGetList(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	ctx := context.Background()
+	muted, err := c.MuteGetList(ctx, "0001")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(muted))
+		assert.Equal(t, "card", muted[0].Type)
+		assert.Equal(t, "https://example.com/", muted[0].URL)
+	}
+}
+
+func TestServer_MuteURL(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.MuteURL(ctx, "0001", "https://example.com/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "mute", channel: "0001", url: "https://example.com/"}, backend.call)
+	}
+}
+
+func TestServer_UnmuteURL(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.UnmuteURL(ctx, "global", "https://example.com/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "unmute", channel: "global", url: "https://example.com/"}, backend.call)
+	}
+}
+
+func TestServer_BlockGetList(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	ctx := context.Background()
+	blocked, err := c.BlockGetList(ctx, "0001")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(blocked))
+		assert.Equal(t, "card", blocked[0].Type)
+		assert.Equal(t, "https://example.com/", blocked[0].URL)
+	}
+}
+
+func TestServer_BlockURL(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.BlockURL(ctx, "0001", "https://example.com/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "block", channel: "0001", url: "https://example.com/"}, backend.call)
+	}
+}
+
+func TestServer_UnblockURL(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.UnblockURL(ctx, "global", "https://example.com/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "unblock", channel: "global", url: "https://example.com/"}, backend.call)
+	}
+}
+
+func TestServer_RemoveItems(t *testing.T) {
+	backend := &recordingBackend{}
+	server, c := createBackendServerClient(backend)
+	defer server.Close()
+	ctx := context.Background()
+	err := c.RemoveItems(ctx, "0001", []string{"test", "test2"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, recordedCall{method: "remove", channel: "0001", uids: []string{"test", "test2"}}, backend.call)
+	}
 }
 
 func TestServer_GetUnknownAction(t *testing.T) {
@@ -206,3 +508,162 @@ func TestServer_PostUnknownAction(t *testing.T) {
 		assert.Equal(t, 400, resp.StatusCode)
 	}
 }
+
+// recordedCall contains the arguments of a call to the backend
+type recordedCall struct {
+	method  string
+	channel string
+	url     string
+	uids    []string
+}
+
+// recordingBackend records the last call to the backend
+type recordingBackend struct {
+	NullBackend
+	call recordedCall
+}
+
+func (b *recordingBackend) ChannelsOrder(ctx context.Context, uids []string) error {
+	b.call = recordedCall{method: "order", uids: uids}
+	return nil
+}
+
+func (b *recordingBackend) RetentionGet(ctx context.Context, channel string) (microsub.Retention, error) {
+	b.call = recordedCall{method: "retention", channel: channel}
+	return b.NullBackend.RetentionGet(ctx, channel)
+}
+
+func (b *recordingBackend) MarkRead(ctx context.Context, channel string, uids []string) error {
+	b.call = recordedCall{method: "mark_read", channel: channel, uids: uids}
+	return nil
+}
+
+func (b *recordingBackend) MarkReadUntil(ctx context.Context, channel string, lastReadEntry string) error {
+	b.call = recordedCall{method: "mark_read_until", channel: channel, uids: []string{lastReadEntry}}
+	return nil
+}
+
+func (b *recordingBackend) MarkUnread(ctx context.Context, channel string, uids []string) error {
+	b.call = recordedCall{method: "mark_unread", channel: channel, uids: uids}
+	return nil
+}
+
+func (b *recordingBackend) Star(ctx context.Context, channel string, uids []string) error {
+	b.call = recordedCall{method: "star", channel: channel, uids: uids}
+	return nil
+}
+
+func (b *recordingBackend) Unstar(ctx context.Context, channel string, uids []string) error {
+	b.call = recordedCall{method: "unstar", channel: channel, uids: uids}
+	return nil
+}
+
+func (b *recordingBackend) MuteURL(ctx context.Context, channel string, url string) error {
+	b.call = recordedCall{method: "mute", channel: channel, url: url}
+	return nil
+}
+
+func (b *recordingBackend) UnmuteURL(ctx context.Context, channel string, url string) error {
+	b.call = recordedCall{method: "unmute", channel: channel, url: url}
+	return nil
+}
+
+func (b *recordingBackend) BlockURL(ctx context.Context, channel string, url string) error {
+	b.call = recordedCall{method: "block", channel: channel, url: url}
+	return nil
+}
+
+func (b *recordingBackend) UnblockURL(ctx context.Context, channel string, url string) error {
+	b.call = recordedCall{method: "unblock", channel: channel, url: url}
+	return nil
+}
+
+func (b *recordingBackend) RemoveItems(ctx context.Context, channel string, uids []string) error {
+	b.call = recordedCall{method: "remove", channel: channel, uids: uids}
+	return nil
+}
+
+type errorBackend struct {
+	NullBackend
+	err error
+}
+
+func (b *errorBackend) TimelineGet(ctx context.Context, channel string, options microsub.TimelineOptions) (microsub.Timeline, error) {
+	return microsub.Timeline{}, b.err
+}
+
+func (b *errorBackend) ChannelsDelete(ctx context.Context, uid string) error {
+	return b.err
+}
+
+func (b *errorBackend) ChannelsCreate(ctx context.Context, name string) (microsub.Channel, error) {
+	return microsub.Channel{}, b.err
+}
+
+func (b *errorBackend) FollowGetList(ctx context.Context, uid string) ([]microsub.Feed, error) {
+	return nil, b.err
+}
+
+func (b *errorBackend) ItemSearch(ctx context.Context, channel, query string) ([]microsub.Item, error) {
+	return nil, b.err
+}
+
+func TestServer_ErrorResponse(t *testing.T) {
+	backend := &errorBackend{err: fmt.Errorf("channel %q: %w", "0001", microsub.ErrNotFound)}
+	handler, _ := NewMicrosubHandler(backend)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	c := client.Client{Token: "1234"}
+	c.MicrosubEndpoint, _ = url.Parse(server.URL + "/microsub")
+
+	ctx := context.Background()
+
+	_, err := c.TimelineGet(ctx, "0001", microsub.TimelineOptions{})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, microsub.ErrNotFound))
+		assert.Equal(t, `channel "0001": not found`, err.Error())
+	}
+
+	err = c.ChannelsDelete(ctx, "0001")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, microsub.ErrNotFound))
+	}
+
+	_, err = c.ChannelsCreate(ctx, "Test")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound))
+
+	_, err = c.FollowGetList(ctx, "0001")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound))
+
+	_, err = c.ItemSearch(ctx, "0001", "test")
+	assert.True(t, errors.Is(err, microsub.ErrNotFound))
+}
+
+func TestRespondError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("test: %w", microsub.ErrNotFound), http.StatusNotFound, "not_found"},
+		{fmt.Errorf("test: %w", microsub.ErrInvalidRequest), http.StatusBadRequest, "invalid_request"},
+		{fmt.Errorf("test: %w", microsub.ErrUnauthorized), http.StatusUnauthorized, "unauthorized"},
+		{fmt.Errorf("test: %w", microsub.ErrInsufficientScope), http.StatusForbidden, "insufficient_scope"},
+		{fmt.Errorf("test: %w", microsub.ErrUpstream), http.StatusBadGateway, "upstream_error"},
+		{errors.New("test"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			RespondError(w, tt.err)
+			assert.Equal(t, tt.status, w.Code)
+
+			var body map[string]string
+			if assert.NoError(t, json.NewDecoder(w.Body).Decode(&body)) {
+				assert.Equal(t, tt.code, body["error"])
+				assert.Equal(t, tt.err.Error(), body["error_description"])
+			}
+		})
+	}
+}
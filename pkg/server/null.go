@@ -58,8 +58,18 @@ func (b *NullBackend) ChannelsDelete(ctx context.Context, uid string) error {
 	return nil
 }
 
+// ChannelsOrder orders no channels
+func (b *NullBackend) ChannelsOrder(ctx context.Context, uids []string) error {
+	return nil
+}
+
+// RetentionGet returns an empty retention policy
+func (b *NullBackend) RetentionGet(ctx context.Context, channel string) (microsub.Retention, error) {
+	return microsub.Retention{Items: []microsub.Item{}}, nil
+}
+
 // TimelineGet gets no timeline
-func (b *NullBackend) TimelineGet(ctx context.Context, before, after, channel string) (microsub.Timeline, error) {
+func (b *NullBackend) TimelineGet(ctx context.Context, channel string, options microsub.TimelineOptions) (microsub.Timeline, error) {
 	return microsub.Timeline{
 		Paging: microsub.Pagination{},
 		Items:  []microsub.Item{},
@@ -69,7 +79,7 @@ func (b *NullBackend) TimelineGet(ctx context.Context, before, after, channel st
 // FollowGetList implements the follow list command
 func (b *NullBackend) FollowGetList(ctx context.Context, uid string) ([]microsub.Feed, error) {
 	return []microsub.Feed{
-		{Name: "test", Type: "feed", URL: "https://example.com/"},
+		{ID: "1", Name: "test", Type: "feed", URL: "https://example.com/"},
 	}, nil
 }
 
@@ -108,8 +118,67 @@ func (b *NullBackend) MarkRead(ctx context.Context, channel string, uids []strin
 	return nil
 }
 
+// MarkReadUntil marks no items as read
+func (b *NullBackend) MarkReadUntil(ctx context.Context, channel string, lastReadEntry string) error {
+	return nil
+}
+
+// MarkUnread marks no items as unread
+func (b *NullBackend) MarkUnread(ctx context.Context, channel string, uids []string) error {
+	return nil
+}
+
+// Star stars no items
+func (b *NullBackend) Star(ctx context.Context, channel string, uids []string) error {
+	return nil
+}
+
+// Unstar unstars no items
+func (b *NullBackend) Unstar(ctx context.Context, channel string, uids []string) error {
+	return nil
+}
+
+// MuteGetList returns an example list of muted users
+func (b *NullBackend) MuteGetList(ctx context.Context, channel string) ([]microsub.Card, error) {
+	return []microsub.Card{
+		{Type: "card", URL: "https://example.com/"},
+	}, nil
+}
+
+// MuteURL mutes no users
+func (b *NullBackend) MuteURL(ctx context.Context, channel string, url string) error {
+	return nil
+}
+
+// UnmuteURL unmutes no users
+func (b *NullBackend) UnmuteURL(ctx context.Context, channel string, url string) error {
+	return nil
+}
+
+// BlockGetList returns an example list of blocked users
+func (b *NullBackend) BlockGetList(ctx context.Context, channel string) ([]microsub.Card, error) {
+	return []microsub.Card{
+		{Type: "card", URL: "https://example.com/"},
+	}, nil
+}
+
+// BlockURL blocks no users
+func (b *NullBackend) BlockURL(ctx context.Context, channel string, url string) error {
+	return nil
+}
+
+// UnblockURL unblocks no users
+func (b *NullBackend) UnblockURL(ctx context.Context, channel string, url string) error {
+	return nil
+}
+
+// RemoveItems removes no items
+func (b *NullBackend) RemoveItems(ctx context.Context, channel string, uids []string) error {
+	return nil
+}
+
 // Events returns a closed channel.
-func (b *NullBackend) Events(ctx context.Context) (chan sse.Message, error) {
+func (b *NullBackend) Events(ctx context.Context, lastEventID string) (chan sse.Message, error) {
 	ch := make(chan sse.Message)
 	close(ch)
 	return ch, nil
@@ -0,0 +1,68 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/pstuifzand/ekster/pkg/auth"
+	"github.com/pstuifzand/ekster/pkg/microsub"
+)
+
+// requiredScope returns the scope that a token needs for the action and
+// method of a request. It returns "" for unknown actions.
+func requiredScope(httpMethod, action, method string) string {
+	switch action {
+	case "channels":
+		if httpMethod == http.MethodGet {
+			return "read"
+		}
+		return "channels"
+	case "timeline":
+		if method == "remove" {
+			return "channels"
+		}
+		return "read"
+	case "search", "preview", "events", "retention":
+		return "read"
+	case "follow", "unfollow":
+		return "follow"
+	case "mute", "unmute":
+		return "mute"
+	case "block", "unblock":
+		return "block"
+	}
+	return ""
+}
+
+// checkScope checks that the token in the context has the scope that is
+// required for the request. Requests without a token are not checked, when
+// authorization is enabled the token is added by the authorization handler.
+func checkScope(ctx context.Context, httpMethod, action, method string) error {
+	token, ok := auth.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	scope := requiredScope(httpMethod, action, method)
+	if scope == "" || token.HasScope(scope) {
+		return nil
+	}
+	return fmt.Errorf("action %q requires scope %q: %w", action, scope, microsub.ErrInsufficientScope)
+}
@@ -0,0 +1,103 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pstuifzand/ekster/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func withToken(handler http.Handler, scope string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := auth.NewContext(r.Context(), auth.TokenResponse{Me: "https://example.com/", Scope: scope})
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func TestServer_Scopes(t *testing.T) {
+	tests := []struct {
+		name       string
+		httpMethod string
+		values     url.Values
+		scope      string
+	}{
+		{"get channels", http.MethodGet, url.Values{"action": {"channels"}}, "read"},
+		{"get timeline", http.MethodGet, url.Values{"action": {"timeline"}, "channel": {"0001"}}, "read"},
+		{"get retention", http.MethodGet, url.Values{"action": {"retention"}, "channel": {"0001"}}, "read"},
+		{"get preview", http.MethodGet, url.Values{"action": {"preview"}, "url": {"https://example.com/"}}, "read"},
+		{"get follow", http.MethodGet, url.Values{"action": {"follow"}, "channel": {"0001"}}, "follow"},
+		{"get mute", http.MethodGet, url.Values{"action": {"mute"}, "channel": {"0001"}}, "mute"},
+		{"get block", http.MethodGet, url.Values{"action": {"block"}, "channel": {"0001"}}, "block"},
+		{"get events", http.MethodGet, url.Values{"action": {"events"}}, "read"},
+		{"create channel", http.MethodPost, url.Values{"action": {"channels"}, "name": {"test"}}, "channels"},
+		{"update channel", http.MethodPost, url.Values{"action": {"channels"}, "channel": {"0001"}, "name": {"test"}}, "channels"},
+		{"delete channel", http.MethodPost, url.Values{"action": {"channels"}, "channel": {"0001"}, "method": {"delete"}}, "channels"},
+		{"order channels", http.MethodPost, url.Values{"action": {"channels"}, "method": {"order"}, "channels[]": {"0001", "0000"}}, "channels"},
+		{"follow", http.MethodPost, url.Values{"action": {"follow"}, "channel": {"0001"}, "url": {"https://example.com/"}}, "follow"},
+		{"unfollow", http.MethodPost, url.Values{"action": {"unfollow"}, "channel": {"0001"}, "url": {"https://example.com/"}}, "follow"},
+		{"mute", http.MethodPost, url.Values{"action": {"mute"}, "channel": {"0001"}, "url": {"https://example.com/"}}, "mute"},
+		{"unmute", http.MethodPost, url.Values{"action": {"unmute"}, "channel": {"0001"}, "url": {"https://example.com/"}}, "mute"},
+		{"block", http.MethodPost, url.Values{"action": {"block"}, "channel": {"0001"}, "url": {"https://example.com/"}}, "block"},
+		{"unblock", http.MethodPost, url.Values{"action": {"unblock"}, "channel": {"0001"}, "url": {"https://example.com/"}}, "block"},
+		{"post preview", http.MethodPost, url.Values{"action": {"preview"}, "url": {"https://example.com/"}}, "read"},
+		{"search", http.MethodPost, url.Values{"action": {"search"}, "channel": {"0001"}, "query": {"test"}}, "read"},
+		{"mark read", http.MethodPost, url.Values{"action": {"timeline"}, "method": {"mark_read"}, "channel": {"0001"}, "entry": {"test"}}, "read"},
+		{"mark read until", http.MethodPost, url.Values{"action": {"timeline"}, "method": {"mark_read"}, "channel": {"0001"}, "last_read_entry": {"test"}}, "read"},
+		{"mark unread", http.MethodPost, url.Values{"action": {"timeline"}, "method": {"mark_unread"}, "channel": {"0001"}, "entry": {"test"}}, "read"},
+		{"remove", http.MethodPost, url.Values{"action": {"timeline"}, "method": {"remove"}, "channel": {"0001"}, "entry": {"test"}}, "channels"},
+	}
+
+	handler, _ := NewMicrosubHandler(&NullBackend{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.httpMethod, "/microsub?"+tt.values.Encode(), nil)
+			w := httptest.NewRecorder()
+			withToken(handler, tt.scope).ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code, "with scope %q", tt.scope)
+
+			req = httptest.NewRequest(tt.httpMethod, "/microsub?"+tt.values.Encode(), nil)
+			w = httptest.NewRecorder()
+			withToken(handler, "profile").ServeHTTP(w, req)
+			if assert.Equal(t, http.StatusForbidden, w.Code) {
+				var body map[string]string
+				if assert.NoError(t, json.NewDecoder(w.Body).Decode(&body)) {
+					assert.Equal(t, "insufficient_scope", body["error"])
+				}
+			}
+		})
+	}
+}
+
+func TestServer_NoTokenSkipsScopes(t *testing.T) {
+	handler, _ := NewMicrosubHandler(&NullBackend{})
+	req := httptest.NewRequest(http.MethodGet, "/microsub?action=channels", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_requiredScopeUnknownAction(t *testing.T) {
+	assert.Equal(t, "", requiredScope(http.MethodGet, "unknown", ""))
+}
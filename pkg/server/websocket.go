@@ -0,0 +1,118 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/sse"
+	"golang.org/x/net/websocket"
+)
+
+// isWebSocket returns true when the client asks to upgrade the connection to a WebSocket
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket sends the events over a WebSocket connection. The client can
+// send commands back over the same connection.
+func (h *microsubHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, events chan sse.Message) {
+	ctx := r.Context()
+
+	// Like the event stream, the WebSocket is available from every origin
+	s := websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer h.Broker.CloseClient(events)
+
+		go func() {
+			h.readCommands(ctx, ws)
+			h.Broker.CloseClient(events)
+		}()
+
+		err := sse.WriteWebSocket(ws, events)
+		if err != nil {
+			log.Println(err)
+		}
+		ws.Close()
+	}}
+	s.ServeHTTP(w, r)
+}
+
+// readCommands handles the commands from the client, until the connection is closed
+func (h *microsubHandler) readCommands(ctx context.Context, ws *websocket.Conn) {
+	for {
+		var data []byte
+		err := websocket.Message.Receive(ws, &data)
+		if err != nil {
+			return
+		}
+
+		var cmd sse.Command
+		err = json.Unmarshal(data, &cmd)
+		if err != nil {
+			sendError(ws, fmt.Errorf("invalid command: %v: %w", err, microsub.ErrInvalidRequest))
+			continue
+		}
+
+		err = h.runCommand(ctx, cmd)
+		if err != nil {
+			log.Println(err)
+			sendError(ws, err)
+		}
+	}
+}
+
+// runCommand runs a command with the same scope as the matching POST request
+func (h *microsubHandler) runCommand(ctx context.Context, cmd sse.Command) error {
+	if err := checkScope(ctx, http.MethodPost, "timeline", cmd.Method); err != nil {
+		return err
+	}
+
+	switch cmd.Method {
+	case "mark_read":
+		if cmd.LastReadEntry != "" {
+			return h.backend.MarkReadUntil(ctx, cmd.Channel, cmd.LastReadEntry)
+		}
+		if len(cmd.Entries) == 0 {
+			return fmt.Errorf("missing entry: %w", microsub.ErrInvalidRequest)
+		}
+		return h.backend.MarkRead(ctx, cmd.Channel, cmd.Entries)
+	}
+
+	return fmt.Errorf("unknown method %q: %w", cmd.Method, microsub.ErrInvalidRequest)
+}
+
+// sendError sends an error to the client as an "error" frame
+func sendError(ws *websocket.Conn, err error) {
+	code := "internal_error"
+	var merr *microsub.Error
+	if errors.As(err, &merr) {
+		code = merr.Code
+	}
+	data, _ := json.Marshal(microsub.Error{Code: code, Description: err.Error()})
+	if err := websocket.JSON.Send(ws, sse.Frame{Event: "error", Data: data}); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pstuifzand/ekster/pkg/client"
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/sse"
+	"github.com/stretchr/testify/assert"
+)
+
+type markReadCall struct {
+	channel       string
+	uids          []string
+	lastReadEntry string
+}
+
+type eventsBackend struct {
+	NullBackend
+	events chan sse.Message
+	marked chan markReadCall
+}
+
+func (b *eventsBackend) Events(ctx context.Context, lastEventID string) (chan sse.Message, error) {
+	return b.events, nil
+}
+
+func (b *eventsBackend) MarkRead(ctx context.Context, channel string, uids []string) error {
+	b.marked <- markReadCall{channel: channel, uids: uids}
+	return nil
+}
+
+func (b *eventsBackend) MarkReadUntil(ctx context.Context, channel string, lastReadEntry string) error {
+	b.marked <- markReadCall{channel: channel, lastReadEntry: lastReadEntry}
+	return nil
+}
+
+func createWebSocketServerClient() (*httptest.Server, *client.Client, *eventsBackend) {
+	backend := &eventsBackend{
+		events: make(chan sse.Message, 1),
+		marked: make(chan markReadCall, 1),
+	}
+	handler, _ := NewMicrosubHandler(backend)
+	server := httptest.NewServer(handler)
+
+	c := client.Client{Token: "1234", UseWebSocket: true}
+	c.MicrosubEndpoint, _ = url.Parse(server.URL + "/microsub")
+
+	return server, &c, backend
+}
+
+func receiveMessage(t *testing.T, ch sse.MessageChan) sse.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	return sse.Message{}
+}
+
+func TestServer_EventsWebSocket(t *testing.T) {
+	server, c, backend := createWebSocketServerClient()
+	defer server.Close()
+	defer close(backend.events)
+
+	conn, err := c.DialEvents(context.Background(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	messages := make(sse.MessageChan)
+	go conn.Read(messages)
+
+	msg := receiveMessage(t, messages)
+	assert.Equal(t, "started", msg.Event)
+
+	backend.events <- sse.Message{ID: 42, Event: "new item", Object: map[string]string{"channel": "0001"}}
+
+	msg = receiveMessage(t, messages)
+	assert.Equal(t, int64(42), msg.ID)
+	assert.Equal(t, "new item", msg.Event)
+	assert.JSONEq(t, `{"channel":"0001"}`, msg.Data)
+}
+
+func TestServer_EventsWebSocketMarkRead(t *testing.T) {
+	server, c, backend := createWebSocketServerClient()
+	defer server.Close()
+	defer close(backend.events)
+
+	conn, err := c.DialEvents(context.Background(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	err = conn.MarkRead("0001", []string{"item1", "item2"})
+	if assert.NoError(t, err) {
+		select {
+		case call := <-backend.marked:
+			assert.Equal(t, markReadCall{channel: "0001", uids: []string{"item1", "item2"}}, call)
+		case <-time.After(time.Second):
+			t.Fatal("mark_read was not received")
+		}
+	}
+
+	err = conn.MarkReadUntil("0001", "item3")
+	if assert.NoError(t, err) {
+		select {
+		case call := <-backend.marked:
+			assert.Equal(t, markReadCall{channel: "0001", lastReadEntry: "item3"}, call)
+		case <-time.After(time.Second):
+			t.Fatal("mark_read was not received")
+		}
+	}
+}
+
+func TestServer_EventsWebSocketInvalidCommand(t *testing.T) {
+	server, c, backend := createWebSocketServerClient()
+	defer server.Close()
+	defer close(backend.events)
+
+	conn, err := c.DialEvents(context.Background(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	messages := make(sse.MessageChan)
+	go conn.Read(messages)
+	receiveMessage(t, messages)
+
+	err = conn.MarkRead("0001", nil)
+	if assert.NoError(t, err) {
+		msg := receiveMessage(t, messages)
+		assert.Equal(t, "error", msg.Event)
+
+		var merr microsub.Error
+		if assert.NoError(t, json.Unmarshal([]byte(msg.Data), &merr)) {
+			assert.Equal(t, "invalid_request", merr.Code)
+		}
+	}
+}
+
+func TestClient_EventsWebSocket(t *testing.T) {
+	server, c, backend := createWebSocketServerClient()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := c.Events(ctx, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	msg := receiveMessage(t, events)
+	assert.Equal(t, "started", msg.Event)
+
+	backend.events <- sse.Message{ID: 1, Event: "new item", Object: map[string]string{}}
+	msg = receiveMessage(t, events)
+	assert.Equal(t, "new item", msg.Event)
+
+	close(backend.events)
+}
@@ -21,10 +21,12 @@ package sse
 import (
 	"bufio"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,35 +36,106 @@ import (
 // A MessageChan is a channel of channels
 // Each connection sends a channel of bytes to a global MessageChan
 // The main broker listen() loop listens on new connections on MessageChan
-// New event messages are broadcast to all registered connection channels
+// New event messages are sent to the registered connection channels of the user
 type MessageChan chan Message
 
+// HistorySize is the number of messages per user that is kept for replay
+const HistorySize = 100
+
+// ClientBufferSize is the number of messages that are queued for a client
+const ClientBufferSize = 100
+
+// SlowClientPolicy tells the Broker what to do with a message when the
+// queue of a client is full
+type SlowClientPolicy int
+
+// Policies for slow clients
+const (
+	// Disconnect closes the connection of a slow client, the client can
+	// reconnect with Last-Event-ID to receive the missed messages
+	Disconnect SlowClientPolicy = iota
+	// Drop drops the message for a slow client
+	Drop
+)
+
+var varSSE *expvar.Map
+
+func init() {
+	varSSE = expvar.NewMap("sse")
+}
+
 // Message is a message.
 type Message struct {
+	// ID is set by the Broker, IDs of later messages are larger
+	ID int64
+
+	// UserID is the user that owns the message, it is only sent to the connections of this user
+	UserID int
+
 	Event  string
 	Data   string
 	Object interface{}
 }
 
+type client struct {
+	ch          MessageChan
+	userID      int
+	lastEventID int64
+}
+
 type pingMessage struct {
 	PingCount int `json:"ping"`
 }
 
 // Broker holds open client connections,
 // listens for incoming events on its Notifier channel
-// and broadcast event data to all registered connections
+// and sends event data to the registered connections of the user of the event
 type Broker struct {
 	// Events are pushed to this channel by the main UDP daemon
 	Notifier chan Message
 
 	// New client connections
-	newClients chan MessageChan
+	newClients chan client
 
 	// Closed client connections
 	closingClients chan MessageChan
 
-	// Client connections registry
-	clients map[MessageChan]bool
+	// Client connections registry, with the user id of the connection
+	clients map[MessageChan]int
+
+	// The last messages of each user, to replay them to reconnecting clients
+	history map[int][]Message
+
+	// ID of the last message
+	lastID int64
+
+	policy SlowClientPolicy
+}
+
+// send sends msg to the client without blocking. When the queue of the
+// client is full, the policy of the broker is applied.
+func (broker *Broker) send(ch MessageChan, msg Message) {
+	select {
+	case ch <- msg:
+		varSSE.Add("sent", 1)
+	default:
+		varSSE.Add("dropped", 1)
+		if broker.policy == Disconnect {
+			broker.removeClient(ch)
+			varSSE.Add("disconnected", 1)
+			log.Printf("Disconnected slow client. %d registered clients", len(broker.clients))
+		}
+	}
+}
+
+// removeClient removes the client and closes its channel, so the writer stops
+func (broker *Broker) removeClient(ch MessageChan) {
+	if _, e := broker.clients[ch]; !e {
+		return
+	}
+	delete(broker.clients, ch)
+	close(ch)
+	varSSE.Add("clients", -1)
 }
 
 // Listen on different channels and act accordingly
@@ -72,40 +145,75 @@ func (broker *Broker) listen() {
 	for {
 		select {
 		case <-ticker.C:
-			broker.Notifier <- Message{
+			// Pings are sent to all connected clients
+			ping := Message{
 				Event:  "ping",
 				Object: pingMessage{PingCount: pingCount},
 			}
+			for clientMessageChan := range broker.clients {
+				broker.send(clientMessageChan, ping)
+			}
 			pingCount++
-		case s := <-broker.newClients:
+		case c := <-broker.newClients:
 			// A new client has connected.
 			// Register their message channel
-			broker.clients[s] = true
+			broker.clients[c.ch] = c.userID
+			varSSE.Add("clients", 1)
+			// Replay the messages the client missed
+			if c.lastEventID > 0 {
+				for _, msg := range broker.history[c.userID] {
+					if msg.ID > c.lastEventID {
+						broker.send(c.ch, msg)
+					}
+				}
+			}
 			log.Printf("Client added. %d registered clients", len(broker.clients))
 		case s := <-broker.closingClients:
 			// A client has detached and we want to
 			// stop sending them messages.
-			delete(broker.clients, s)
+			broker.removeClient(s)
 			log.Printf("Removed client. %d registered clients", len(broker.clients))
 		case event := <-broker.Notifier:
 			// We got a new event from the outside!
-			// Send event to all connected clients
-			for clientMessageChan := range broker.clients {
-				clientMessageChan <- event
+			broker.lastID++
+			event.ID = broker.lastID
+
+			history := append(broker.history[event.UserID], event)
+			if len(history) > HistorySize {
+				history = history[len(history)-HistorySize:]
+			}
+			broker.history[event.UserID] = history
+
+			// Send event to the connected clients of the user
+			for clientMessageChan, userID := range broker.clients {
+				if userID != event.UserID {
+					continue
+				}
+				broker.send(clientMessageChan, event)
 			}
 		}
 	}
 
 }
 
-// NewBroker creates a Broker.
+// NewBroker creates a Broker that disconnects slow clients.
 func NewBroker() (broker *Broker) {
+	return NewBrokerWithPolicy(Disconnect)
+}
+
+// NewBrokerWithPolicy creates a Broker with a policy for slow clients.
+func NewBrokerWithPolicy(policy SlowClientPolicy) (broker *Broker) {
 	// Instantiate a broker
 	broker = &Broker{
-		Notifier:       make(chan Message, 1),
-		newClients:     make(chan MessageChan),
+		Notifier:       make(chan Message, 100),
+		newClients:     make(chan client),
 		closingClients: make(chan MessageChan),
-		clients:        make(map[MessageChan]bool),
+		clients:        make(map[MessageChan]int),
+		history:        make(map[int][]Message),
+		// IDs start at the current time in microseconds, so they keep
+		// increasing after a restart and stay below 2^53 for JavaScript clients
+		lastID: time.Now().UnixNano() / int64(time.Microsecond),
+		policy: policy,
 	}
 
 	// Set it running - listening and broadcasting events
@@ -114,18 +222,20 @@ func NewBroker() (broker *Broker) {
 	return
 }
 
-// CloseClient closes the client channel
+// CloseClient removes the client from the broker and closes the client channel.
+// It can be called more than once.
 func (broker *Broker) CloseClient(ch MessageChan) {
 	broker.closingClients <- ch
 }
 
-// StartConnection starts a SSE connection, based on an existing HTTP connection.
-func StartConnection(broker *Broker) (MessageChan, error) {
+// StartConnection starts a SSE connection for the user, based on an existing HTTP connection.
+// When lastEventID is not zero, the messages of the user after it are sent first.
+func StartConnection(broker *Broker, userID int, lastEventID int64) (MessageChan, error) {
 	// Each connection registers its own message channel with the Broker's connections registry
-	messageChan := make(MessageChan)
+	messageChan := make(MessageChan, ClientBufferSize)
 
 	// Signal the broker that we have a new connection
-	broker.newClients <- messageChan
+	broker.newClients <- client{ch: messageChan, userID: userID, lastEventID: lastEventID}
 
 	return messageChan, nil
 }
@@ -155,14 +265,11 @@ func WriteMessages(w http.ResponseWriter, messageChan chan Message) error {
 		return errors.Wrap(err, "could not encode welcome message")
 	}
 
-	messageID := 1
-
-	_, err = fmt.Fprintf(w, "event: started\r\nid: %d\r\ndata: %s\r\n\r\n", messageID, encoded)
+	_, err = fmt.Fprintf(w, "event: started\r\ndata: %s\r\n\r\n", encoded)
 	if err != nil {
 		return err
 	}
 
-	messageID++
 	flusher.Flush()
 
 	// block waiting or messages broadcast on this connection's messageChan
@@ -173,13 +280,16 @@ func WriteMessages(w http.ResponseWriter, messageChan chan Message) error {
 			return errors.Wrap(err, "could not marshal message data")
 		}
 
-		_, err = fmt.Fprintf(w, "event: %s\r\nid: %d\r\ndata: %s\r\n\r\n", message.Event, messageID, output)
+		// Messages without an ID, like pings, keep the last event id of the client
+		if message.ID != 0 {
+			_, err = fmt.Fprintf(w, "event: %s\r\nid: %d\r\ndata: %s\r\n\r\n", message.Event, message.ID, output)
+		} else {
+			_, err = fmt.Fprintf(w, "event: %s\r\ndata: %s\r\n\r\n", message.Event, output)
+		}
 		if err != nil {
 			return errors.Wrap(err, "could not write message")
 		}
 
-		messageID++
-
 		flusher.Flush()
 	}
 
@@ -202,6 +312,12 @@ func Reader(body io.ReadCloser, ch MessageChan) error {
 			line = line[len("event: "):]
 			msg.Event = line
 		}
+		if strings.HasPrefix(line, "id: ") {
+			line = line[len("id: "):]
+			if id, err := strconv.ParseInt(line, 10, 64); err == nil {
+				msg.ID = id
+			}
+		}
 		if strings.HasPrefix(line, "data: ") {
 			line = line[len("data: "):]
 			msg.Data = line
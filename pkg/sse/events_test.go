@@ -0,0 +1,297 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package sse
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(ch MessageChan) (Message, bool) {
+	select {
+	case msg, open := <-ch:
+		return msg, open
+	case <-time.After(100 * time.Millisecond):
+		return Message{}, false
+	}
+}
+
+func TestBroker_RoutesByUser(t *testing.T) {
+	broker := NewBroker()
+
+	user1, err := StartConnection(broker, 1, 0)
+	assert.NoError(t, err)
+	user2, err := StartConnection(broker, 2, 0)
+	assert.NoError(t, err)
+
+	broker.Notifier <- Message{UserID: 1, Event: "new item"}
+
+	msg, ok := receive(user1)
+	if assert.True(t, ok, "user 1 should receive its event") {
+		assert.Equal(t, "new item", msg.Event)
+		assert.Equal(t, 1, msg.UserID)
+	}
+
+	_, ok = receive(user2)
+	assert.False(t, ok, "user 2 should not receive the event of user 1")
+
+	broker.Notifier <- Message{UserID: 2, Event: "new channel"}
+
+	msg, ok = receive(user2)
+	if assert.True(t, ok, "user 2 should receive its event") {
+		assert.Equal(t, "new channel", msg.Event)
+	}
+
+	_, ok = receive(user1)
+	assert.False(t, ok, "user 1 should not receive the event of user 2")
+}
+
+func TestBroker_AllConnectionsOfUser(t *testing.T) {
+	broker := NewBroker()
+
+	first, _ := StartConnection(broker, 1, 0)
+	second, _ := StartConnection(broker, 1, 0)
+
+	broker.Notifier <- Message{UserID: 1, Event: "new item"}
+
+	_, ok := receive(first)
+	assert.True(t, ok)
+	_, ok = receive(second)
+	assert.True(t, ok)
+}
+
+func TestBroker_CloseClient(t *testing.T) {
+	broker := NewBroker()
+
+	user1, _ := StartConnection(broker, 1, 0)
+	broker.CloseClient(user1)
+
+	broker.Notifier <- Message{UserID: 1, Event: "new item"}
+
+	_, ok := receive(user1)
+	assert.False(t, ok, "closed connections should not receive events")
+}
+
+func TestBroker_IncreasingIDs(t *testing.T) {
+	broker := NewBroker()
+
+	user1, _ := StartConnection(broker, 1, 0)
+
+	broker.Notifier <- Message{UserID: 1, Event: "first"}
+	broker.Notifier <- Message{UserID: 1, Event: "second"}
+
+	first, _ := receive(user1)
+	second, _ := receive(user1)
+	assert.NotZero(t, first.ID)
+	assert.Greater(t, second.ID, first.ID)
+	assert.Less(t, second.ID, int64(1)<<53, "IDs are exact numbers in JavaScript")
+}
+
+func TestBroker_ReplayAfterLastEventID(t *testing.T) {
+	broker := NewBroker()
+
+	user1, _ := StartConnection(broker, 1, 0)
+
+	broker.Notifier <- Message{UserID: 1, Event: "first"}
+	broker.Notifier <- Message{UserID: 2, Event: "other user"}
+	broker.Notifier <- Message{UserID: 1, Event: "second"}
+	broker.Notifier <- Message{UserID: 1, Event: "third"}
+
+	first, _ := receive(user1)
+	broker.CloseClient(user1)
+
+	reconnected, _ := StartConnection(broker, 1, first.ID)
+
+	msg, ok := receive(reconnected)
+	if assert.True(t, ok) {
+		assert.Equal(t, "second", msg.Event)
+	}
+	msg, ok = receive(reconnected)
+	if assert.True(t, ok) {
+		assert.Equal(t, "third", msg.Event)
+	}
+	_, ok = receive(reconnected)
+	assert.False(t, ok, "only missed messages of the user should be replayed")
+}
+
+func TestBroker_HistoryIsBounded(t *testing.T) {
+	broker := NewBroker()
+	other, _ := StartConnection(broker, 2, 0)
+
+	for i := 0; i < HistorySize+10; i++ {
+		broker.Notifier <- Message{UserID: 1, Event: "new item"}
+	}
+	// Wait until the broker has handled the messages
+	broker.Notifier <- Message{UserID: 2, Event: "new item"}
+	_, ok := receive(other)
+	assert.True(t, ok)
+
+	ch, _ := StartConnection(broker, 1, 1)
+
+	count := 0
+	for {
+		if _, ok := receive(ch); !ok {
+			break
+		}
+		count++
+	}
+	assert.Equal(t, HistorySize, count)
+}
+
+func droppedCount() int64 {
+	if v, ok := varSSE.Get("dropped").(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// startSlowClients starts n connections that never read their messages
+func startSlowClients(broker *Broker, n int) []MessageChan {
+	var clients []MessageChan
+	for i := 0; i < n; i++ {
+		ch, _ := StartConnection(broker, 1, 0)
+		clients = append(clients, ch)
+	}
+	return clients
+}
+
+func TestBroker_SlowClientsAreDisconnected(t *testing.T) {
+	broker := NewBroker()
+
+	slow := startSlowClients(broker, 1000)
+	fast, _ := StartConnection(broker, 1, 0)
+
+	messages := ClientBufferSize * 3
+
+	// The fast client reads every message before the next one is sent
+	done := make(chan int)
+	go func() {
+		count := 0
+		for i := 0; i < messages; i++ {
+			broker.Notifier <- Message{UserID: 1, Event: "new item"}
+			if _, ok := receive(fast); !ok {
+				break
+			}
+			count++
+		}
+		done <- count
+	}()
+
+	select {
+	case count := <-done:
+		assert.Equal(t, messages, count, "fast client should receive all messages")
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow clients should not block the broker")
+	}
+
+	for _, ch := range slow {
+		n := 0
+		for range ch {
+			n++
+		}
+		assert.Equal(t, ClientBufferSize, n, "slow client should be closed after a full queue")
+	}
+}
+
+func TestBroker_SlowClientsDropMessages(t *testing.T) {
+	broker := NewBrokerWithPolicy(Drop)
+
+	slow := startSlowClients(broker, 1000)
+	fast, _ := StartConnection(broker, 1, 0)
+	before := droppedCount()
+
+	// Messages are sent in order, so all messages are handled when the
+	// fast client receives the last one
+	last := make(chan bool)
+	go func() {
+		for {
+			msg, ok := receive(fast)
+			if !ok || msg.Event == "last" {
+				last <- ok
+				return
+			}
+		}
+	}()
+
+	messages := ClientBufferSize + 10
+	for i := 0; i < messages; i++ {
+		broker.Notifier <- Message{UserID: 1, Event: "new item"}
+	}
+	broker.Notifier <- Message{UserID: 1, Event: "last"}
+	assert.True(t, <-last, "fast client should receive the last message")
+
+	for _, ch := range slow {
+		assert.Len(t, ch, ClientBufferSize)
+	}
+	assert.GreaterOrEqual(t, droppedCount()-before, int64(len(slow)*(messages-ClientBufferSize)))
+
+	for _, ch := range slow {
+		_, ok := receive(ch)
+		assert.True(t, ok, "slow client should stay connected")
+	}
+}
+
+func TestReader_ID(t *testing.T) {
+	body := ioutil.NopCloser(strings.NewReader("event: new item\r\nid: 42\r\ndata: {}\r\n\r\nevent: ping\r\ndata: {}\r\n\r\n"))
+	ch := make(MessageChan, 2)
+
+	err := Reader(body, ch)
+	if assert.NoError(t, err) {
+		msg := <-ch
+		assert.Equal(t, "new item", msg.Event)
+		assert.Equal(t, int64(42), msg.ID)
+		msg = <-ch
+		assert.Equal(t, "ping", msg.Event)
+		assert.Equal(t, int64(0), msg.ID)
+	}
+}
+
+func TestWriteMessages_ID(t *testing.T) {
+	ch := make(chan Message, 2)
+	ch <- Message{ID: 42, Event: "new item", Object: map[string]string{}}
+	ch <- Message{Event: "ping", Object: map[string]string{}}
+	close(ch)
+
+	w := httptest.NewRecorder()
+	err := WriteMessages(w, ch)
+	if assert.NoError(t, err) {
+		body := w.Body.String()
+		assert.Contains(t, body, "event: new item\r\nid: 42\r\ndata: {}\r\n\r\n")
+		assert.Contains(t, body, "event: ping\r\ndata: {}\r\n\r\n")
+		assert.NotContains(t, body, "event: started\r\nid:")
+	}
+}
+
+func TestFrame_IDString(t *testing.T) {
+	data, err := json.Marshal(Frame{ID: 1 << 60, Event: "new item", Data: json.RawMessage(`{}`)})
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"id":"1152921504606846976","event":"new item","data":{}}`, string(data))
+	}
+
+	var frame Frame
+	if assert.NoError(t, json.Unmarshal(data, &frame)) {
+		assert.Equal(t, int64(1<<60), frame.ID)
+	}
+}
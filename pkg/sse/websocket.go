@@ -0,0 +1,89 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sse
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// Frame is a Message as it is sent over a WebSocket connection. The ID is
+// sent as a string, like the id of a server-sent event.
+type Frame struct {
+	ID    int64           `json:"id,omitempty,string"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Command is sent by the client over a WebSocket connection
+type Command struct {
+	Method        string   `json:"method"`
+	Channel       string   `json:"channel"`
+	Entries       []string `json:"entry,omitempty"`
+	LastReadEntry string   `json:"last_read_entry,omitempty"`
+}
+
+// WriteWebSocket writes messages as JSON frames to the WebSocket connection,
+// until messageChan is closed
+func WriteWebSocket(ws *websocket.Conn, messageChan chan Message) error {
+	var welcomeMsg welcomeMessage
+	welcomeMsg.Version = "1.0.0"
+	encoded, err := json.Marshal(&welcomeMsg)
+	if err != nil {
+		return errors.Wrap(err, "could not encode welcome message")
+	}
+
+	err = websocket.JSON.Send(ws, Frame{Event: "started", Data: encoded})
+	if err != nil {
+		return errors.Wrap(err, "could not write welcome message")
+	}
+
+	for message := range messageChan {
+		output, err := json.Marshal(message.Object)
+		if err != nil {
+			return errors.Wrap(err, "could not marshal message data")
+		}
+
+		err = websocket.JSON.Send(ws, Frame{ID: message.ID, Event: message.Event, Data: output})
+		if err != nil {
+			return errors.Wrap(err, "could not write message")
+		}
+	}
+
+	return nil
+}
+
+// ReadWebSocket reads JSON frames from the WebSocket connection and sends them
+// to ch, in the same form as Reader. It returns nil when the connection is closed.
+func ReadWebSocket(ws *websocket.Conn, ch MessageChan) error {
+	for {
+		var frame Frame
+		err := websocket.JSON.Receive(ws, &frame)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not read frame from websocket")
+		}
+		ch <- Message{ID: frame.ID, Event: frame.Event, Data: string(frame.Data)}
+	}
+}
@@ -0,0 +1,532 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package timeline
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+)
+
+// globalTimeline merges the items of more timelines, newest first. It's the
+// GlobalChannel of a user with channels of more timeline types.
+type globalTimeline struct {
+	channels  []string
+	timelines []Backend
+}
+
+// Merge returns a timeline with the items of the timelines, newest first.
+// The keys are the channels of the timelines, items without a channel get
+// the key of their timeline. The paging cursors contain the position in
+// each timeline.
+func Merge(timelines map[string]Backend) Backend {
+	g := &globalTimeline{}
+	for channel := range timelines {
+		g.channels = append(g.channels, channel)
+	}
+	sort.Strings(g.channels)
+	for _, channel := range g.channels {
+		g.timelines = append(g.timelines, timelines[channel])
+	}
+	return g
+}
+
+// position is the position of an item in a timeline, the item at Skip in the
+// items after the After cursor. UID and Published are from the item, they are
+// empty at the end of the timeline.
+type position struct {
+	After     string `json:"a,omitempty"`
+	Skip      int    `json:"s,omitempty"`
+	UID       string `json:"u,omitempty"`
+	Published string `json:"p,omitempty"`
+}
+
+// first returns true for the position of the newest item
+func (p position) first() bool {
+	return p.After == "" && p.Skip == 0 && p.UID != ""
+}
+
+// globalCursor is a paging cursor of the global timeline, the position in each
+// timeline by channel
+type globalCursor map[string]position
+
+func (c globalCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseGlobalCursor parses a cursor that was returned by globalCursor.String
+func parseGlobalCursor(s string) (globalCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q: %w", s, microsub.ErrInvalidRequest)
+	}
+	var c globalCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor %q: %w", s, microsub.ErrInvalidRequest)
+	}
+	return c, nil
+}
+
+// entry is an item with its position in its timeline
+type entry struct {
+	item     microsub.Item
+	position position
+	timeline int
+}
+
+func published(item microsub.Item) time.Time {
+	t, _ := time.Parse(time.RFC3339, item.Published)
+	return t
+}
+
+// read returns up to n items of the timeline from the position, and the
+// position after the items
+func read(ctx context.Context, tl Backend, options microsub.TimelineOptions, from position, n int) ([]entry, position, error) {
+	options.Before = ""
+	after, skip := from.After, from.Skip
+
+	var entries []entry
+	for {
+		options.After = after
+		options.Limit = skip + n + 1 - len(entries)
+		page, err := tl.Items(ctx, options)
+		if err != nil {
+			return nil, position{}, err
+		}
+		for i, item := range page.Items {
+			if i < skip {
+				continue
+			}
+			p := position{After: after, Skip: i, UID: item.ID, Published: item.Published}
+			if len(entries) == n {
+				return entries, p, nil
+			}
+			entries = append(entries, entry{item: item, position: p})
+		}
+		if page.Paging.After == "" || page.Paging.After == after {
+			return entries, position{After: after, Skip: len(page.Items)}, nil
+		}
+		skip -= len(page.Items)
+		if skip < 0 {
+			skip = 0
+		}
+		after = page.Paging.After
+	}
+}
+
+// readBefore returns the last n items of the timeline before the position, and
+// true when there are more items before them
+func readBefore(ctx context.Context, tl Backend, options microsub.TimelineOptions, to position, n int) ([]entry, bool, error) {
+	if to.first() {
+		return nil, false, nil
+	}
+	options.Before = ""
+	options.After = ""
+	options.Limit = MaxLimit
+
+	stop := published(microsub.Item{Published: to.Published})
+
+	var entries []entry
+	more := false
+	for {
+		page, err := tl.Items(ctx, options)
+		if err != nil {
+			return nil, false, err
+		}
+		for i, item := range page.Items {
+			// an older item is found when the item at the position was removed
+			if to.UID != "" && (item.ID == to.UID || published(item).Before(stop)) {
+				return entries, more, nil
+			}
+			entries = append(entries, entry{item: item, position: position{After: options.After, Skip: i, UID: item.ID, Published: item.Published}})
+			if len(entries) > n {
+				entries = entries[1:]
+				more = true
+			}
+		}
+		if page.Paging.After == "" || page.Paging.After == options.After {
+			return entries, more, nil
+		}
+		options.After = page.Paging.After
+	}
+}
+
+// mergeEntries merges the entries of the timelines, newest first. Entries
+// published at the same time keep the order of the timelines.
+func mergeEntries(lists [][]entry) []entry {
+	next := make([]int, len(lists))
+	var merged []entry
+	for {
+		best := -1
+		for i, list := range lists {
+			if next[i] == len(list) {
+				continue
+			}
+			if best == -1 || published(list[next[i]].item).After(published(lists[best][next[best]].item)) {
+				best = i
+			}
+		}
+		if best == -1 {
+			return merged
+		}
+		e := lists[best][next[best]]
+		e.timeline = best
+		merged = append(merged, e)
+		next[best]++
+	}
+}
+
+// page returns the items of the entries with their channel
+func (g *globalTimeline) page(entries []entry) []microsub.Item {
+	items := []microsub.Item{}
+	for _, e := range entries {
+		if e.item.Channel == "" {
+			e.item.Channel = g.channels[e.timeline]
+		}
+		items = append(items, e.item)
+	}
+	return items
+}
+
+// Items returns a page of the merged items, newest first
+func (g *globalTimeline) Items(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error) {
+	limit := PageLimit(options)
+	if options.Before != "" {
+		return g.itemsBefore(ctx, options, limit)
+	}
+
+	var from globalCursor
+	if options.After != "" {
+		var err error
+		from, err = parseGlobalCursor(options.After)
+		if err != nil {
+			return microsub.Timeline{}, err
+		}
+	}
+
+	lists := make([][]entry, len(g.timelines))
+	rest := make([]position, len(g.timelines))
+	for i, tl := range g.timelines {
+		var err error
+		lists[i], rest[i], err = read(ctx, tl, options, from[g.channels[i]], limit)
+		if err != nil {
+			return microsub.Timeline{}, err
+		}
+	}
+
+	merged := mergeEntries(lists)
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+	taken := make([]int, len(g.timelines))
+	for _, e := range merged {
+		taken[e.timeline]++
+	}
+
+	var tl microsub.Timeline
+	before, after := globalCursor{}, globalCursor{}
+	hasBefore, hasAfter := false, false
+	for i, channel := range g.channels {
+		start, end := rest[i], rest[i]
+		if len(lists[i]) > 0 {
+			start = lists[i][0].position
+		}
+		if taken[i] < len(lists[i]) {
+			end = lists[i][taken[i]].position
+		}
+		before[channel], after[channel] = start, end
+		hasBefore = hasBefore || start.After != "" || start.Skip > 0
+		hasAfter = hasAfter || end.UID != ""
+	}
+	if hasBefore && len(merged) > 0 {
+		tl.Paging.Before = before.String()
+	}
+	if hasAfter {
+		tl.Paging.After = after.String()
+	}
+	tl.Items = g.page(merged)
+	return tl, nil
+}
+
+// itemsBefore returns the page of merged items right before the cursor in
+// options.Before, newest first
+func (g *globalTimeline) itemsBefore(ctx context.Context, options microsub.TimelineOptions, limit int) (microsub.Timeline, error) {
+	to, err := parseGlobalCursor(options.Before)
+	if err != nil {
+		return microsub.Timeline{}, err
+	}
+
+	lists := make([][]entry, len(g.timelines))
+	more := make([]bool, len(g.timelines))
+	for i, tl := range g.timelines {
+		lists[i], more[i], err = readBefore(ctx, tl, options, to[g.channels[i]], limit)
+		if err != nil {
+			return microsub.Timeline{}, err
+		}
+	}
+
+	merged := mergeEntries(lists)
+	if len(merged) > limit {
+		merged = merged[len(merged)-limit:]
+	}
+	taken := make([]int, len(g.timelines))
+	for _, e := range merged {
+		taken[e.timeline]++
+	}
+
+	var tl microsub.Timeline
+	before, after := globalCursor{}, globalCursor{}
+	hasBefore, hasAfter := false, false
+	for i, channel := range g.channels {
+		start := to[channel]
+		if taken[i] > 0 {
+			start = lists[i][len(lists[i])-taken[i]].position
+		}
+		before[channel], after[channel] = start, to[channel]
+		hasBefore = hasBefore || more[i] || taken[i] < len(lists[i])
+		hasAfter = hasAfter || to[channel].UID != ""
+	}
+	if hasBefore {
+		tl.Paging.Before = before.String()
+	}
+	if hasAfter && len(merged) > 0 {
+		tl.Paging.After = after.String()
+	}
+	tl.Items = g.page(merged)
+	return tl, nil
+}
+
+// Count returns the number of unread items in all timelines
+func (g *globalTimeline) Count(ctx context.Context) (int, error) {
+	count := 0
+	for _, tl := range g.timelines {
+		n, err := tl.Count(ctx)
+		if err != nil {
+			return -1, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// Len returns the number of items in all timelines
+func (g *globalTimeline) Len(ctx context.Context) (int, error) {
+	count := 0
+	for _, tl := range g.timelines {
+		n, err := tl.Len(ctx)
+		if err != nil {
+			return -1, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+func (g *globalTimeline) AddItem(ctx context.Context, item microsub.Item) (bool, error) {
+	return false, fmt.Errorf("items can't be added to the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+}
+
+func (g *globalTimeline) UpdateItem(ctx context.Context, item microsub.Item, markUnread bool) (bool, error) {
+	return false, fmt.Errorf("items can't be updated in the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+}
+
+func (g *globalTimeline) UpdateSources(ctx context.Context, uid string, sources []microsub.Source) error {
+	return fmt.Errorf("items can't be updated in the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+}
+
+func (g *globalTimeline) RemoveItems(ctx context.Context, uids []string) error {
+	return fmt.Errorf("items can't be removed from the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+}
+
+// foundUIDs returns the uids of the items that are in the timeline
+func foundUIDs(ctx context.Context, tl Backend, uids []string) ([]string, error) {
+	items, err := tl.ItemsByUID(ctx, uids)
+	if errors.Is(err, microsub.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, item := range items {
+		found = append(found, item.ID)
+	}
+	return found, nil
+}
+
+// MarkRead marks the items as read in the timelines that contain them
+func (g *globalTimeline) MarkRead(ctx context.Context, uids []string) error {
+	for _, tl := range g.timelines {
+		found, err := foundUIDs(ctx, tl, uids)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			continue
+		}
+		if err = tl.MarkRead(ctx, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkUnread marks the items as unread in the timelines that contain them
+func (g *globalTimeline) MarkUnread(ctx context.Context, uids []string) error {
+	for _, tl := range g.timelines {
+		found, err := foundUIDs(ctx, tl, uids)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			continue
+		}
+		if err = tl.MarkUnread(ctx, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Star stars the items in the timelines that contain them
+func (g *globalTimeline) Star(ctx context.Context, uids []string) error {
+	for _, tl := range g.timelines {
+		found, err := foundUIDs(ctx, tl, uids)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			continue
+		}
+		if err = tl.Star(ctx, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unstar unstars the items in the timelines that contain them
+func (g *globalTimeline) Unstar(ctx context.Context, uids []string) error {
+	for _, tl := range g.timelines {
+		found, err := foundUIDs(ctx, tl, uids)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			continue
+		}
+		if err = tl.Unstar(ctx, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newestUntil returns the uid of the newest item in the timeline that was
+// published at or before until, or "" when there is none
+func newestUntil(ctx context.Context, tl Backend, until time.Time) (string, error) {
+	options := microsub.TimelineOptions{Limit: MaxLimit}
+	for {
+		page, err := tl.Items(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		for _, item := range page.Items {
+			if !published(item).After(until) {
+				return item.ID, nil
+			}
+		}
+		if page.Paging.After == "" || page.Paging.After == options.After {
+			return "", nil
+		}
+		options.After = page.Paging.After
+	}
+}
+
+// MarkReadUntil marks the item with uid and the items of all timelines
+// published before it as read
+func (g *globalTimeline) MarkReadUntil(ctx context.Context, uid string) error {
+	items, err := g.ItemsByUID(ctx, []string{uid})
+	if err != nil {
+		return err
+	}
+	until := published(items[0])
+
+	for _, tl := range g.timelines {
+		found, err := foundUIDs(ctx, tl, []string{uid})
+		if err != nil {
+			return err
+		}
+		last := uid
+		if len(found) == 0 {
+			last, err = newestUntil(ctx, tl, until)
+			if err != nil {
+				return err
+			}
+		}
+		if last == "" {
+			continue
+		}
+		if err = tl.MarkReadUntil(ctx, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ItemsByUID returns the items with the uids from all timelines
+func (g *globalTimeline) ItemsByUID(ctx context.Context, uids []string) ([]microsub.Item, error) {
+	found := make(map[string]microsub.Item)
+	for i, tl := range g.timelines {
+		items, err := tl.ItemsByUID(ctx, uids)
+		if errors.Is(err, microsub.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if _, e := found[item.ID]; e {
+				continue
+			}
+			if item.Channel == "" {
+				item.Channel = g.channels[i]
+			}
+			found[item.ID] = item
+		}
+	}
+
+	var items []microsub.Item
+	for _, uid := range uids {
+		if item, e := found[uid]; e {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 && len(uids) > 0 {
+		return nil, ErrItemNotFound
+	}
+	return items, nil
+}
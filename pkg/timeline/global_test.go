@@ -0,0 +1,250 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package timeline_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/timeline"
+	"github.com/pstuifzand/ekster/pkg/timeline/timelinetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// sliceTimeline keeps the items in memory, newest first. The paging cursors
+// are uids. Pages have at most pageSize items, when it is set.
+type sliceTimeline struct {
+	items    []microsub.Item
+	pageSize int
+}
+
+func (tl *sliceTimeline) index(uid string) int {
+	for i, item := range tl.items {
+		if item.ID == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (tl *sliceTimeline) Items(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error) {
+	limit := timeline.PageLimit(options)
+	if tl.pageSize > 0 && limit > tl.pageSize {
+		limit = tl.pageSize
+	}
+
+	var all []microsub.Item
+	first, last := 0, -1
+	for i, item := range tl.items {
+		if options.IsRead != nil && item.Read != *options.IsRead {
+			continue
+		}
+		if options.After != "" && i <= tl.index(options.After) {
+			first = len(all) + 1
+		}
+		if options.Before != "" && i < tl.index(options.Before) {
+			last = len(all)
+		}
+		all = append(all, item)
+	}
+	if options.After != "" && tl.index(options.After) < 0 || options.Before != "" && tl.index(options.Before) < 0 {
+		return microsub.Timeline{}, microsub.ErrInvalidRequest
+	}
+
+	if options.Before != "" {
+		first = last + 1 - limit
+		if first < 0 {
+			first = 0
+		}
+		last++
+	} else {
+		last = first + limit
+		if last > len(all) {
+			last = len(all)
+		}
+	}
+
+	var page microsub.Timeline
+	page.Items = append([]microsub.Item{}, all[first:last]...)
+	if len(page.Items) > 0 && first > 0 {
+		page.Paging.Before = page.Items[0].ID
+	}
+	if len(page.Items) > 0 && last < len(all) {
+		page.Paging.After = page.Items[len(page.Items)-1].ID
+	}
+	return page, nil
+}
+
+func (tl *sliceTimeline) Count(ctx context.Context) (int, error) {
+	count := 0
+	for _, item := range tl.items {
+		if !item.Read {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (tl *sliceTimeline) Len(ctx context.Context) (int, error) {
+	return len(tl.items), nil
+}
+
+func (tl *sliceTimeline) AddItem(ctx context.Context, item microsub.Item) (bool, error) {
+	if tl.index(item.ID) >= 0 {
+		return false, nil
+	}
+	i := 0
+	for i < len(tl.items) && tl.items[i].Published >= item.Published {
+		i++
+	}
+	tl.items = append(tl.items[:i], append([]microsub.Item{item}, tl.items[i:]...)...)
+	return true, nil
+}
+
+// content returns the item without the fields that are not part of the content
+func content(item microsub.Item) microsub.Item {
+	item.Read = false
+	item.Starred = false
+	item.Source = nil
+	item.Sources = nil
+	item.Channel = ""
+	return item
+}
+
+func (tl *sliceTimeline) UpdateItem(ctx context.Context, item microsub.Item, markUnread bool) (bool, error) {
+	i := tl.index(item.ID)
+	if i < 0 || reflect.DeepEqual(content(tl.items[i]), content(item)) {
+		return false, nil
+	}
+	item.Read = tl.items[i].Read && !markUnread
+	item.Starred = tl.items[i].Starred
+	tl.items[i] = item
+	return true, nil
+}
+
+func (tl *sliceTimeline) UpdateSources(ctx context.Context, uid string, sources []microsub.Source) error {
+	i := tl.index(uid)
+	if i < 0 {
+		return timeline.ErrItemNotFound
+	}
+	tl.items[i].Sources = sources
+	return nil
+}
+
+func (tl *sliceTimeline) mark(uids []string, read bool) {
+	for _, uid := range uids {
+		if i := tl.index(uid); i >= 0 {
+			tl.items[i].Read = read
+		}
+	}
+}
+
+func (tl *sliceTimeline) MarkRead(ctx context.Context, uids []string) error {
+	tl.mark(uids, true)
+	return nil
+}
+
+func (tl *sliceTimeline) MarkUnread(ctx context.Context, uids []string) error {
+	tl.mark(uids, false)
+	return nil
+}
+
+func (tl *sliceTimeline) star(uids []string, starred bool) {
+	for _, uid := range uids {
+		if i := tl.index(uid); i >= 0 {
+			tl.items[i].Starred = starred
+		}
+	}
+}
+
+func (tl *sliceTimeline) Star(ctx context.Context, uids []string) error {
+	tl.star(uids, true)
+	return nil
+}
+
+func (tl *sliceTimeline) Unstar(ctx context.Context, uids []string) error {
+	tl.star(uids, false)
+	return nil
+}
+
+func (tl *sliceTimeline) MarkReadUntil(ctx context.Context, uid string) error {
+	i := tl.index(uid)
+	if i < 0 {
+		return timeline.ErrItemNotFound
+	}
+	for ; i < len(tl.items); i++ {
+		tl.items[i].Read = true
+	}
+	return nil
+}
+
+func (tl *sliceTimeline) ItemsByUID(ctx context.Context, uids []string) ([]microsub.Item, error) {
+	var items []microsub.Item
+	for _, uid := range uids {
+		if i := tl.index(uid); i >= 0 {
+			items = append(items, tl.items[i])
+		}
+	}
+	if len(items) == 0 && len(uids) > 0 {
+		return nil, timeline.ErrItemNotFound
+	}
+	return items, nil
+}
+
+func (tl *sliceTimeline) RemoveItems(ctx context.Context, uids []string) error {
+	for _, uid := range uids {
+		if i := tl.index(uid); i >= 0 {
+			tl.items = append(tl.items[:i], tl.items[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func TestSliceTimeline(t *testing.T) {
+	timelinetest.Run(t, func(t *testing.T) (timeline.Backend, string) {
+		return &sliceTimeline{}, ""
+	}, timelinetest.Options{})
+}
+
+func TestMerge(t *testing.T) {
+	timelinetest.RunGlobal(t, func(t *testing.T) (timeline.Backend, []timeline.Backend, string) {
+		// timelines with small pages are read in more pages
+		channels := []timeline.Backend{&sliceTimeline{pageSize: 1}, &sliceTimeline{pageSize: 2}, &sliceTimeline{}}
+		global := timeline.Merge(map[string]timeline.Backend{"a": channels[0], "b": channels[1], "c": channels[2]})
+		return global, channels, ""
+	})
+}
+
+func TestMerge_Channel(t *testing.T) {
+	ctx := context.Background()
+	channel := &sliceTimeline{}
+	_, _ = channel.AddItem(ctx, microsub.Item{ID: "item-1", Published: "2022-01-01T12:00:00Z"})
+	global := timeline.Merge(map[string]timeline.Backend{"first": channel, "second": &sliceTimeline{}})
+
+	page, err := global.Items(ctx, microsub.TimelineOptions{})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "first", page.Items[0].Channel)
+	}
+
+	_, err = global.Items(ctx, microsub.TimelineOptions{After: "not a cursor"})
+	assert.True(t, errors.Is(err, microsub.ErrInvalidRequest))
+}
@@ -19,13 +19,24 @@
 package timeline
 
 import (
-	"errors"
+	"context"
+	"fmt"
 
 	"github.com/pstuifzand/ekster/pkg/microsub"
 )
 
 // ErrItemNotFound is an error for when an item is not found
-var ErrItemNotFound = errors.New("Item not found")
+var ErrItemNotFound = fmt.Errorf("item: %w", microsub.ErrNotFound)
+
+func init() {
+	Register("null", func(ctx context.Context, options Options) (Backend, error) {
+		if err := checkOwner(ctx, options); err != nil {
+			return nil, err
+		}
+		timeline := &nullTimeline{channel: options.Channel}
+		return timeline, timeline.Init()
+	})
+}
 
 type nullTimeline struct {
 	channel string
@@ -35,21 +46,54 @@ func (timeline *nullTimeline) Init() error {
 	return nil
 }
 
-func (timeline *nullTimeline) Items(before, after string) (microsub.Timeline, error) {
+func (timeline *nullTimeline) Items(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error) {
 	return microsub.Timeline{Items: []microsub.Item{}}, nil
 }
 
-func (timeline *nullTimeline) AddItem(item microsub.Item) (bool, error) {
+func (timeline *nullTimeline) AddItem(ctx context.Context, item microsub.Item) (bool, error) {
 	return false, nil
 }
 
-func (timeline *nullTimeline) Count() (int, error) {
+func (timeline *nullTimeline) Count(ctx context.Context) (int, error) {
 	return 0, nil
 }
 
-func (timeline *nullTimeline) MarkRead(uids []string) error {
+func (timeline *nullTimeline) Len(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (timeline *nullTimeline) MarkRead(ctx context.Context, uids []string) error {
+	return nil
+}
+
+func (timeline *nullTimeline) Star(ctx context.Context, uids []string) error {
+	return nil
+}
+
+func (timeline *nullTimeline) Unstar(ctx context.Context, uids []string) error {
+	return nil
+}
+
+func (timeline *nullTimeline) MarkUnread(ctx context.Context, uids []string) error {
+	return nil
+}
+
+func (timeline *nullTimeline) MarkReadUntil(ctx context.Context, uid string) error {
 	return nil
 }
-func (timeline *nullTimeline) ItemsByUID(uid []string) ([]microsub.Item, error) {
+
+func (timeline *nullTimeline) ItemsByUID(ctx context.Context, uid []string) ([]microsub.Item, error) {
 	return nil, ErrItemNotFound
 }
+
+func (timeline *nullTimeline) RemoveItems(ctx context.Context, uids []string) error {
+	return nil
+}
+
+func (timeline *nullTimeline) UpdateItem(ctx context.Context, item microsub.Item, markUnread bool) (bool, error) {
+	return false, nil
+}
+
+func (timeline *nullTimeline) UpdateSources(ctx context.Context, uid string, sources []microsub.Source) error {
+	return ErrItemNotFound
+}
@@ -22,7 +22,9 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
@@ -35,15 +37,28 @@ import (
 	"github.com/lib/pq"
 )
 
+func init() {
+	Register("postgres-stream", func(ctx context.Context, options Options) (Backend, error) {
+		if options.DB == nil {
+			return nil, fmt.Errorf("postgres-stream needs a database")
+		}
+		timeline := &postgresStream{database: options.DB, channel: options.Channel, userID: options.UserID}
+		return timeline, timeline.Init(ctx)
+	})
+}
+
 type postgresStream struct {
 	database  *sql.DB
 	channel   string
 	channelID int
+
+	// userID is the owner of the channel, when it is set the channel must belong
+	// to this user. The GlobalChannel contains the items of all channels of the user.
+	userID int
 }
 
 // Init
-func (p *postgresStream) Init() error {
-	ctx := context.Background()
+func (p *postgresStream) Init(ctx context.Context) error {
 	conn, err := p.database.Conn(ctx)
 	if err != nil {
 		return err
@@ -54,80 +69,181 @@ func (p *postgresStream) Init() error {
 		return fmt.Errorf("database ping failed: %w", err)
 	}
 
-	row := conn.QueryRowContext(ctx, `SELECT "id" FROM "channels" WHERE "uid" = $1`, p.channel)
+	if p.channel == GlobalChannel {
+		return nil
+	}
+
+	row := conn.QueryRowContext(ctx, `SELECT "id" FROM "channels" WHERE "uid" = $1 AND ($2 = 0 OR "user_id" = $2)`, p.channel, p.userID)
 	err = row.Scan(&p.channelID)
-	// if err == sql.ErrNoRows {
-	// 	return fmt.Errorf("channel %s not found: %w", p.channel, err)
-	// }
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("channel %s not found: %w", p.channel, microsub.ErrNotFound)
+	} else if err != nil {
+		return err
+	}
 
 	return nil
 }
 
-// Items
-func (p *postgresStream) Items(before, after string) (microsub.Timeline, error) {
-	ctx := context.Background()
+// itemsFilter builds the WHERE clause for a query on items
+type itemsFilter struct {
+	conds []string
+	args  []interface{}
+}
+
+// add adds a condition, each %d in cond is replaced with the placeholder for the matching arg.
+// The slices are copied, so copies of a filter can be extended independently.
+func (f *itemsFilter) add(cond string, args ...interface{}) {
+	placeholders := make([]interface{}, len(args))
+	for i := range args {
+		placeholders[i] = len(f.args) + i + 1
+	}
+	f.args = append(f.args[:len(f.args):len(f.args)], args...)
+	f.conds = append(f.conds[:len(f.conds):len(f.conds)], fmt.Sprintf(cond, placeholders...))
+}
+
+// addCursor adds a condition that compares the position of items with the cursor
+func (f *itemsFilter) addCursor(op string, c cursor) {
+	f.add(`("published_at", "id") `+op+` ($%d, $%d)`, c.publishedAt, c.id)
+}
+
+func (f itemsFilter) where() string {
+	return strings.Join(f.conds, " AND ")
+}
+
+// channelFilter returns a filter for the items in the timeline
+func (p *postgresStream) channelFilter() itemsFilter {
+	var f itemsFilter
+	if p.channel == GlobalChannel {
+		f.add(`"channel_id" IN (SELECT "id" FROM "channels" WHERE "user_id" = $%d)`, p.userID)
+	} else {
+		f.add(`"channel_id" = $%d`, p.channelID)
+	}
+	return f
+}
+
+func newItemsFilter(f itemsFilter, options microsub.TimelineOptions) (itemsFilter, error) {
+	if options.Source != "" {
+		feedID, err := strconv.ParseInt(options.Source, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid source %q: %w", options.Source, microsub.ErrInvalidRequest)
+		}
+		f.add(`"feed_id" = $%d`, feedID)
+	}
+	if options.IsRead != nil {
+		isRead := 0
+		if *options.IsRead {
+			isRead = 1
+		}
+		f.add(`"is_read" = $%d`, isRead)
+	}
+	return f, nil
+}
+
+// cursor is the position of an item in a timeline. Items are ordered by
+// published_at and id, so items with the same published_at have a stable order.
+type cursor struct {
+	publishedAt time.Time
+	id          int
+}
+
+// String returns the opaque form of the cursor that is used for paging
+func (c cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.publishedAt.UnixNano(), c.id)))
+}
+
+// parseCursor parses a cursor that was returned by cursor.String
+func parseCursor(s string) (cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor %q: %w", s, microsub.ErrInvalidRequest)
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return cursor{}, fmt.Errorf("invalid cursor %q: %w", s, microsub.ErrInvalidRequest)
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor %q: %w", s, microsub.ErrInvalidRequest)
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor %q: %w", s, microsub.ErrInvalidRequest)
+	}
+	return cursor{publishedAt: time.Unix(0, ns).UTC(), id: id}, nil
+}
+
+// Items returns a page of items, newest first. The paging cursors of the
+// timeline point to the first and last item of the page.
+func (p *postgresStream) Items(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error) {
 	conn, err := p.database.Conn(ctx)
 	if err != nil {
 		return microsub.Timeline{}, err
 	}
 	defer conn.Close()
 
-	var args []interface{}
-	args = append(args, p.channelID)
-	var qb strings.Builder
-	qb.WriteString(`
-SELECT "id", "uid", "data", "created_at", "is_read", "published_at"
-FROM "items"
-WHERE "channel_id" = $1
-`)
-	if before != "" {
-		b, err := time.Parse(time.RFC3339, before)
+	filter, err := newItemsFilter(p.channelFilter(), options)
+	if err != nil {
+		return microsub.Timeline{}, err
+	}
+	query := filter
+
+	// Newer items are before the cursor, they are selected in ascending
+	// order so the page starts right at the cursor
+	order := `"published_at" DESC, "id" DESC`
+	reverse := false
+	if options.Before != "" {
+		c, err := parseCursor(options.Before)
 		if err != nil {
-			log.Println(err)
-		} else {
-			args = append(args, b)
-			qb.WriteString(` AND "published_at" > $2`)
+			return microsub.Timeline{}, err
 		}
-	} else if after != "" {
-		b, err := time.Parse(time.RFC3339, after)
-		if err == nil {
-			args = append(args, b)
-			qb.WriteString(` AND "published_at" < $2`)
+		query.addCursor(">", c)
+		order = `"published_at" ASC, "id" ASC`
+		reverse = true
+	} else if options.After != "" {
+		c, err := parseCursor(options.After)
+		if err != nil {
+			return microsub.Timeline{}, err
 		}
+		query.addCursor("<", c)
 	}
-	qb.WriteString(` ORDER BY "published_at" DESC LIMIT 20`)
 
-	rows, err := conn.QueryContext(context.Background(), qb.String(), args...)
+	args := append(query.args[:len(query.args):len(query.args)], PageLimit(options))
+
+	rows, err := conn.QueryContext(ctx, `
+SELECT "id", "uid", "data", "created_at", "is_read", "is_starred", "published_at",
+       (SELECT "uid" FROM "channels" WHERE "channels"."id" = "items"."channel_id")
+FROM "items"
+WHERE `+query.where()+`
+ORDER BY `+order+fmt.Sprintf(` LIMIT $%d`, len(args)), args...)
 	if err != nil {
 		return microsub.Timeline{}, fmt.Errorf("while query: %w", err)
 	}
 
 	var tl microsub.Timeline
-
-	var first, last string
+	var cursors []cursor
 
 	for rows.Next() {
 		var id int
 		var uid string
 		var item microsub.Item
 		var createdAt time.Time
-		var isRead int
-		var publishedAt string
+		var isRead, isStarred int
+		var publishedAt time.Time
+		var channel string
 
-		err = rows.Scan(&id, &uid, &item, &createdAt, &isRead, &publishedAt)
+		err = rows.Scan(&id, &uid, &item, &createdAt, &isRead, &isStarred, &publishedAt, &channel)
 		if err != nil {
 			break
 		}
-		if first == "" {
-			first = publishedAt
-		}
-		last = publishedAt
 
 		item.Read = isRead == 1
+		item.Starred = isStarred == 1
 		item.ID = uid
-		item.Published = publishedAt
+		item.Published = publishedAt.Format(time.RFC3339Nano)
+		item.Channel = channel
 
 		tl.Items = append(tl.Items, item)
+		cursors = append(cursors, cursor{publishedAt: publishedAt, id: id})
 	}
 	if closeErr := rows.Close(); closeErr != nil {
 		return tl, err
@@ -139,11 +255,21 @@ WHERE "channel_id" = $1
 		return tl, err
 	}
 
-	if len(tl.Items) > 0 && hasMoreBefore(conn, tl.Items[0].Published) {
-		tl.Paging.Before = tl.Items[0].Published
+	if reverse {
+		for i, j := 0, len(tl.Items)-1; i < j; i, j = i+1, j-1 {
+			tl.Items[i], tl.Items[j] = tl.Items[j], tl.Items[i]
+			cursors[i], cursors[j] = cursors[j], cursors[i]
+		}
 	}
-	if hasMoreAfter(conn, last) {
-		tl.Paging.After = last
+
+	if len(cursors) > 0 {
+		first, last := cursors[0], cursors[len(cursors)-1]
+		if hasMoreBefore(ctx, conn, filter, first) {
+			tl.Paging.Before = first.String()
+		}
+		if hasMoreAfter(ctx, conn, filter, last) {
+			tl.Paging.After = last.String()
+		}
 	}
 
 	if tl.Items == nil {
@@ -153,44 +279,74 @@ WHERE "channel_id" = $1
 	return tl, nil
 }
 
-func hasMoreBefore(conn *sql.Conn, before string) bool {
-	row := conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM "items" WHERE "published_at" > $1`, before)
-	var count int
-	if err := row.Scan(&count); err == sql.ErrNoRows {
+// hasMoreBefore returns true when there are newer items than the item at the cursor
+func hasMoreBefore(ctx context.Context, conn *sql.Conn, filter itemsFilter, before cursor) bool {
+	filter.addCursor(">", before)
+	return hasItems(ctx, conn, filter)
+}
+
+// hasMoreAfter returns true when there are older items than the item at the cursor
+func hasMoreAfter(ctx context.Context, conn *sql.Conn, filter itemsFilter, after cursor) bool {
+	filter.addCursor("<", after)
+	return hasItems(ctx, conn, filter)
+}
+
+func hasItems(ctx context.Context, conn *sql.Conn, filter itemsFilter) bool {
+	row := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM "items" WHERE `+filter.where()+`)`, filter.args...)
+	var exists bool
+	if err := row.Scan(&exists); err != nil {
 		return false
 	}
-	return count > 0
+	return exists
 }
 
-func hasMoreAfter(conn *sql.Conn, after string) bool {
-	row := conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM "items" WHERE "published_at" < $1`, after)
+// Count
+func (p *postgresStream) Count(ctx context.Context) (int, error) {
+	conn, err := p.database.Conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
 	var count int
-	if err := row.Scan(&count); err == sql.ErrNoRows {
-		return false
+	filter := p.channelFilter()
+	filter.add(`"is_read" = $%d`, 0)
+	row := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM items WHERE `+filter.where(), filter.args...)
+	err = row.Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return -1, err
 	}
-	return count > 0
+	return count, nil
 }
 
-// Count
-func (p *postgresStream) Count() (int, error) {
-	ctx := context.Background()
+// Len returns the number of items, read and unread
+func (p *postgresStream) Len(ctx context.Context) (int, error) {
 	conn, err := p.database.Conn(ctx)
 	if err != nil {
 		return -1, err
 	}
 	defer conn.Close()
 	var count int
-	row := conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM items WHERE channel_id = $1 AND "is_read" = 0`, p.channelID)
+	filter := p.channelFilter()
+	row := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM items WHERE `+filter.where(), filter.args...)
 	err = row.Scan(&count)
-	if err != nil && err == sql.ErrNoRows {
+	if err == sql.ErrNoRows {
 		return 0, nil
 	}
+	if err != nil {
+		return -1, err
+	}
 	return count, nil
 }
 
 // AddItem
-func (p *postgresStream) AddItem(item microsub.Item) (bool, error) {
-	ctx := context.Background()
+func (p *postgresStream) AddItem(ctx context.Context, item microsub.Item) (bool, error) {
+	if p.channel == GlobalChannel {
+		return false, fmt.Errorf("items can't be added to the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+	}
+
 	conn, err := p.database.Conn(ctx)
 	if err != nil {
 		return false, err
@@ -206,9 +362,7 @@ func (p *postgresStream) AddItem(item microsub.Item) (bool, error) {
 		t = t2
 	}
 	if item.ID == "" {
-		// FIXME: This won't work when we receive the item multiple times
-		h := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", p.channel, time.Now().UnixNano())))
-		item.UID = hex.EncodeToString(h[:])
+		item.ID = newItemID(p.channel)
 	}
 
 	var optFeedID sql.NullInt64
@@ -226,11 +380,16 @@ func (p *postgresStream) AddItem(item microsub.Item) (bool, error) {
 		}
 	}
 
-	result, err := conn.ExecContext(context.Background(), `
-INSERT INTO "items" ("channel_id", "feed_id", "uid", "data", "published_at", "created_at")
-VALUES ($1, $2, $3, $4, $5, DEFAULT)
-ON CONFLICT ON CONSTRAINT "items_uid_key" DO NOTHING
-`, p.channelID, optFeedID, item.ID, &item, t)
+	hash, err := contentHash(item)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := conn.ExecContext(ctx, `
+INSERT INTO "items" ("channel_id", "feed_id", "uid", "data", "published_at", "content_hash", "created_at")
+VALUES ($1, $2, $3, $4, $5, $6, DEFAULT)
+ON CONFLICT ON CONSTRAINT "items_channel_id_uid_key" DO NOTHING
+`, p.channelID, optFeedID, item.ID, &item, t, hash)
 	if err != nil {
 		return false, fmt.Errorf("insert item: %w", err)
 	}
@@ -242,51 +401,300 @@ ON CONFLICT ON CONSTRAINT "items_uid_key" DO NOTHING
 	return c > 0, nil
 }
 
+// UpdateItem replaces the data of the item when its content hash changed.
+// Items that were stored without a hash get one, but are not reported as
+// updated, because it's unknown if their content changed.
+func (p *postgresStream) UpdateItem(ctx context.Context, item microsub.Item, markUnread bool) (bool, error) {
+	if p.channel == GlobalChannel {
+		return false, fmt.Errorf("items can't be updated in the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+	}
+	if item.ID == "" {
+		return false, nil
+	}
+
+	hash, err := contentHash(item)
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := p.database.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	filter := p.channelFilter()
+	filter.add(`"uid" = $%d`, item.ID)
+	n := len(filter.args)
+	args := append(filter.args, &item, hash, markUnread)
+
+	var oldHash string
+	err = conn.QueryRowContext(ctx, fmt.Sprintf(`
+WITH "old" AS (
+    SELECT "id", "content_hash" FROM "items" WHERE %s FOR UPDATE
+)
+UPDATE "items" AS "i"
+SET "data" = $%d, "content_hash" = $%d, "updated_at" = now(),
+    "is_read" = CASE WHEN $%d AND "old"."content_hash" <> '' THEN 0 ELSE "i"."is_read" END
+FROM "old"
+WHERE "i"."id" = "old"."id" AND "old"."content_hash" <> $%d
+RETURNING "old"."content_hash"
+`, filter.where(), n+1, n+2, n+3, n+2), args...).Scan(&oldHash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("update item: %w", err)
+	}
+
+	return oldHash != "", nil
+}
+
+// UpdateSources replaces the "_sources" of the stored item
+func (p *postgresStream) UpdateSources(ctx context.Context, uid string, sources []microsub.Source) error {
+	if p.channel == GlobalChannel {
+		return fmt.Errorf("items can't be updated in the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+	}
+	if sources == nil {
+		sources = []microsub.Source{}
+	}
+	data, err := json.Marshal(sources)
+	if err != nil {
+		return fmt.Errorf("while encoding sources: %w", err)
+	}
+
+	filter := p.channelFilter()
+	filter.add(`"uid" = $%d`, uid)
+	n := len(filter.args)
+	args := append(filter.args, string(data))
+
+	result, err := p.database.ExecContext(ctx, fmt.Sprintf(`
+UPDATE "items"
+SET "data" = jsonb_set("data", '{_sources}', $%d::jsonb), "updated_at" = now()
+WHERE %s
+`, n+1, filter.where()), args...)
+	if err != nil {
+		return fmt.Errorf("update sources: %w", err)
+	}
+	c, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if c == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+// contentHash returns the hash of the content of the item, without the fields
+// that are set by the server. The sources are not part of the content, an
+// item that was merged from another feed is not changed.
+func contentHash(item microsub.Item) (string, error) {
+	item.ID = ""
+	item.Read = false
+	item.Starred = false
+	item.Source = nil
+	item.Sources = nil
+	item.Channel = ""
+	data, err := json.Marshal(item)
+	if err != nil {
+		return "", fmt.Errorf("while hashing item: %w", err)
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
 // MarkRead
-func (p *postgresStream) MarkRead(uids []string) error {
-	ctx := context.Background()
+func (p *postgresStream) MarkRead(ctx context.Context, uids []string) error {
+	conn, err := p.database.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+	filter := p.channelFilter()
+	filter.add(`"uid" = ANY($%d)`, pq.Array(uids))
+	_, err = conn.ExecContext(ctx, `UPDATE "items" SET is_read = 1 WHERE `+filter.where(), filter.args...)
+	if err != nil {
+		return fmt.Errorf("while marking as read: %w", err)
+	}
+	return nil
+}
+
+// MarkUnread
+func (p *postgresStream) MarkUnread(ctx context.Context, uids []string) error {
+	conn, err := p.database.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+	filter := p.channelFilter()
+	filter.add(`"uid" = ANY($%d)`, pq.Array(uids))
+	_, err = conn.ExecContext(ctx, `UPDATE "items" SET is_read = 0 WHERE `+filter.where(), filter.args...)
+	if err != nil {
+		return fmt.Errorf("while marking as unread: %w", err)
+	}
+	return nil
+}
+
+// Star
+func (p *postgresStream) Star(ctx context.Context, uids []string) error {
+	return p.setStarred(ctx, uids, 1)
+}
+
+// Unstar
+func (p *postgresStream) Unstar(ctx context.Context, uids []string) error {
+	return p.setStarred(ctx, uids, 0)
+}
+
+func (p *postgresStream) setStarred(ctx context.Context, uids []string, starred int) error {
+	conn, err := p.database.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+	filter := p.channelFilter()
+	filter.add(`"uid" = ANY($%d)`, pq.Array(uids))
+	args := append(filter.args, starred)
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`UPDATE "items" SET is_starred = $%d WHERE `, len(args))+filter.where(), args...)
+	if err != nil {
+		return fmt.Errorf("while starring: %w", err)
+	}
+	return nil
+}
+
+// MarkReadUntil
+func (p *postgresStream) MarkReadUntil(ctx context.Context, uid string) error {
 	conn, err := p.database.Conn(ctx)
 	if err != nil {
 		return fmt.Errorf("getting connection: %w", err)
 	}
 	defer conn.Close()
-	_, err = conn.ExecContext(context.Background(), `UPDATE "items" SET is_read = 1 WHERE "uid" = ANY($1)`, pq.Array(uids))
+
+	var last cursor
+	filter := p.channelFilter()
+	entry := filter
+	entry.add(`"uid" = $%d`, uid)
+	row := conn.QueryRowContext(ctx, `SELECT "published_at", "id" FROM "items" WHERE `+entry.where(), entry.args...)
+	err = row.Scan(&last.publishedAt, &last.id)
+	if err == sql.ErrNoRows {
+		return ErrItemNotFound
+	} else if err != nil {
+		return fmt.Errorf("while finding last read entry: %w", err)
+	}
+
+	filter.add(`"is_read" = $%d`, 0)
+	filter.addCursor("<=", last)
+	_, err = conn.ExecContext(ctx, `UPDATE "items" SET is_read = 1 WHERE `+filter.where(), filter.args...)
 	if err != nil {
 		return fmt.Errorf("while marking as read: %w", err)
 	}
 	return nil
 }
 
-// Item returns the item with id for this channel
-func (p *postgresStream) ItemsByUID(uids []string) ([]microsub.Item, error) {
+// RemoveItems removes the items from this channel
+func (p *postgresStream) RemoveItems(ctx context.Context, uids []string) error {
+	conn, err := p.database.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+	filter := p.channelFilter()
+	filter.add(`"uid" = ANY($%d)`, pq.Array(uids))
+	_, err = conn.ExecContext(ctx, `DELETE FROM "items" WHERE `+filter.where(), filter.args...)
+	if err != nil {
+		return fmt.Errorf("while removing items: %w", err)
+	}
+	return nil
+}
+
+// expired finds the expired items with one query, the oldest items first
+func (p *postgresStream) expired(ctx context.Context, policy Retention, now time.Time, limit int) ([]string, error) {
+	if p.channel == GlobalChannel {
+		return nil, fmt.Errorf("items can't be removed from the %s channel: %w", GlobalChannel, microsub.ErrInvalidRequest)
+	}
+
+	filter := p.channelFilter()
+
+	// the conditions of the outer query use the placeholders after the filter
+	expire := itemsFilter{args: filter.args}
+	if policy.MaxItems > 0 {
+		expire.add(`"position" > $%d`, policy.MaxItems)
+	}
+	if policy.MaxAge > 0 {
+		expire.add(`"published_at" < $%d`, now.Add(-policy.MaxAge))
+	}
+	where := "(" + strings.Join(expire.conds, " OR ") + ")"
+	if policy.KeepUnread {
+		where += ` AND "is_read" = 1`
+	}
+	if policy.KeepStarred {
+		where += ` AND "is_starred" = 0`
+	}
+	args := append(expire.args[:len(expire.args):len(expire.args)], limit)
+
+	rows, err := p.database.QueryContext(ctx, `
+SELECT "uid" FROM (
+  SELECT "uid", "is_read", "is_starred", "published_at",
+         row_number() OVER (ORDER BY "published_at" DESC, "id" DESC) AS "position"
+  FROM "items"
+  WHERE `+filter.where()+`
+) AS "timeline"
+WHERE `+where+`
+ORDER BY "position" DESC`+fmt.Sprintf(` LIMIT $%d`, len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("while finding expired items: %w", err)
+	}
+	defer rows.Close()
+
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+// ItemsByUID returns the items with the uids for this channel
+func (p *postgresStream) ItemsByUID(ctx context.Context, uids []string) ([]microsub.Item, error) {
 
 	var items []microsub.Item
 
 	for _, uid := range uids {
 		var item microsub.Item
 		var createdAt time.Time
-		var isRead int
+		var isRead, isStarred int
 		var publishedAt string
+		var channel string
 
-		row := p.database.QueryRow(`
-			SELECT  "data", "created_at", "is_read", "published_at"
+		filter := p.channelFilter()
+		filter.add(`"uid" = $%d`, uid)
+		row := p.database.QueryRowContext(ctx, `
+			SELECT  "data", "created_at", "is_read", "is_starred", "published_at",
+			        (SELECT "uid" FROM "channels" WHERE "channels"."id" = "items"."channel_id")
 			FROM "items"
-			WHERE "uid" = $1
-		`, uid)
+			WHERE `+filter.where(), filter.args...)
 
-		err := row.Scan(&item, &createdAt, &isRead, &publishedAt)
+		err := row.Scan(&item, &createdAt, &isRead, &isStarred, &publishedAt, &channel)
 		if err == sql.ErrNoRows {
-			return nil, ErrItemNotFound
+			continue
 		} else if err != nil {
 			log.Println("Scan failed", err)
 			return nil, err
 		}
 
 		item.Read = isRead == 1
+		item.Starred = isStarred == 1
 		item.ID = uid
 		item.Published = publishedAt
+		item.Channel = channel
 		items = append(items, item)
 	}
 
+	if len(items) == 0 && len(uids) > 0 {
+		return nil, ErrItemNotFound
+	}
 	return items, nil
 }
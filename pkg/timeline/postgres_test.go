@@ -0,0 +1,114 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2021 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package timeline
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	c := cursor{publishedAt: time.Date(2022, 1, 1, 12, 0, 0, 123456000, time.UTC), id: 42}
+
+	parsed, err := parseCursor(c.String())
+	if assert.NoError(t, err) {
+		assert.True(t, c.publishedAt.Equal(parsed.publishedAt))
+		assert.Equal(t, c.id, parsed.id)
+	}
+}
+
+func TestCursor_SameTimestamp(t *testing.T) {
+	published := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := cursor{publishedAt: published, id: 1}
+	b := cursor{publishedAt: published, id: 2}
+	assert.NotEqual(t, a.String(), b.String())
+}
+
+func TestParseCursor_Invalid(t *testing.T) {
+	for _, s := range []string{"", "not a cursor", "MTIz", "YWJjOjE", "MTIzOmFiYw"} {
+		_, err := parseCursor(s)
+		assert.True(t, errors.Is(err, microsub.ErrInvalidRequest), "cursor %q", s)
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	assert.Equal(t, DefaultLimit, PageLimit(microsub.TimelineOptions{}))
+	assert.Equal(t, DefaultLimit, PageLimit(microsub.TimelineOptions{Limit: -1}))
+	assert.Equal(t, 5, PageLimit(microsub.TimelineOptions{Limit: 5}))
+	assert.Equal(t, MaxLimit, PageLimit(microsub.TimelineOptions{Limit: MaxLimit + 1}))
+}
+
+func TestItemsFilter_Add(t *testing.T) {
+	var f itemsFilter
+	f.add(`"channel_id" = $%d`, 1)
+	g := f
+	g.addCursor("<", cursor{id: 2})
+	f.add(`"is_read" = $%d`, 0)
+
+	assert.Equal(t, `"channel_id" = $1 AND "is_read" = $2`, f.where())
+	assert.Equal(t, []interface{}{1, 0}, f.args)
+	assert.Equal(t, `"channel_id" = $1 AND ("published_at", "id") < ($2, $3)`, g.where())
+	assert.Len(t, g.args, 3)
+}
+
+func TestNewItemsFilter_InvalidSource(t *testing.T) {
+	_, err := newItemsFilter(itemsFilter{}, microsub.TimelineOptions{Source: "feed"})
+	assert.True(t, errors.Is(err, microsub.ErrInvalidRequest))
+}
+
+func TestPostgresStream_ChannelFilter(t *testing.T) {
+	channel := &postgresStream{channel: "0001", channelID: 1}
+	assert.Equal(t, `"channel_id" = $1`, channel.channelFilter().where())
+	assert.Equal(t, []interface{}{1}, channel.channelFilter().args)
+
+	global := &postgresStream{channel: GlobalChannel, userID: 2}
+	assert.Equal(t, `"channel_id" IN (SELECT "id" FROM "channels" WHERE "user_id" = $1)`, global.channelFilter().where())
+	assert.Equal(t, []interface{}{2}, global.channelFilter().args)
+}
+
+func TestContentHash(t *testing.T) {
+	item := microsub.Item{Type: "entry", ID: "1", Name: "Title", Content: &microsub.Content{Text: "Text"}}
+
+	hash, err := contentHash(item)
+	assert.NoError(t, err)
+
+	read := item
+	read.Read = true
+	read.Channel = "0001"
+	readHash, err := contentHash(read)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, readHash, "read state and channel are not part of the content")
+
+	merged := item
+	merged.Source = &microsub.Source{ID: "1", URL: "https://example.com/feed", Name: "Feed"}
+	merged.Sources = []microsub.Source{*merged.Source, {ID: "2", URL: "https://example.org/feed"}}
+	mergedHash, err := contentHash(merged)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, mergedHash, "sources are not part of the content, UpdateSources stores them")
+
+	changed := item
+	changed.Content = &microsub.Content{Text: "Corrected text"}
+	changedHash, err := contentHash(changed)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changedHash)
+}
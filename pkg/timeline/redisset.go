@@ -19,15 +19,30 @@
 package timeline
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/pstuifzand/ekster/pkg/microsub"
 )
 
+func init() {
+	Register("sorted-set", func(ctx context.Context, options Options) (Backend, error) {
+		if options.Pool == nil {
+			return nil, fmt.Errorf("sorted-set needs a redis pool")
+		}
+		if err := checkOwner(ctx, options); err != nil {
+			return nil, err
+		}
+		timeline := &redisSortedSetTimeline{channel: options.Channel, pool: options.Pool}
+		return timeline, timeline.Init()
+	})
+}
+
 type redisSortedSetTimeline struct {
 	channel string
 	pool    *redis.Pool
@@ -40,53 +55,67 @@ func (timeline *redisSortedSetTimeline) Init() error {
 	return nil
 }
 
-func (timeline *redisSortedSetTimeline) Items(before, after string) (microsub.Timeline, error) {
-	conn := timeline.pool.Get()
-	defer conn.Close()
-
-	items := []microsub.Item{}
+func (timeline *redisSortedSetTimeline) zchannelKey() string {
+	return fmt.Sprintf("zchannel:%s:posts", timeline.channel)
+}
 
-	channel := timeline.channel
+func (timeline *redisSortedSetTimeline) readChannelKey() string {
+	return fmt.Sprintf("channel:%s:read", timeline.channel)
+}
 
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+func (timeline *redisSortedSetTimeline) starredChannelKey() string {
+	return fmt.Sprintf("channel:%s:starred", timeline.channel)
+}
 
-	afterScore := "-inf"
-	if len(after) != 0 {
-		afterScore = "(" + after
-	}
-	beforeScore := "+inf"
-	if len(before) != 0 {
-		beforeScore = "(" + before
+// Items returns a page of unread items, newest first. The paging cursors are
+// the score and member of an item, so items published in the same second are
+// ordered by member, like Redis does.
+func (timeline *redisSortedSetTimeline) Items(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
 	}
+	defer conn.Close()
 
-	var itemJSONs [][]byte
+	items := []microsub.Item{}
 
-	itemScores, err := redis.Strings(
-		conn.Do(
-			"ZRANGEBYSCORE",
-			zchannelKey,
-			afterScore,
-			beforeScore,
-			"LIMIT",
-			0,
-			20,
-			"WITHSCORES",
-		),
-	)
+	// read items are removed from the sorted set, so only unread items are returned
+	if options.IsRead != nil && *options.IsRead {
+		return microsub.Timeline{Items: items}, nil
+	}
 
+	limit := PageLimit(options)
+
+	var itemScores []string
+	if options.Before != "" {
+		// newer items are found oldest first
+		score, member := parseSetCursor(options.Before)
+		itemScores, err = timeline.scoreRange(conn, "ZRANGEBYSCORE", score, "+inf", limit, func(s, m string) bool {
+			return s == score && (member == "" || m <= member)
+		})
+		for i, j := 0, len(itemScores)-2; i < j; i, j = i+2, j-2 {
+			itemScores[i], itemScores[i+1], itemScores[j], itemScores[j+1] = itemScores[j], itemScores[j+1], itemScores[i], itemScores[i+1]
+		}
+	} else {
+		max := "+inf"
+		skip := func(s, m string) bool { return false }
+		if options.After != "" {
+			score, member := parseSetCursor(options.After)
+			max = score
+			skip = func(s, m string) bool {
+				return s == score && (member == "" || m >= member)
+			}
+		}
+		itemScores, err = timeline.scoreRange(conn, "ZREVRANGEBYSCORE", max, "-inf", limit, skip)
+	}
 	if err != nil {
-		return microsub.Timeline{
-			Paging: microsub.Pagination{},
-			Items:  items,
-		}, err
+		return microsub.Timeline{Items: items}, err
 	}
 
+	var paging microsub.Pagination
 	if len(itemScores) >= 2 {
-		before = itemScores[1]
-		after = itemScores[len(itemScores)-1]
-	} else {
-		before = ""
-		after = ""
+		paging.Before = itemScores[1] + ":" + itemScores[0]
+		paging.After = itemScores[len(itemScores)-1] + ":" + itemScores[len(itemScores)-2]
 	}
 
 	for i := 0; i < len(itemScores); i += 2 {
@@ -96,24 +125,20 @@ func (timeline *redisSortedSetTimeline) Items(before, after string) (microsub.Ti
 			log.Println(err)
 			continue
 		}
-		itemJSONs = append(itemJSONs, itemJSON)
-	}
-
-	for _, obj := range itemJSONs {
 		item := microsub.Item{}
-		err := json.Unmarshal(obj, &item)
+		err = json.Unmarshal(itemJSON, &item)
 		if err != nil {
 			// FIXME: what should we do if one of the items doen't unmarshal?
 			log.Println(err)
 			continue
 		}
 		item.Read = false
+		item.Starred, err = redis.Bool(conn.Do("SISMEMBER", timeline.starredChannelKey(), itemID))
+		if err != nil {
+			return microsub.Timeline{Items: items}, err
+		}
 		items = append(items, item)
 	}
-	paging := microsub.Pagination{
-		After:  after,
-		Before: before,
-	}
 
 	return microsub.Timeline{
 		Paging: paging,
@@ -121,22 +146,94 @@ func (timeline *redisSortedSetTimeline) Items(before, after string) (microsub.Ti
 	}, nil
 }
 
-func (timeline *redisSortedSetTimeline) AddItem(item microsub.Item) (bool, error) {
-	conn := timeline.pool.Get()
-	defer conn.Close()
+// parseSetCursor returns the score and member of a paging cursor. Cursors
+// without a member are the score of an item.
+func parseSetCursor(cursor string) (score, member string) {
+	i := strings.Index(cursor, ":")
+	if i < 0 {
+		return cursor, ""
+	}
+	return cursor[:i], cursor[i+1:]
+}
 
-	channel := timeline.channel
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+// scoreRange returns up to limit members with their scores from the range of
+// scores. Members at the start of the range, that were on the page of the
+// cursor, are skipped.
+func (timeline *redisSortedSetTimeline) scoreRange(conn redis.Conn, command, start, stop string, limit int, skip func(score, member string) bool) ([]string, error) {
+	var itemScores []string
+	for offset := 0; ; offset += limit {
+		values, err := redis.Strings(conn.Do(command, timeline.zchannelKey(), start, stop, "WITHSCORES", "LIMIT", offset, limit))
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(values); i += 2 {
+			if skip(values[i+1], values[i]) {
+				continue
+			}
+			itemScores = append(itemScores, values[i], values[i+1])
+			if len(itemScores) == 2*limit {
+				return itemScores, nil
+			}
+		}
+		if len(values) < 2*limit {
+			return itemScores, nil
+		}
+	}
+}
 
+// normalizePublished sets the published date of the item to now when it's
+// missing, and fixes dates that almost match RFC3339, except for the colon in
+// the timezone
+func normalizePublished(item *microsub.Item) {
 	if item.Published == "" {
 		item.Published = time.Now().Format(time.RFC3339)
 	}
 
-	// Fix date when it almost matches with RFC3339, except the colon in the timezone
 	format := "2006-01-02T15:04:05Z0700"
 	if parsedDate, err := time.Parse(format, item.Published); err == nil {
 		item.Published = parsedDate.Format(time.RFC3339)
 	}
+}
+
+// inChannel returns if the item is in the channel, and if it is read
+func (timeline *redisSortedSetTimeline) inChannel(conn redis.Conn, itemKey string) (found, read bool, err error) {
+	read, err = redis.Bool(conn.Do("SISMEMBER", timeline.readChannelKey(), itemKey))
+	if err != nil {
+		return false, false, err
+	}
+	if read {
+		return true, true, nil
+	}
+	_, err = redis.Float64(conn.Do("ZSCORE", timeline.zchannelKey(), itemKey))
+	if err == redis.ErrNil {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, false, nil
+}
+
+func (timeline *redisSortedSetTimeline) AddItem(ctx context.Context, item microsub.Item) (bool, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if item.ID == "" {
+		item.ID = newItemID(timeline.channel)
+	}
+	normalizePublished(&item)
+
+	itemKey := fmt.Sprintf("item:%s", item.ID)
+	found, _, err := timeline.inChannel(conn, itemKey)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		return false, nil
+	}
 
 	data, err := json.Marshal(item)
 	if err != nil {
@@ -150,27 +247,17 @@ func (timeline *redisSortedSetTimeline) AddItem(item microsub.Item) (bool, error
 		Data:      data,
 	}
 
-	itemKey := fmt.Sprintf("item:%s", item.ID)
 	_, err = redis.String(conn.Do("HMSET", redis.Args{}.Add(itemKey).AddFlat(&forRedis)...))
 	if err != nil {
 		return false, fmt.Errorf("writing failed for item to redis: %v", err)
 	}
 
-	readChannelKey := fmt.Sprintf("channel:%s:read", channel)
-	isRead, err := redis.Bool(conn.Do("SISMEMBER", readChannelKey, itemKey))
-	if err != nil {
-		return false, err
-	}
-
-	if isRead {
-		return false, nil
-	}
-
 	score, err := time.Parse(time.RFC3339, item.Published)
 	if err != nil {
 		return false, fmt.Errorf("can't parse %s as time", item.Published)
 	}
 
+	zchannelKey := timeline.zchannelKey()
 	n, err := redis.Int64(conn.Do("ZADD", zchannelKey, score.Unix()*1.0, itemKey))
 	if err != nil {
 		return false, fmt.Errorf("zadding failed item %s to channel %s for redis: %v", itemKey, zchannelKey, err)
@@ -179,21 +266,127 @@ func (timeline *redisSortedSetTimeline) AddItem(item microsub.Item) (bool, error
 	return n == 1, nil
 }
 
-func (timeline *redisSortedSetTimeline) Count() (int, error) {
-	conn := timeline.pool.Get()
+func (timeline *redisSortedSetTimeline) Count(ctx context.Context) (int, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return -1, err
+	}
 	defer conn.Close()
 
 	channel := timeline.channel
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
-	unread, err := redis.Int(conn.Do("ZCARD", zchannelKey))
+	unread, err := redis.Int(conn.Do("ZCARD", timeline.zchannelKey()))
 	if err != nil {
 		return -1, fmt.Errorf("while updating channel unread count for %s: %s", channel, err)
 	}
 	return unread, nil
 }
 
-func (timeline *redisSortedSetTimeline) MarkRead(uids []string) error {
-	conn := timeline.pool.Get()
+// Len returns the number of items, the unread items in the sorted set and
+// the read items in the read set
+func (timeline *redisSortedSetTimeline) Len(ctx context.Context) (int, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	unread, err := redis.Int(conn.Do("ZCARD", timeline.zchannelKey()))
+	if err != nil {
+		return -1, fmt.Errorf("while counting items of channel %s: %s", timeline.channel, err)
+	}
+	read, err := redis.Int(conn.Do("SCARD", timeline.readChannelKey()))
+	if err != nil {
+		return -1, fmt.Errorf("while counting items of channel %s: %s", timeline.channel, err)
+	}
+	return unread + read, nil
+}
+
+func (timeline *redisSortedSetTimeline) ItemsByUID(ctx context.Context, uids []string) ([]microsub.Item, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var items []microsub.Item
+	for _, uid := range uids {
+		itemKey := "item:" + uid
+		found, read, err := timeline.inChannel(conn, itemKey)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+
+		data, err := redis.Bytes(conn.Do("HGET", itemKey, "Data"))
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var item microsub.Item
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, err
+		}
+		item.Read = read
+		item.Starred, err = redis.Bool(conn.Do("SISMEMBER", timeline.starredChannelKey(), itemKey))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if len(items) == 0 && len(uids) > 0 {
+		return nil, ErrItemNotFound
+	}
+	return items, nil
+}
+
+func (timeline *redisSortedSetTimeline) UpdateSources(ctx context.Context, uid string, sources []microsub.Source) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	itemKey := "item:" + uid
+	found, _, err := timeline.inChannel(conn, itemKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrItemNotFound
+	}
+
+	data, err := redis.Bytes(conn.Do("HGET", itemKey, "Data"))
+	if err == redis.ErrNil {
+		return ErrItemNotFound
+	} else if err != nil {
+		return err
+	}
+	var item microsub.Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return err
+	}
+
+	item.Sources = sources
+	data, err = json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal item for redis: %s", err)
+	}
+	if _, err := conn.Do("HSET", itemKey, "Data", data); err != nil {
+		return fmt.Errorf("updating item %s has failed: %s", itemKey, err)
+	}
+	return nil
+}
+
+func (timeline *redisSortedSetTimeline) MarkRead(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
 	channel := timeline.channel
@@ -203,14 +396,14 @@ func (timeline *redisSortedSetTimeline) MarkRead(uids []string) error {
 		itemUIDs = append(itemUIDs, "item:"+uid)
 	}
 
-	channelKey := fmt.Sprintf("channel:%s:read", channel)
+	channelKey := timeline.readChannelKey()
 	args := redis.Args{}.Add(channelKey).AddFlat(itemUIDs)
 
 	if _, err := conn.Do("SADD", args...); err != nil {
 		return fmt.Errorf("marking read for channel %s has failed: %s", channel, err)
 	}
 
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	zchannelKey := timeline.zchannelKey()
 	args = redis.Args{}.Add(zchannelKey).AddFlat(itemUIDs)
 
 	if _, err := conn.Do("ZREM", args...); err != nil {
@@ -220,6 +413,190 @@ func (timeline *redisSortedSetTimeline) MarkRead(uids []string) error {
 	return nil
 }
 
-func (timeline *redisSortedSetTimeline) MarkUnread(uids []string) error {
-	panic("implement me")
+func (timeline *redisSortedSetTimeline) RemoveItems(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channel := timeline.channel
+
+	itemUIDs := []string{}
+	for _, uid := range uids {
+		itemUIDs = append(itemUIDs, "item:"+uid)
+	}
+
+	zchannelKey := timeline.zchannelKey()
+	args := redis.Args{}.Add(zchannelKey).AddFlat(itemUIDs)
+
+	if _, err := conn.Do("ZREM", args...); err != nil {
+		return fmt.Errorf("removing items for channel %s has failed: %s", channel, err)
+	}
+
+	channelKey := timeline.readChannelKey()
+	args = redis.Args{}.Add(channelKey).AddFlat(itemUIDs)
+
+	if _, err := conn.Do("SREM", args...); err != nil {
+		return fmt.Errorf("removing items for channel %s has failed: %s", channel, err)
+	}
+
+	args = redis.Args{}.Add(timeline.starredChannelKey()).AddFlat(itemUIDs)
+	if _, err := conn.Do("SREM", args...); err != nil {
+		return fmt.Errorf("removing items for channel %s has failed: %s", channel, err)
+	}
+
+	return nil
+}
+
+// Star stars the items
+func (timeline *redisSortedSetTimeline) Star(ctx context.Context, uids []string) error {
+	return timeline.setStarred(ctx, uids, "SADD")
+}
+
+// Unstar removes the star of the items
+func (timeline *redisSortedSetTimeline) Unstar(ctx context.Context, uids []string) error {
+	return timeline.setStarred(ctx, uids, "SREM")
+}
+
+// setStarred adds the items to or removes them from the starred set with command
+func (timeline *redisSortedSetTimeline) setStarred(ctx context.Context, uids []string, command string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(timeline.starredChannelKey())
+	for _, uid := range uids {
+		args = args.Add("item:" + uid)
+	}
+	if _, err := conn.Do(command, args...); err != nil {
+		return fmt.Errorf("starring items for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+// UpdateItem replaces the data of the item. The data is shared with the
+// other channels that contain the item.
+func (timeline *redisSortedSetTimeline) UpdateItem(ctx context.Context, item microsub.Item, markUnread bool) (bool, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	itemKey := "item:" + item.ID
+	found, read, err := timeline.inChannel(conn, itemKey)
+	if err != nil || !found {
+		return false, err
+	}
+
+	data, err := redis.Bytes(conn.Do("HGET", itemKey, "Data"))
+	if err != nil {
+		return false, err
+	}
+	var stored microsub.Item
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return false, err
+	}
+
+	if item.Published == "" {
+		item.Published = stored.Published
+	}
+	normalizePublished(&item)
+
+	storedHash, err := contentHash(stored)
+	if err != nil {
+		return false, err
+	}
+	hash, err := contentHash(item)
+	if err != nil {
+		return false, err
+	}
+	if hash == storedHash {
+		return false, nil
+	}
+
+	data, err = json.Marshal(item)
+	if err != nil {
+		return false, fmt.Errorf("couldn't marshal item for redis: %s", err)
+	}
+	if _, err := conn.Do("HSET", itemKey, "Data", data); err != nil {
+		return false, fmt.Errorf("updating item %s has failed: %s", itemKey, err)
+	}
+
+	if markUnread && read {
+		return true, timeline.MarkUnread(ctx, []string{item.ID})
+	}
+	return true, nil
+}
+
+func (timeline *redisSortedSetTimeline) MarkUnread(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channel := timeline.channel
+
+	itemUIDs := []string{}
+	for _, uid := range uids {
+		itemUIDs = append(itemUIDs, "item:"+uid)
+	}
+
+	channelKey := timeline.readChannelKey()
+	args := redis.Args{}.Add(channelKey).AddFlat(itemUIDs)
+
+	if _, err := conn.Do("SREM", args...); err != nil {
+		return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+	}
+
+	zchannelKey := timeline.zchannelKey()
+	for _, itemKey := range itemUIDs {
+		published, err := redis.String(conn.Do("HGET", itemKey, "Published"))
+		if err != nil {
+			log.Printf("could not find item %s: %s", itemKey, err)
+			continue
+		}
+		score, err := time.Parse(time.RFC3339, published)
+		if err != nil {
+			return fmt.Errorf("can't parse %s as time", published)
+		}
+		if _, err := conn.Do("ZADD", zchannelKey, score.Unix()*1.0, itemKey); err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+	}
+
+	return nil
+}
+
+func (timeline *redisSortedSetTimeline) MarkReadUntil(ctx context.Context, uid string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	zchannelKey := timeline.zchannelKey()
+
+	score, err := redis.String(conn.Do("ZSCORE", zchannelKey, "item:"+uid))
+	if err == redis.ErrNil {
+		return ErrItemNotFound
+	} else if err != nil {
+		return err
+	}
+
+	itemKeys, err := redis.Strings(conn.Do("ZRANGEBYSCORE", zchannelKey, "-inf", score))
+	if err != nil {
+		return err
+	}
+
+	var uids []string
+	for _, itemKey := range itemKeys {
+		uids = append(uids, strings.TrimPrefix(itemKey, "item:"))
+	}
+
+	return timeline.MarkRead(ctx, uids)
 }
@@ -19,21 +19,46 @@
 package timeline
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/pstuifzand/ekster/pkg/microsub"
 )
 
+// maxStreamLength is the number of items that a stream keeps
+const maxStreamLength = 250
+
+func init() {
+	Register("stream", func(ctx context.Context, options Options) (Backend, error) {
+		if options.Pool == nil {
+			return nil, fmt.Errorf("stream needs a redis pool")
+		}
+		if err := checkOwner(ctx, options); err != nil {
+			return nil, err
+		}
+		timeline := &redisStreamTimeline{channel: options.Channel, pool: options.Pool}
+		return timeline, timeline.Init()
+	})
+}
+
+// redisStreamTimeline keeps the uids of the items in a stream, in the order
+// they were added. The data of the items, the stream ids of the uids and the
+// read items are kept in separate keys.
 type redisStreamTimeline struct {
 	channel, channelKey string
 
 	pool *redis.Pool
 }
 
+type streamEntry struct {
+	StreamID  string `redis:"-"`
+	ID        string `redis:"ID"`
+	Published string `redis:"Published"`
+}
+
 /*
  * REDIS STREAMS TIMELINE
  */
@@ -42,88 +67,470 @@ func (timeline *redisStreamTimeline) Init() error {
 	return nil
 }
 
-func (timeline *redisStreamTimeline) Items(before, after string) (microsub.Timeline, error) {
-	conn := timeline.pool.Get()
-	defer conn.Close()
+func (timeline *redisStreamTimeline) itemsKey() string {
+	return timeline.channelKey + ":items"
+}
+
+func (timeline *redisStreamTimeline) idsKey() string {
+	return timeline.channelKey + ":ids"
+}
+
+func (timeline *redisStreamTimeline) readKey() string {
+	return timeline.channelKey + ":read"
+}
+
+func (timeline *redisStreamTimeline) starredKey() string {
+	return timeline.channelKey + ":starred"
+}
 
-	if before == "" {
-		before = "-"
+// entries runs an XRANGE or XREVRANGE command and returns the entries
+func (timeline *redisStreamTimeline) entries(conn redis.Conn, command string, args ...interface{}) ([]streamEntry, error) {
+	results, err := redis.Values(conn.Do(command, redis.Args{}.Add(timeline.channelKey).Add(args...)...))
+	if err != nil {
+		return nil, err
 	}
 
-	if after == "" {
-		after = "+"
+	var entries []streamEntry
+	for _, result := range results {
+		value, err := redis.Values(result, nil)
+		if err != nil || len(value) != 2 {
+			continue
+		}
+		streamID, err := redis.String(value[0], nil)
+		if err != nil {
+			continue
+		}
+		fields, err := redis.Values(value[1], nil)
+		if err != nil {
+			continue
+		}
+		var entry streamEntry
+		if err := redis.ScanStruct(fields, &entry); err != nil {
+			continue
+		}
+		entry.StreamID = streamID
+		entries = append(entries, entry)
 	}
+	return entries, nil
+}
 
-	results, err := redis.Values(conn.Do("XREVRANGE", redis.Args{}.Add(timeline.channelKey, after, before, "COUNT", "20")...))
+// Items returns a page of items, in the reverse order they were added. The
+// paging cursors are stream ids.
+func (timeline *redisStreamTimeline) Items(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error) {
+	conn, err := timeline.pool.GetContext(ctx)
 	if err != nil {
-		return microsub.Timeline{}, err
+		return microsub.Timeline{Items: []microsub.Item{}}, err
 	}
+	defer conn.Close()
 
-	var forRedis redisItem
+	limit := PageLimit(options)
 
-	var items []microsub.Item
-	for _, result := range results {
-		if value, ok := result.([]interface{}); ok {
-			id, ok2 := value[0].([]uint8)
-
-			if item, ok3 := value[1].([]interface{}); ok3 {
-				err = redis.ScanStruct(item, &forRedis)
-				if err != nil {
-					continue
-				}
-				item := forRedis.Item()
-				if ok2 {
-					item.ID = string(id)
-				}
-				items = append(items, item)
+	var entries []streamEntry
+	var paging microsub.Pagination
+	if options.Before != "" {
+		// one more entry than the limit, because the range includes the cursor
+		entries, err = timeline.entries(conn, "XRANGE", options.Before, "+", "COUNT", limit+2)
+		if len(entries) > 0 && entries[0].StreamID == options.Before {
+			entries = entries[1:]
+		}
+		more := len(entries) > limit
+		if more {
+			entries = entries[:limit]
+		}
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		if len(entries) > 0 {
+			paging.After = entries[len(entries)-1].StreamID
+			if more {
+				paging.Before = entries[0].StreamID
 			}
 		}
+	} else {
+		end := "+"
+		if options.After != "" {
+			end = options.After
+		}
+		entries, err = timeline.entries(conn, "XREVRANGE", end, "-", "COUNT", limit+2)
+		if len(entries) > 0 && entries[0].StreamID == options.After {
+			entries = entries[1:]
+		}
+		more := len(entries) > limit
+		if more {
+			entries = entries[:limit]
+			paging.After = entries[len(entries)-1].StreamID
+		}
+		if len(entries) > 0 && options.After != "" {
+			paging.Before = entries[0].StreamID
+		}
+	}
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	items := []microsub.Item{}
+	for _, entry := range entries {
+		item, read, err := timeline.item(conn, entry.ID)
+		if err != nil {
+			continue
+		}
+		if options.IsRead != nil && *options.IsRead != read {
+			continue
+		}
+		items = append(items, item)
 	}
 
 	return microsub.Timeline{
-		Items: items,
-		Paging: microsub.Pagination{
-			After: items[len(items)-1].ID,
-		},
+		Items:  items,
+		Paging: paging,
 	}, nil
 }
 
-func (timeline *redisStreamTimeline) AddItem(item microsub.Item) (bool, error) {
-	conn := timeline.pool.Get()
+// item returns the item with uid and if it is read. The starred state is set
+// in the item.
+func (timeline *redisStreamTimeline) item(conn redis.Conn, uid string) (microsub.Item, bool, error) {
+	var item microsub.Item
+	data, err := redis.Bytes(conn.Do("HGET", timeline.itemsKey(), uid))
+	if err == redis.ErrNil {
+		return item, false, ErrItemNotFound
+	} else if err != nil {
+		return item, false, err
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, false, err
+	}
+	read, err := redis.Bool(conn.Do("SISMEMBER", timeline.readKey(), uid))
+	if err != nil {
+		return item, false, err
+	}
+	item.Read = read
+	item.Starred, err = redis.Bool(conn.Do("SISMEMBER", timeline.starredKey(), uid))
+	if err != nil {
+		return item, false, err
+	}
+	return item, read, nil
+}
+
+func (timeline *redisStreamTimeline) AddItem(ctx context.Context, item microsub.Item) (bool, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if item.ID == "" {
+		item.ID = newItemID(timeline.channel)
+	}
+	normalizePublished(&item)
+
+	exists, err := redis.Bool(conn.Do("HEXISTS", timeline.idsKey(), item.ID))
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return false, fmt.Errorf("couldn't marshal item for redis: %s", err)
+	}
+
+	streamID, err := redis.String(conn.Do("XADD", timeline.channelKey, "*", "ID", item.ID, "Published", item.Published))
+	if err != nil {
+		return false, fmt.Errorf("adding item %s to stream %s: %v", item.ID, timeline.channelKey, err)
+	}
+	if _, err := conn.Do("HSET", timeline.itemsKey(), item.ID, data); err != nil {
+		return false, err
+	}
+	if _, err := conn.Do("HSET", timeline.idsKey(), item.ID, streamID); err != nil {
+		return false, err
+	}
+
+	return true, timeline.trim(conn)
+}
+
+// trim removes the oldest items when the stream is longer than maxStreamLength
+func (timeline *redisStreamTimeline) trim(conn redis.Conn) error {
+	n, err := redis.Int(conn.Do("XLEN", timeline.channelKey))
+	if err != nil || n <= maxStreamLength {
+		return err
+	}
+	entries, err := timeline.entries(conn, "XRANGE", "-", "+", "COUNT", n-maxStreamLength)
+	if err != nil {
+		return err
+	}
+	return timeline.removeEntries(conn, entries)
+}
+
+func (timeline *redisStreamTimeline) removeEntries(conn redis.Conn, entries []streamEntry) error {
+	for _, entry := range entries {
+		if _, err := conn.Do("XDEL", timeline.channelKey, entry.StreamID); err != nil {
+			return err
+		}
+		if _, err := conn.Do("HDEL", timeline.itemsKey(), entry.ID); err != nil {
+			return err
+		}
+		if _, err := conn.Do("HDEL", timeline.idsKey(), entry.ID); err != nil {
+			return err
+		}
+		if _, err := conn.Do("SREM", timeline.readKey(), entry.ID); err != nil {
+			return err
+		}
+		if _, err := conn.Do("SREM", timeline.starredKey(), entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of items in the stream
+func (timeline *redisStreamTimeline) Len(ctx context.Context) (int, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	return redis.Int(conn.Do("XLEN", timeline.channelKey))
+}
+
+// Count returns the number of unread items
+func (timeline *redisStreamTimeline) Count(ctx context.Context) (int, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return -1, err
+	}
 	defer conn.Close()
 
+	entries, err := timeline.entries(conn, "XRANGE", "-", "+")
+	if err != nil {
+		return -1, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		read, err := redis.Bool(conn.Do("SISMEMBER", timeline.readKey(), entry.ID))
+		if err != nil {
+			return -1, err
+		}
+		if !read {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// streamEntries returns the entries of the items with uids in the stream
+func (timeline *redisStreamTimeline) streamEntries(conn redis.Conn, uids []string) ([]streamEntry, error) {
+	var entries []streamEntry
+	for _, uid := range uids {
+		streamID, err := redis.String(conn.Do("HGET", timeline.idsKey(), uid))
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, streamEntry{StreamID: streamID, ID: uid})
+	}
+	return entries, nil
+}
+
+func (timeline *redisStreamTimeline) MarkRead(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	entries, err := timeline.streamEntries(conn, uids)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := conn.Do("SADD", timeline.readKey(), entry.ID); err != nil {
+			return fmt.Errorf("marking read for channel %s has failed: %s", timeline.channel, err)
+		}
+	}
+	return nil
+}
+
+func (timeline *redisStreamTimeline) RemoveItems(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	entries, err := timeline.streamEntries(conn, uids)
+	if err != nil {
+		return err
+	}
+	return timeline.removeEntries(conn, entries)
+}
+
+// UpdateItem replaces the data of the item, it keeps its place in the stream
+func (timeline *redisStreamTimeline) UpdateItem(ctx context.Context, item microsub.Item, markUnread bool) (bool, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	stored, read, err := timeline.item(conn, item.ID)
+	if err == ErrItemNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
 	if item.Published == "" {
-		item.Published = time.Now().Format(time.RFC3339)
+		item.Published = stored.Published
+	}
+	normalizePublished(&item)
+
+	storedHash, err := contentHash(stored)
+	if err != nil {
+		return false, err
+	}
+	hash, err := contentHash(item)
+	if err != nil {
+		return false, err
+	}
+	if hash == storedHash {
+		return false, nil
 	}
 
+	item.Read = false
 	data, err := json.Marshal(item)
 	if err != nil {
-		log.Printf("error while creating item for redis: %v\n", err)
+		return false, fmt.Errorf("couldn't marshal item for redis: %s", err)
+	}
+	if _, err := conn.Do("HSET", timeline.itemsKey(), item.ID, data); err != nil {
 		return false, err
 	}
 
-	args := redis.Args{}.Add(timeline.channelKey).Add("*").Add("ID").Add(item.ID).Add("Published").Add(item.Published).Add("Read").Add(item.Read).Add("Data").Add(data)
+	if markUnread && read {
+		if _, err := conn.Do("SREM", timeline.readKey(), item.ID); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
 
-	_, err = redis.String(conn.Do("XADD", args...))
+func (timeline *redisStreamTimeline) UpdateSources(ctx context.Context, uid string, sources []microsub.Source) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	_, _ = conn.Do("XTRIM", timeline.channelKey, "MAXLEN", "~", "250")
+	item, _, err := timeline.item(conn, uid)
+	if err != nil {
+		return err
+	}
 
-	return err == nil, err
+	item.Read = false
+	item.Sources = sources
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal item for redis: %s", err)
+	}
+	_, err = conn.Do("HSET", timeline.itemsKey(), uid, data)
+	return err
 }
 
-func (timeline *redisStreamTimeline) Count() (int, error) {
-	conn := timeline.pool.Get()
+func (timeline *redisStreamTimeline) MarkUnread(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	return redis.Int(conn.Do("XLEN", timeline.channelKey))
+	args := redis.Args{}.Add(timeline.readKey()).AddFlat(uids)
+	if _, err := conn.Do("SREM", args...); err != nil {
+		return fmt.Errorf("marking unread for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
 }
 
-func (timeline *redisStreamTimeline) MarkRead(uids []string) error {
-	// panic("implement me")
+// Star stars the items
+func (timeline *redisStreamTimeline) Star(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(timeline.starredKey()).AddFlat(uids)
+	if _, err := conn.Do("SADD", args...); err != nil {
+		return fmt.Errorf("starring items for channel %s has failed: %s", timeline.channel, err)
+	}
 	return nil
 }
 
-func (timeline *redisStreamTimeline) MarkUnread(uids []string) error {
-	// panic("implement me")
+// Unstar removes the star of the items
+func (timeline *redisStreamTimeline) Unstar(ctx context.Context, uids []string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(timeline.starredKey()).AddFlat(uids)
+	if _, err := conn.Do("SREM", args...); err != nil {
+		return fmt.Errorf("unstarring items for channel %s has failed: %s", timeline.channel, err)
+	}
 	return nil
 }
+
+// MarkReadUntil marks the item with uid and the items that were added before
+// it as read
+func (timeline *redisStreamTimeline) MarkReadUntil(ctx context.Context, uid string) error {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	streamID, err := redis.String(conn.Do("HGET", timeline.idsKey(), uid))
+	if err == redis.ErrNil {
+		return ErrItemNotFound
+	} else if err != nil {
+		return err
+	}
+
+	entries, err := timeline.entries(conn, "XRANGE", "-", streamID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := conn.Do("SADD", timeline.readKey(), entry.ID); err != nil {
+			return fmt.Errorf("marking read for channel %s has failed: %s", timeline.channel, err)
+		}
+	}
+	return nil
+}
+
+func (timeline *redisStreamTimeline) ItemsByUID(ctx context.Context, uids []string) ([]microsub.Item, error) {
+	conn, err := timeline.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var items []microsub.Item
+	for _, uid := range uids {
+		item, _, err := timeline.item(conn, uid)
+		if errors.Is(err, ErrItemNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 && len(uids) > 0 {
+		return nil, ErrItemNotFound
+	}
+	return items, nil
+}
@@ -0,0 +1,55 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package timeline_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pstuifzand/ekster/pkg/timeline"
+	"github.com/pstuifzand/ekster/pkg/timeline/timelinetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypes(t *testing.T) {
+	assert.Equal(t, []string{"null", "postgres-stream", "sorted-set", "stream"}, timeline.Types())
+}
+
+func TestRegister_Twice(t *testing.T) {
+	assert.Panics(t, func() {
+		timeline.Register("null", func(ctx context.Context, options timeline.Options) (timeline.Backend, error) {
+			return nil, nil
+		})
+	})
+}
+
+func TestCreate_UnknownType(t *testing.T) {
+	assert.Nil(t, timeline.Create(context.Background(), "0001", "unknown", nil, nil))
+}
+
+func TestCreate_MissingConnection(t *testing.T) {
+	assert.Nil(t, timeline.Create(context.Background(), "0001", "sorted-set", nil, nil))
+	assert.Nil(t, timeline.Create(context.Background(), "0001", "postgres-stream", nil, nil))
+}
+
+func TestNullTimeline(t *testing.T) {
+	timelinetest.Run(t, func(t *testing.T) (timeline.Backend, string) {
+		return timeline.Create(context.Background(), "0001", "null", nil, nil), ""
+	}, timelinetest.Options{Discards: true})
+}
@@ -0,0 +1,134 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package timeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+)
+
+// Retention is the policy that decides which items are removed from a
+// timeline. The zero value keeps all items.
+type Retention struct {
+	// MaxAge removes items that were published longer than MaxAge ago
+	MaxAge time.Duration
+	// MaxItems removes the items after the newest MaxItems items
+	MaxItems int
+	// KeepUnread keeps unread items, also when they are expired
+	KeepUnread bool
+	// KeepStarred keeps starred items, also when they are expired
+	KeepStarred bool
+}
+
+// Enabled returns true when the policy removes items
+func (r Retention) Enabled() bool {
+	return r.MaxAge > 0 || r.MaxItems > 0
+}
+
+// Expires returns true when the policy removes the item. Position is the
+// index of the item in the timeline, newest first.
+func (r Retention) Expires(item microsub.Item, position int, now time.Time) bool {
+	if r.KeepUnread && !item.Read {
+		return false
+	}
+	if r.KeepStarred && item.Starred {
+		return false
+	}
+	if r.MaxItems > 0 && position >= r.MaxItems {
+		return true
+	}
+	if r.MaxAge > 0 {
+		published, err := parsePublished(item.Published)
+		if err == nil && published.Before(now.Add(-r.MaxAge)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePublished parses the published date of an item, items without a
+// valid date are never too old
+func parsePublished(published string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, published)
+	if err != nil {
+		return time.Parse("2006-01-02T15:04:05Z0700", published)
+	}
+	return t, nil
+}
+
+// expirer is implemented by timelines that find expired items without
+// reading the whole timeline
+type expirer interface {
+	expired(ctx context.Context, policy Retention, now time.Time, limit int) ([]string, error)
+}
+
+// Expired returns the uids of at most limit items of the timeline that the
+// policy removes.
+func Expired(ctx context.Context, tl Backend, policy Retention, now time.Time, limit int) ([]string, error) {
+	if !policy.Enabled() || limit <= 0 {
+		return nil, nil
+	}
+	if e, ok := tl.(expirer); ok {
+		return e.expired(ctx, policy, now, limit)
+	}
+
+	items, err := ExpiredItems(ctx, tl.Items, policy, now, limit)
+	var uids []string
+	for _, item := range items {
+		uids = append(uids, item.ID)
+	}
+	return uids, err
+}
+
+// ItemsFunc returns a page of the items of a timeline, like Backend.Items
+type ItemsFunc func(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error)
+
+// ExpiredItems reads the timeline with items, and returns at most limit
+// items that the policy removes. It's used for timelines that can only be
+// read page by page, like the timelines of a Microsub server.
+func ExpiredItems(ctx context.Context, items ItemsFunc, policy Retention, now time.Time, limit int) ([]microsub.Item, error) {
+	var expired []microsub.Item
+	if !policy.Enabled() || limit <= 0 {
+		return expired, nil
+	}
+
+	position := 0
+	options := microsub.TimelineOptions{Limit: MaxLimit}
+	for {
+		page, err := items(ctx, options)
+		if err != nil {
+			return expired, err
+		}
+		for _, item := range page.Items {
+			if policy.Expires(item, position, now) {
+				expired = append(expired, item)
+				if len(expired) == limit {
+					return expired, nil
+				}
+			}
+			position++
+		}
+		if len(page.Items) == 0 || page.Paging.After == "" {
+			return expired, nil
+		}
+		options.After = page.Paging.After
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package timeline_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetention_Expires(t *testing.T) {
+	now := time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	old := microsub.Item{ID: "old", Published: "2022-01-01T12:00:00Z", Read: true}
+	recent := microsub.Item{ID: "recent", Published: "2022-01-31T12:00:00+0100", Read: true}
+	unknown := microsub.Item{ID: "unknown", Published: "yesterday", Read: true}
+
+	tests := []struct {
+		name     string
+		policy   timeline.Retention
+		item     microsub.Item
+		position int
+		want     bool
+	}{
+		{"no policy", timeline.Retention{}, old, 100, false},
+		{"older than max age", timeline.Retention{MaxAge: 7 * 24 * time.Hour}, old, 0, true},
+		{"newer than max age", timeline.Retention{MaxAge: 7 * 24 * time.Hour}, recent, 0, false},
+		{"unknown published", timeline.Retention{MaxAge: time.Hour}, unknown, 0, false},
+		{"after max items", timeline.Retention{MaxItems: 10}, recent, 10, true},
+		{"within max items", timeline.Retention{MaxItems: 10}, old, 9, false},
+		{"keep unread", timeline.Retention{MaxItems: 10, KeepUnread: true}, microsub.Item{ID: "unread"}, 20, false},
+		{"keep unread, read item", timeline.Retention{MaxItems: 10, KeepUnread: true}, old, 20, true},
+		{"keep starred", timeline.Retention{MaxItems: 10, KeepStarred: true}, microsub.Item{ID: "starred", Read: true, Starred: true}, 20, false},
+		{"keep starred, unstarred item", timeline.Retention{MaxItems: 10, KeepStarred: true}, old, 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.Expires(tt.item, tt.position, now))
+		})
+	}
+}
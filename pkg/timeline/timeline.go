@@ -18,15 +18,25 @@
 
 // Package timeline contains different types of timeline backends.
 //
+// "postgres-stream" uses Postgresql as a backend, it's the default
 // "sorted-set" uses Redis sorted sets as a backend
 // "stream" uses Redis 5 streams as a backend
 // "null" doesn't remember any items added to it
+//
+// The backends register themselves with Register. The conformance tests in
+// package timelinetest describe the behaviour that every backend has.
 package timeline
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
-	"encoding/json"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/pstuifzand/ekster/pkg/microsub"
 
@@ -36,40 +46,194 @@ import (
 // Backend specifies the interface for Timeline. It supports everything that is needed
 // for Ekster to implement the channel protocol for Microsub
 type Backend interface {
-	Items(before, after string) (microsub.Timeline, error)
-	Count() (int, error)
+	Items(ctx context.Context, options microsub.TimelineOptions) (microsub.Timeline, error)
+	Count(ctx context.Context) (int, error)
+	// Len returns the number of items in the timeline, read and unread
+	Len(ctx context.Context) (int, error)
+
+	AddItem(ctx context.Context, item microsub.Item) (bool, error)
+	// UpdateItem replaces the stored item with the same uid when its content
+	// changed. The item keeps its read state, unless markUnread is true.
+	// Returns true when the item was updated.
+	UpdateItem(ctx context.Context, item microsub.Item, markUnread bool) (bool, error)
+	// UpdateSources replaces the sources of the stored item with uid. The
+	// sources are not part of the content, so UpdateItem doesn't store them
+	// when only the sources changed. The content and read state of the item
+	// are not changed.
+	UpdateSources(ctx context.Context, uid string, sources []microsub.Source) error
+	MarkRead(ctx context.Context, uids []string) error
+	MarkUnread(ctx context.Context, uids []string) error
+	// Star and Unstar change the starred state of the items. Retention can
+	// keep starred items.
+	Star(ctx context.Context, uids []string) error
+	Unstar(ctx context.Context, uids []string) error
+	// MarkReadUntil marks the item with uid and all items published before it as read
+	MarkReadUntil(ctx context.Context, uid string) error
+	// ItemsByUID returns the items with the uids, in the same order. Uids
+	// that are not found are skipped, ErrItemNotFound is returned when none
+	// of the uids are found.
+	ItemsByUID(ctx context.Context, uid []string) ([]microsub.Item, error)
+	RemoveItems(ctx context.Context, uids []string) error
+}
+
+// GlobalChannel is the virtual channel that contains the items of all
+// channels of a user
+const GlobalChannel = "global"
+
+// Limits for the number of items in a page of a timeline
+const (
+	// DefaultLimit is used when the client doesn't choose a limit
+	DefaultLimit = 20
+	// MaxLimit is the maximum number of items the client can ask for
+	MaxLimit = 100
+)
 
-	AddItem(item microsub.Item) (bool, error)
-	MarkRead(uids []string) error
-	ItemsByUID(uid []string) ([]microsub.Item, error)
+// PageLimit returns the number of items in a page for the options
+func PageLimit(options microsub.TimelineOptions) int {
+	if options.Limit <= 0 {
+		return DefaultLimit
+	}
+	if options.Limit > MaxLimit {
+		return MaxLimit
+	}
+	return options.Limit
+}
 
-	// Not used at the moment
-	// MarkUnread(uids []string) error
+// DefaultType is the timeline type of channels without a configured type
+const DefaultType = "postgres-stream"
+
+// Options contain the channel and the connections that a Factory uses to
+// create a timeline
+type Options struct {
+	Channel string
+	// UserID is the owner of the channel. When it is set, the Factory returns
+	// an error for channels of other users.
+	UserID int
+	Pool   *redis.Pool
+	DB     *sql.DB
+}
+
+// Factory creates a timeline of a registered type
+type Factory func(ctx context.Context, options Options) (Backend, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Factory{}
+)
+
+// Register makes a timeline type available to Create. It panics when the
+// type is registered twice.
+func Register(timelineType string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("timeline: Register factory is nil")
+	}
+	if _, dup := registry[timelineType]; dup {
+		panic("timeline: Register called twice for type " + timelineType)
+	}
+	registry[timelineType] = factory
+}
+
+// Types returns the sorted list of registered timeline types
+func Types() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	var types []string
+	for timelineType := range registry {
+		types = append(types, timelineType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// create creates a timeline with the registered factory of timelineType
+func create(ctx context.Context, timelineType string, options Options) Backend {
+	registryLock.RLock()
+	factory, ok := registry[timelineType]
+	registryLock.RUnlock()
+
+	if !ok {
+		log.Printf("Error while creating %s: unknown timeline type %q", options.Channel, timelineType)
+		return nil
+	}
+
+	timeline, err := factory(ctx, options)
+	if err != nil {
+		log.Printf("Error while creating %s: %v", options.Channel, err)
+		return nil
+	}
+	return timeline
 }
 
 // Create creates a channel of the specified type. Return nil when the type
 // is not known.
-func Create(channel, timelineType string, pool *redis.Pool, db *sql.DB) Backend {
-	if timelineType == "null" {
-		timeline := &nullTimeline{channel: channel}
-		err := timeline.Init()
-		if err != nil {
-			return nil
-		}
-		return timeline
+func Create(ctx context.Context, channel, timelineType string, pool *redis.Pool, db *sql.DB) Backend {
+	return create(ctx, timelineType, Options{Channel: channel, Pool: pool, DB: db})
+}
+
+// CreateForUser creates a channel of the specified type, like Create. Returns
+// nil when the channel doesn't belong to the user.
+func CreateForUser(ctx context.Context, userID int, channel, timelineType string, pool *redis.Pool, db *sql.DB) Backend {
+	if userID == 0 {
+		log.Printf("Error while creating %s: no user", channel)
+		return nil
+	}
+
+	return create(ctx, timelineType, Options{Channel: channel, UserID: userID, Pool: pool, DB: db})
+}
+
+// checkOwner returns an error when options.UserID is set and the channel
+// doesn't belong to the user. It is used by the timelines that don't store
+// their items in the database.
+func checkOwner(ctx context.Context, options Options) error {
+	if options.UserID == 0 {
+		return nil
+	}
+	if options.DB == nil {
+		return fmt.Errorf("channel %s: owner can't be checked without database", options.Channel)
+	}
+	var id int
+	err := options.DB.QueryRowContext(ctx, `SELECT "id" FROM "channels" WHERE "uid" = $1 AND "user_id" = $2`, options.Channel, options.UserID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("channel %s not found: %w", options.Channel, microsub.ErrNotFound)
 	}
+	return err
+}
 
-	if timelineType == "postgres-stream" {
-		timeline := &postgresStream{database: db, channel: channel}
-		err := timeline.Init()
-		if err != nil {
-			log.Printf("Error while creating %s: %v", channel, err)
-			return nil
-		}
+// CreateGlobal creates the timeline of the GlobalChannel of the user. It
+// merges the items of all channels of the user. The items of channels of the
+// DefaultType are read from the database, the timelines of the channels of
+// other types are in channels, by uid.
+func CreateGlobal(ctx context.Context, userID int, db *sql.DB, channels map[string]Backend) Backend {
+	if userID == 0 {
+		log.Printf("Error while creating %s: no user", GlobalChannel)
+		return nil
+	}
+	timeline := &postgresStream{database: db, channel: GlobalChannel, userID: userID}
+	err := timeline.Init(ctx)
+	if err != nil {
+		log.Printf("Error while creating %s: %v", GlobalChannel, err)
+		return nil
+	}
+	if len(channels) == 0 {
 		return timeline
 	}
 
-	return nil
+	timelines := map[string]Backend{GlobalChannel: timeline}
+	for uid, tl := range channels {
+		timelines[uid] = tl
+	}
+	return Merge(timelines)
+}
+
+// newItemID returns a uid for an item that doesn't have one
+func newItemID(channel string) string {
+	// FIXME: This won't work when we receive the item multiple times
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", channel, time.Now().UnixNano())))
+	return hex.EncodeToString(h[:])
 }
 
 type redisItem struct {
@@ -78,9 +242,3 @@ type redisItem struct {
 	Read      bool
 	Data      []byte
 }
-
-func (ri *redisItem) Item() microsub.Item {
-	var item microsub.Item
-	_ = json.Unmarshal(ri.Data, &item)
-	return item
-}
@@ -0,0 +1,593 @@
+/*
+ *  Ekster is a microsub server
+ *  Copyright (c) 2022 The Ekster authors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package timelinetest contains the conformance tests for timeline backends.
+//
+// Every timeline.Backend has to pass Run. Backends that don't remember items,
+// like "null", pass Run with Options.Discards. The global timeline of a user
+// with channels of more types has to pass RunGlobal.
+package timelinetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pstuifzand/ekster/pkg/microsub"
+	"github.com/pstuifzand/ekster/pkg/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// Options changes the expected behaviour of a backend
+type Options struct {
+	// Discards is set for backends that don't store the items added to them
+	Discards bool
+}
+
+// NewTimeline returns a new, empty timeline for each test. The uids of the
+// items are prefixed with prefix, so the tests can share storage.
+type NewTimeline func(t *testing.T) (tl timeline.Backend, prefix string)
+
+// Run runs the conformance tests for the timelines created by newTimeline
+func Run(t *testing.T, newTimeline NewTimeline, options Options) {
+	if options.Discards {
+		t.Run("Discards", func(t *testing.T) { testDiscards(t, newTimeline) })
+		return
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, tl timeline.Backend, items []microsub.Item)
+	}{
+		{"Empty", testEmpty},
+		{"AddItem", testAddItem},
+		{"Items", testItems},
+		{"Paging", testPaging},
+		{"PagingSamePublished", testPagingSamePublished},
+		{"ItemsByUID", testItemsByUID},
+		{"MarkRead", testMarkRead},
+		{"Len", testLen},
+		{"MarkReadUntil", testMarkReadUntil},
+		{"RemoveItems", testRemoveItems},
+		{"UpdateItem", testUpdateItem},
+		{"UpdateSources", testUpdateSources},
+		{"Expired", testExpired},
+		{"Star", testStar},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tl, prefix := newTimeline(t)
+			if tl == nil {
+				t.Fatal("timeline was not created")
+			}
+			tt.test(t, tl, newItems(prefix, 5))
+		})
+	}
+}
+
+// newItems returns n items, oldest first, published a minute apart
+func newItems(prefix string, n int) []microsub.Item {
+	published := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	var items []microsub.Item
+	for i := 0; i < n; i++ {
+		items = append(items, microsub.Item{
+			Type:      "entry",
+			ID:        fmt.Sprintf("%sitem-%d", prefix, i),
+			Name:      fmt.Sprintf("Item %d", i),
+			Published: published.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+	}
+	return items
+}
+
+func addItems(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	t.Helper()
+	for _, item := range items {
+		added, err := tl.AddItem(context.Background(), item)
+		if assert.NoError(t, err, "add %s", item.ID) {
+			assert.True(t, added, "add %s", item.ID)
+		}
+	}
+}
+
+func assertCount(t *testing.T, tl timeline.Backend, expected int) {
+	t.Helper()
+	count, err := tl.Count(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, count, "unread count")
+	}
+}
+
+func assertLen(t *testing.T, tl timeline.Backend, expected int) {
+	t.Helper()
+	n, err := tl.Len(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, n, "number of items")
+	}
+}
+
+func uids(items []microsub.Item) []string {
+	var ids []string
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+// newestFirst returns the uids of the items in reverse order
+func newestFirst(items []microsub.Item) []string {
+	var ids []string
+	for i := len(items) - 1; i >= 0; i-- {
+		ids = append(ids, items[i].ID)
+	}
+	return ids
+}
+
+func testDiscards(t *testing.T, newTimeline NewTimeline) {
+	tl, prefix := newTimeline(t)
+	if tl == nil {
+		t.Fatal("timeline was not created")
+	}
+	item := newItems(prefix, 1)[0]
+
+	added, err := tl.AddItem(context.Background(), item)
+	assert.NoError(t, err)
+	assert.False(t, added)
+	assertCount(t, tl, 0)
+	assertLen(t, tl, 0)
+
+	page, err := tl.Items(context.Background(), microsub.TimelineOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, page.Items)
+	}
+
+	_, err = tl.ItemsByUID(context.Background(), []string{item.ID})
+	assert.True(t, errors.Is(err, microsub.ErrNotFound))
+
+	updated, err := tl.UpdateItem(context.Background(), item, false)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+
+	err = tl.UpdateSources(context.Background(), item.ID, []microsub.Source{{ID: "1"}})
+	assert.True(t, errors.Is(err, microsub.ErrNotFound))
+
+	assert.NoError(t, tl.Star(context.Background(), []string{item.ID}))
+
+	expired, err := timeline.Expired(context.Background(), tl, timeline.Retention{MaxItems: 1}, time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, expired)
+}
+
+func testEmpty(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	assertCount(t, tl, 0)
+
+	page, err := tl.Items(context.Background(), microsub.TimelineOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, page.Items)
+	}
+}
+
+func testAddItem(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+	assertCount(t, tl, len(items))
+
+	added, err := tl.AddItem(context.Background(), items[0])
+	assert.NoError(t, err)
+	assert.False(t, added, "same item again")
+	assertCount(t, tl, len(items))
+}
+
+func testItems(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+
+	page, err := tl.Items(context.Background(), microsub.TimelineOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, newestFirst(items), uids(page.Items), "newest first")
+		for _, item := range page.Items {
+			assert.False(t, item.Read)
+		}
+	}
+}
+
+func testPaging(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+
+	var seen []string
+	options := microsub.TimelineOptions{Limit: 2}
+	for i := 0; i < len(items); i++ {
+		page, err := tl.Items(context.Background(), options)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, len(page.Items), 2, "limit")
+		seen = append(seen, uids(page.Items)...)
+		if len(page.Items) == 0 || page.Paging.After == "" {
+			break
+		}
+		options.After = page.Paging.After
+	}
+	assert.Equal(t, newestFirst(items), seen, "all items once, newest first")
+}
+
+// testPagingSamePublished checks that items published at the same time are
+// not skipped or repeated between pages
+func testPagingSamePublished(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	for i := range items {
+		items[i].Published = items[0].Published
+	}
+	addItems(t, tl, items)
+
+	var pages []microsub.Timeline
+	var seen []string
+	options := microsub.TimelineOptions{Limit: 2}
+	for i := 0; i < len(items); i++ {
+		page, err := tl.Items(context.Background(), options)
+		if !assert.NoError(t, err) {
+			return
+		}
+		pages = append(pages, page)
+		seen = append(seen, uids(page.Items)...)
+		if len(page.Items) == 0 || page.Paging.After == "" {
+			break
+		}
+		options.After = page.Paging.After
+	}
+	assert.ElementsMatch(t, uids(items), seen, "all items once")
+
+	if assert.GreaterOrEqual(t, len(pages), 2) {
+		page, err := tl.Items(context.Background(), microsub.TimelineOptions{Limit: 2, Before: pages[1].Paging.Before})
+		if assert.NoError(t, err) {
+			assert.Equal(t, uids(pages[0].Items), uids(page.Items), "previous page")
+		}
+	}
+}
+
+func testItemsByUID(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+
+	found, err := tl.ItemsByUID(context.Background(), []string{items[1].ID, items[3].ID})
+	if assert.NoError(t, err) && assert.Len(t, found, 2) {
+		assert.Equal(t, items[1].ID, found[0].ID)
+		assert.Equal(t, items[1].Name, found[0].Name)
+		assert.Equal(t, items[3].ID, found[1].ID)
+	}
+
+	found, err = tl.ItemsByUID(context.Background(), []string{items[1].ID, "unknown", items[3].ID})
+	if assert.NoError(t, err, "unknown items are skipped") && assert.Len(t, found, 2) {
+		assert.Equal(t, items[1].ID, found[0].ID)
+		assert.Equal(t, items[3].ID, found[1].ID)
+	}
+
+	_, err = tl.ItemsByUID(context.Background(), []string{"unknown"})
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "unknown item")
+}
+
+func testMarkRead(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+
+	assert.NoError(t, tl.MarkRead(context.Background(), []string{items[0].ID, items[2].ID}))
+	assertCount(t, tl, len(items)-2)
+
+	found, err := tl.ItemsByUID(context.Background(), []string{items[0].ID, items[1].ID})
+	if assert.NoError(t, err) && assert.Len(t, found, 2) {
+		assert.True(t, found[0].Read)
+		assert.False(t, found[1].Read)
+	}
+
+	unread := false
+	page, err := tl.Items(context.Background(), microsub.TimelineOptions{IsRead: &unread})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{items[4].ID, items[3].ID, items[1].ID}, uids(page.Items))
+	}
+
+	assert.NoError(t, tl.MarkUnread(context.Background(), []string{items[0].ID}))
+	assertCount(t, tl, len(items)-1)
+}
+
+// testLen checks that read items are part of the length of the timeline
+func testLen(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	assertLen(t, tl, 0)
+
+	addItems(t, tl, items)
+	assertLen(t, tl, len(items))
+
+	assert.NoError(t, tl.MarkRead(context.Background(), uids(items)))
+	assertCount(t, tl, 0)
+	assertLen(t, tl, len(items))
+
+	assert.NoError(t, tl.RemoveItems(context.Background(), []string{items[0].ID}))
+	assertLen(t, tl, len(items)-1)
+}
+
+func testMarkReadUntil(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+
+	assert.NoError(t, tl.MarkReadUntil(context.Background(), items[2].ID))
+	assertCount(t, tl, 2)
+
+	found, err := tl.ItemsByUID(context.Background(), []string{items[2].ID, items[3].ID})
+	if assert.NoError(t, err) && assert.Len(t, found, 2) {
+		assert.True(t, found[0].Read)
+		assert.False(t, found[1].Read)
+	}
+}
+
+func testRemoveItems(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+
+	assert.NoError(t, tl.RemoveItems(context.Background(), []string{items[1].ID}))
+	assertCount(t, tl, len(items)-1)
+
+	page, err := tl.Items(context.Background(), microsub.TimelineOptions{})
+	if assert.NoError(t, err) {
+		assert.NotContains(t, uids(page.Items), items[1].ID)
+	}
+
+	_, err = tl.ItemsByUID(context.Background(), []string{items[1].ID})
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "removed item")
+}
+
+func testUpdateItem(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+	assert.NoError(t, tl.MarkRead(context.Background(), []string{items[0].ID}))
+
+	updated, err := tl.UpdateItem(context.Background(), items[0], false)
+	assert.NoError(t, err)
+	assert.False(t, updated, "same content")
+
+	changed := items[0]
+	changed.Name = "Changed"
+	updated, err = tl.UpdateItem(context.Background(), changed, false)
+	assert.NoError(t, err)
+	assert.True(t, updated, "changed content")
+
+	found, err := tl.ItemsByUID(context.Background(), []string{changed.ID})
+	if assert.NoError(t, err) && assert.Len(t, found, 1) {
+		assert.Equal(t, "Changed", found[0].Name)
+		assert.True(t, found[0].Read, "keeps read state")
+	}
+
+	changed.Name = "Changed again"
+	updated, err = tl.UpdateItem(context.Background(), changed, true)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assertCount(t, tl, len(items))
+
+	unknown := changed
+	unknown.ID = "unknown"
+	updated, err = tl.UpdateItem(context.Background(), unknown, false)
+	assert.NoError(t, err)
+	assert.False(t, updated, "unknown item")
+}
+
+func testUpdateSources(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	items[0].Source = &microsub.Source{ID: "1", URL: "https://example.com/feed"}
+	addItems(t, tl, items)
+	assert.NoError(t, tl.MarkRead(context.Background(), []string{items[0].ID}))
+
+	// a feed delivers the same content again, with other sources
+	sources := []microsub.Source{*items[0].Source, {ID: "2", URL: "https://example.org/feed"}}
+	merged := items[0]
+	merged.Sources = sources
+	updated, err := tl.UpdateItem(context.Background(), merged, false)
+	assert.NoError(t, err)
+	assert.False(t, updated, "sources are not part of the content")
+
+	assert.NoError(t, tl.UpdateSources(context.Background(), items[0].ID, sources))
+
+	found, err := tl.ItemsByUID(context.Background(), []string{items[0].ID})
+	if assert.NoError(t, err) && assert.Len(t, found, 1) {
+		assert.Equal(t, sources, found[0].Sources)
+		assert.Equal(t, items[0].Name, found[0].Name)
+		assert.True(t, found[0].Read, "keeps read state")
+	}
+
+	err = tl.UpdateSources(context.Background(), "unknown", sources)
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "unknown item")
+}
+
+func testExpired(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+
+	// ten minutes after the first item was published
+	now := time.Date(2022, 1, 1, 12, 10, 0, 0, time.UTC)
+	expired := func(policy timeline.Retention, limit int) []string {
+		t.Helper()
+		uids, err := timeline.Expired(context.Background(), tl, policy, now, limit)
+		assert.NoError(t, err)
+		return uids
+	}
+
+	assert.Empty(t, expired(timeline.Retention{}, 10), "no policy")
+	assert.ElementsMatch(t, uids(items[:2]), expired(timeline.Retention{MaxItems: 3}, 10), "max items")
+	assert.ElementsMatch(t, uids(items[:3]), expired(timeline.Retention{MaxAge: 7*time.Minute + 30*time.Second}, 10), "max age")
+	assert.ElementsMatch(t, uids(items[:3]), expired(timeline.Retention{MaxAge: 9 * time.Minute, MaxItems: 2}, 10), "max age or items")
+	assert.Len(t, expired(timeline.Retention{MaxItems: 1}, 2), 2, "limit")
+	assert.Empty(t, expired(timeline.Retention{MaxItems: 1, KeepUnread: true}, 10), "keep unread")
+
+	// removing the expired items leaves the newest items
+	assert.NoError(t, tl.RemoveItems(context.Background(), expired(timeline.Retention{MaxItems: 3}, 10)))
+	assert.Empty(t, expired(timeline.Retention{MaxItems: 3}, 10))
+	page, err := tl.Items(context.Background(), microsub.TimelineOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, newestFirst(items[2:]), uids(page.Items))
+	}
+}
+
+func testStar(t *testing.T, tl timeline.Backend, items []microsub.Item) {
+	addItems(t, tl, items)
+	assert.NoError(t, tl.MarkRead(context.Background(), uids(items)))
+	assert.NoError(t, tl.Star(context.Background(), uids(items[:2])))
+
+	found, err := tl.ItemsByUID(context.Background(), uids(items))
+	if assert.NoError(t, err) && assert.Len(t, found, 5) {
+		for _, item := range found {
+			starred := item.ID == items[0].ID || item.ID == items[1].ID
+			assert.Equal(t, starred, item.Starred, "starred %s", item.ID)
+		}
+	}
+	page, err := tl.Items(context.Background(), microsub.TimelineOptions{})
+	if assert.NoError(t, err) && assert.Len(t, page.Items, 5) {
+		assert.True(t, page.Items[4].Starred, "oldest item is starred")
+		assert.False(t, page.Items[0].Starred, "newest item is not starred")
+	}
+
+	now := time.Date(2022, 1, 1, 12, 10, 0, 0, time.UTC)
+	expired, err := timeline.Expired(context.Background(), tl, timeline.Retention{MaxItems: 1, KeepStarred: true}, now, 10)
+	if assert.NoError(t, err) {
+		assert.ElementsMatch(t, uids(items[2:4]), expired, "keep starred")
+	}
+
+	assert.NoError(t, tl.Unstar(context.Background(), []string{items[0].ID}))
+	expired, err = timeline.Expired(context.Background(), tl, timeline.Retention{MaxItems: 1, KeepStarred: true}, now, 10)
+	if assert.NoError(t, err) {
+		assert.ElementsMatch(t, append(uids(items[2:4]), items[0].ID), expired, "unstarred")
+	}
+
+	// updating the content keeps the starred state
+	updated := items[1]
+	updated.Name = "Updated"
+	_, err = tl.UpdateItem(context.Background(), updated, false)
+	assert.NoError(t, err)
+	found, err = tl.ItemsByUID(context.Background(), []string{items[1].ID})
+	if assert.NoError(t, err) && assert.Len(t, found, 1) {
+		assert.True(t, found[0].Starred, "keeps starred state")
+	}
+}
+
+// NewGlobal returns the new, empty timelines of the channels of a user and the
+// global timeline that merges them, for each test. The uids of the items are
+// prefixed with prefix.
+type NewGlobal func(t *testing.T) (global timeline.Backend, channels []timeline.Backend, prefix string)
+
+// RunGlobal runs the tests for the global timeline of a user, with channels
+// of more timeline types
+func RunGlobal(t *testing.T, newGlobal NewGlobal) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, global timeline.Backend, channels []timeline.Backend, items []microsub.Item)
+	}{
+		{"Paging", testGlobalPaging},
+		{"ItemsByUID", testGlobalItemsByUID},
+		{"MarkRead", testGlobalMarkRead},
+		{"MarkReadUntil", testGlobalMarkReadUntil},
+		{"AddItem", testGlobalAddItem},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global, channels, prefix := newGlobal(t)
+			if global == nil || len(channels) == 0 {
+				t.Fatal("timelines were not created")
+			}
+			items := newItems(prefix, 7)
+			for i, item := range items {
+				addItems(t, channels[i%len(channels)], []microsub.Item{item})
+			}
+			tt.test(t, global, channels, items)
+		})
+	}
+}
+
+func testGlobalPaging(t *testing.T, global timeline.Backend, channels []timeline.Backend, items []microsub.Item) {
+	assertCount(t, global, len(items))
+
+	var pages []microsub.Timeline
+	var seen []string
+	options := microsub.TimelineOptions{Limit: 2}
+	for i := 0; i < len(items); i++ {
+		page, err := global.Items(context.Background(), options)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, item := range page.Items {
+			assert.NotEmpty(t, item.Channel, "channel of %s", item.ID)
+		}
+		pages = append(pages, page)
+		seen = append(seen, uids(page.Items)...)
+		if len(page.Items) == 0 || page.Paging.After == "" {
+			break
+		}
+		options.After = page.Paging.After
+	}
+	assert.Equal(t, newestFirst(items), seen, "all items once, newest first")
+	assert.Empty(t, pages[0].Paging.Before, "no newer items")
+
+	// paging back from the last page returns the same pages
+	for i := len(pages) - 1; i > 0; i-- {
+		if !assert.NotEmpty(t, pages[i].Paging.Before, "page %d", i) {
+			return
+		}
+		page, err := global.Items(context.Background(), microsub.TimelineOptions{Limit: 2, Before: pages[i].Paging.Before})
+		if assert.NoError(t, err) {
+			assert.Equal(t, uids(pages[i-1].Items), uids(page.Items), "page %d", i-1)
+		}
+	}
+}
+
+func testGlobalItemsByUID(t *testing.T, global timeline.Backend, channels []timeline.Backend, items []microsub.Item) {
+	found, err := global.ItemsByUID(context.Background(), []string{items[2].ID, "unknown", items[1].ID})
+	if assert.NoError(t, err) && assert.Len(t, found, 2) {
+		assert.Equal(t, items[2].ID, found[0].ID)
+		assert.Equal(t, items[1].ID, found[1].ID)
+		assert.NotEqual(t, found[0].Channel, found[1].Channel)
+	}
+
+	_, err = global.ItemsByUID(context.Background(), []string{"unknown"})
+	assert.True(t, errors.Is(err, microsub.ErrNotFound), "unknown item")
+}
+
+// channelItems returns the number of items, starting at index from, that
+// RunGlobal added to channel i of n channels
+func channelItems(items []microsub.Item, from, i, n int) int {
+	count := 0
+	for j := from; j < len(items); j++ {
+		if j%n == i {
+			count++
+		}
+	}
+	return count
+}
+
+func testGlobalMarkRead(t *testing.T, global timeline.Backend, channels []timeline.Backend, items []microsub.Item) {
+	// the first item of each channel
+	n := len(channels)
+	assert.NoError(t, global.MarkRead(context.Background(), uids(items[:n])))
+	assertCount(t, global, len(items)-n)
+	for i, tl := range channels {
+		assertCount(t, tl, channelItems(items, n, i, n))
+	}
+
+	assert.NoError(t, global.MarkUnread(context.Background(), []string{items[0].ID}))
+	assertCount(t, global, len(items)-n+1)
+	assertCount(t, channels[0], channelItems(items, 0, 0, n))
+}
+
+func testGlobalMarkReadUntil(t *testing.T, global timeline.Backend, channels []timeline.Backend, items []microsub.Item) {
+	assert.NoError(t, global.MarkReadUntil(context.Background(), items[3].ID))
+	assertCount(t, global, len(items)-4)
+	for i, tl := range channels {
+		assertCount(t, tl, channelItems(items, 4, i, len(channels)))
+	}
+}
+
+func testGlobalAddItem(t *testing.T, global timeline.Backend, channels []timeline.Backend, items []microsub.Item) {
+	_, err := global.AddItem(context.Background(), newItems("other-", 1)[0])
+	assert.True(t, errors.Is(err, microsub.ErrInvalidRequest))
+}